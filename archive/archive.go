@@ -0,0 +1,213 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxFileSize limits the size of the files which are read from an archive into memory
+const maxFileSize = 16 << 20
+
+// File is a file read from a system backup. Name is relative to the root of the archive, without a leading ./
+type File struct {
+	Name    string
+	Size    int64
+	Content []byte
+}
+
+// Entry is a regular file in an archive, with the sha256 hash of its content
+type Entry struct {
+	Name    string    `json:"name" yaml:"name"`
+	Size    int64     `json:"size" yaml:"size"`
+	ModTime time.Time `json:"modtime" yaml:"modtime"`
+	Sha256  string    `json:"sha256" yaml:"sha256"`
+}
+
+// ExpectedMembers are the files which every system backup holds
+var ExpectedMembers = []string{ConfigName}
+
+// FormatError is returned when a stream is not a valid gzipped tar archive.
+// Layer is gzip when the compression is invalid, and tar when the decompressed stream is not a valid tar archive.
+type FormatError struct {
+	Layer string
+	Err   error
+}
+
+func (e *FormatError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// errorReader remembers the last error of a reader other than io.EOF, so the layer of a stream which failed can be found
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// Archive is the content of a system backup: every regular file as an Entry, and the files which were read into memory
+type Archive struct {
+	Entries []Entry
+	Files   []File
+}
+
+// Read reads a gzipped tar stream, and returns all of its entries with the content of the files for which keep returns true.
+// Files larger than 16 MiB are never read into memory.
+// The gzip checksum is verified as well, so a truncated or corrupt archive returns an error with the entries which could be read.
+// Errors of the archive itself are a FormatError, errors of r are returned as they are.
+func Read(r io.Reader, keep func(name string) bool) (Archive, error) {
+	source := &errorReader{r: r}
+	output, err := read(source, keep)
+	if err == nil || source.err != nil {
+		return output, err
+	}
+	if _, ok := err.(*FormatError); ok {
+		return output, err
+	}
+	return output, &FormatError{Layer: "tar", Err: err}
+}
+
+func read(source io.Reader, keep func(name string) bool) (Archive, error) {
+	var output Archive
+
+	gz, err := gzip.NewReader(source)
+	if err != nil {
+		return output, &FormatError{Layer: "gzip", Err: err}
+	}
+	defer gz.Close()
+
+	decompressed := &errorReader{r: gz}
+	gzipError := func(err error) error {
+		if decompressed.err != nil {
+			return &FormatError{Layer: "gzip", Err: err}
+		}
+		return err
+	}
+
+	tr := tar.NewReader(decompressed)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			// The tar stream ends before the gzip stream, which holds the checksum
+			_, err = io.Copy(ioutil.Discard, decompressed)
+			return output, gzipError(err)
+		}
+		if err != nil {
+			return output, gzipError(err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		entry := Entry{Name: CleanName(header.Name), Size: header.Size, ModTime: header.ModTime}
+		hash := sha256.New()
+		var content bytes.Buffer
+		var w io.Writer = hash
+		read := header.Size <= maxFileSize && keep(entry.Name)
+		if read {
+			w = io.MultiWriter(hash, &content)
+		}
+
+		if _, err = io.Copy(w, tr); err != nil {
+			return output, gzipError(err)
+		}
+		entry.Sha256 = hex.EncodeToString(hash.Sum(nil))
+		output.Entries = append(output.Entries, entry)
+		if read {
+			output.Files = append(output.Files, File{Name: entry.Name, Size: entry.Size, Content: content.Bytes()})
+		}
+	}
+}
+
+// Entry returns the entry with the given name
+func (a Archive) Entry(name string) (Entry, bool) {
+	for _, e := range a.Entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// CleanName returns the name of a member of an archive without leading ./ or /
+func CleanName(name string) string {
+	return strings.TrimLeft(path.Clean("/"+name), "/")
+}
+
+// MissingMembers returns the ExpectedMembers which are not in an archive
+func (a Archive) MissingMembers() []string {
+	var output []string
+	for _, name := range ExpectedMembers {
+		if _, ok := a.Entry(name); !ok {
+			output = append(output, name)
+		}
+	}
+	return output
+}
+
+// Find returns the file with the given name
+func Find(files []File, name string) (File, bool) {
+	for _, f := range files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// IsText reports whether content looks like text, which is the case when it holds no NUL bytes
+func IsText(content []byte) bool {
+	return bytes.IndexByte(content, 0) < 0
+}
+
+// Extractor reads a gzipped tar stream while it is written, so an archive can be read while it is downloaded.
+// Writes never fail: when the stream is not a valid archive, the rest of it is discarded and the error is returned by Close.
+type Extractor struct {
+	w       *io.PipeWriter
+	done    chan struct{}
+	archive Archive
+	err     error
+}
+
+// NewExtractor starts an Extractor for the files for which keep returns true
+func NewExtractor(keep func(name string) bool) *Extractor {
+	r, w := io.Pipe()
+	e := &Extractor{w: w, done: make(chan struct{})}
+
+	go func() {
+		defer close(e.done)
+		e.archive, e.err = Read(r, keep)
+		// Drain the stream, so the writer does not block on a reader which is gone
+		io.Copy(ioutil.Discard, r)
+	}()
+	return e
+}
+
+func (e *Extractor) Write(p []byte) (int, error) {
+	return e.w.Write(p)
+}
+
+// Close ends the stream, and returns the archive which was read with the error of reading it
+func (e *Extractor) Close() (Archive, error) {
+	e.w.Close()
+	<-e.done
+	return e.archive, e.err
+}
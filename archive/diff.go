@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"sort"
+	"strings"
+)
+
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// Operation is what happened to a line between two texts
+type Operation int
+
+const (
+	LineEqual Operation = iota
+	LineInserted
+	LineDeleted
+)
+
+// Line is a line of a line-by-line comparison
+type Line struct {
+	Operation Operation
+	Text      string
+}
+
+// Change is a file which differs between two archives
+type Change struct {
+	Name     string
+	Status   string
+	FromSize int64
+	ToSize   int64
+}
+
+// CommandChanges counts the added and removed lines of a configuration for a type of command, e.g. add lb vserver
+type CommandChanges struct {
+	Command string
+	Added   int
+	Removed int
+}
+
+// commandGroups are the first words of commands which take a second word to name the object, e.g. add lb vserver, set ns param
+var commandGroups = map[string]bool{
+	"aaa": true, "analytics": true, "appflow": true, "appfw": true, "appqoe": true, "audit": true, "authentication": true,
+	"authorization": true, "autoscale": true, "bot": true, "cache": true, "cmp": true, "cr": true, "cs": true, "db": true,
+	"dns": true, "feo": true, "filter": true, "gslb": true, "ica": true, "ipsec": true, "lb": true, "lldp": true, "lsn": true,
+	"network": true, "ns": true, "ntp": true, "policy": true, "pq": true, "qos": true, "rdp": true, "reputation": true,
+	"responder": true, "rewrite": true, "rnat": true, "smpp": true, "snmp": true, "spillover": true, "ssl": true,
+	"stream": true, "subscriber": true, "system": true, "tm": true, "transform": true, "tunnel": true, "ulfd": true,
+	"user": true, "videooptimization": true, "vpn": true,
+}
+
+// Compare returns the files which were added, removed or changed between two archives, sorted by name.
+// Entries are compared by their hash, except ns.conf when it was read from both archives, which is compared after normalization.
+func Compare(from Archive, to Archive) []Change {
+	var output []Change
+
+	toEntries := make(map[string]Entry, len(to.Entries))
+	for _, e := range to.Entries {
+		toEntries[e.Name] = e
+	}
+
+	for _, f := range from.Entries {
+		t, ok := toEntries[f.Name]
+		delete(toEntries, f.Name)
+		switch {
+		case !ok:
+			output = append(output, Change{Name: f.Name, Status: ChangeRemoved, FromSize: f.Size})
+		case f.Sha256 != t.Sha256 && !equalConfigs(f.Name, from, to):
+			output = append(output, Change{Name: f.Name, Status: ChangeChanged, FromSize: f.Size, ToSize: t.Size})
+		}
+	}
+	for _, t := range toEntries {
+		output = append(output, Change{Name: t.Name, Status: ChangeAdded, ToSize: t.Size})
+	}
+
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Name < output[j].Name
+	})
+	return output
+}
+
+func equalConfigs(name string, from Archive, to Archive) bool {
+	if name != ConfigName {
+		return false
+	}
+	f, ok := Find(from.Files, name)
+	if !ok {
+		return false
+	}
+	t, ok := Find(to.Files, name)
+	if !ok {
+		return false
+	}
+	return NormalizeConfig(string(f.Content)) == NormalizeConfig(string(t.Content))
+}
+
+// DiffLines compares two texts line by line
+func DiffLines(from string, to string) []Line {
+	var output []Line
+
+	dmp := diffmatchpatch.New()
+	// A diff which is not minimal is of little use to review a configuration, so it may take as long as it needs
+	dmp.DiffTimeout = 0
+	fromChars, toChars, lines := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(fromChars, toChars, false), lines)
+
+	for _, d := range diffs {
+		operation := LineEqual
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			operation = LineInserted
+		case diffmatchpatch.DiffDelete:
+			operation = LineDeleted
+		}
+		for _, l := range strings.SplitAfter(d.Text, "\n") {
+			if l != "" {
+				output = append(output, Line{Operation: operation, Text: strings.TrimSuffix(l, "\n")})
+			}
+		}
+	}
+	return output
+}
+
+// UnifiedDiff formats a line-by-line comparison as a unified diff, with context lines around every change.
+// It returns an empty string when the texts are equal.
+func UnifiedDiff(fromName string, toName string, lines []Line, context int) string {
+	var changes []int
+	for i, l := range lines {
+		if l.Operation != LineEqual {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+
+	for i := 0; i < len(changes); {
+		// A hunk holds all changes which are at most 2 * context lines apart
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*context+1 {
+			j++
+		}
+		start := changes[i] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changes[j] + context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		var fromStart, toStart, fromCount, toCount int
+		for _, l := range lines[:start] {
+			if l.Operation != LineInserted {
+				fromStart++
+			}
+			if l.Operation != LineDeleted {
+				toStart++
+			}
+		}
+		for _, l := range lines[start:end] {
+			if l.Operation != LineInserted {
+				fromCount++
+			}
+			if l.Operation != LineDeleted {
+				toCount++
+			}
+		}
+		if fromCount > 0 {
+			fromStart++
+		}
+		if toCount > 0 {
+			toStart++
+		}
+
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", fromStart, fromCount, toStart, toCount)
+		for _, l := range lines[start:end] {
+			switch l.Operation {
+			case LineInserted:
+				b.WriteString("+")
+			case LineDeleted:
+				b.WriteString("-")
+			default:
+				b.WriteString(" ")
+			}
+			b.WriteString(l.Text)
+			b.WriteString("\n")
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// CountCommands counts the added and removed commands of a configuration per type of command, sorted by command.
+// Comments and empty lines are not counted.
+func CountCommands(lines []Line) []CommandChanges {
+	counts := make(map[string]*CommandChanges)
+	var commands []string
+	for _, l := range lines {
+		if l.Operation == LineEqual {
+			continue
+		}
+		command := GetCommandType(l.Text)
+		if command == "" {
+			continue
+		}
+
+		c, ok := counts[command]
+		if !ok {
+			c = &CommandChanges{Command: command}
+			counts[command] = c
+			commands = append(commands, command)
+		}
+		if l.Operation == LineInserted {
+			c.Added++
+		} else {
+			c.Removed++
+		}
+	}
+
+	sort.Strings(commands)
+	var output []CommandChanges
+	for _, command := range commands {
+		output = append(output, *counts[command])
+	}
+	return output
+}
+
+// GetCommandType returns the verb and the object type of a configuration line, e.g. bind lb vserver for bind lb vserver lb1 svc1.
+// It returns an empty string for comments and empty lines.
+func GetCommandType(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return ""
+	}
+	if len(fields) == 1 {
+		return fields[0]
+	}
+	if len(fields) > 2 && commandGroups[strings.ToLower(fields[1])] {
+		return strings.Join(fields[:3], " ")
+	}
+	return strings.Join(fields[:2], " ")
+}
@@ -0,0 +1,167 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	LevelBasic   = "basic"
+	LevelFull    = "full"
+	LevelUnknown = "unknown"
+)
+
+// fullLevelPrefixes are directories which are only part of a system backup with level full
+var fullLevelPrefixes = []string{
+	"var/learnt_data/",
+	"var/netscaler/inbuilt_db/",
+	"var/netscaler/locdb/",
+	"var/ns_gui/",
+	"var/nstemplates/",
+	"var/vpn/",
+	"var/wi/",
+}
+
+// firmwareBuild splits a firmware version into the release and the build number, e.g. NS13.0 Build 85.19
+var firmwareBuild = regexp.MustCompile(`^NS(\S+)\s+Build\s+(\S+)$`)
+
+// Info summarizes the content of a system backup
+type Info struct {
+	Name      string         `json:"name" yaml:"name"`
+	Level     string         `json:"level" yaml:"level"`
+	Firmware  string         `json:"firmware,omitempty" yaml:"firmware,omitempty"`
+	Release   string         `json:"release,omitempty" yaml:"release,omitempty"`
+	Build     string         `json:"build,omitempty" yaml:"build,omitempty"`
+	Hostname  string         `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Nsip      string         `json:"nsip,omitempty" yaml:"nsip,omitempty"`
+	HaPeers   []string       `json:"ha_peers,omitempty" yaml:"ha_peers,omitempty"`
+	Vservers  map[string]int `json:"vservers" yaml:"vservers"`
+	CertKeys  int            `json:"certkeys" yaml:"certkeys"`
+	Policies  int            `json:"policies" yaml:"policies"`
+	FileCount int            `json:"file_count" yaml:"file_count"`
+	Size      int64          `json:"size" yaml:"size"`
+	Files     []Entry        `json:"files" yaml:"files"`
+	Problems  []string       `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// VserverCount returns the number of virtual servers of all types
+func (i Info) VserverCount() int {
+	count := 0
+	for _, c := range i.Vservers {
+		count += c
+	}
+	return count
+}
+
+// Inspect summarizes an archive which was read with Read, keeping at least the content of ns.conf.
+// err is the error returned by Read: the entries which could be read are still summarized, and the error is reported as a problem.
+func Inspect(a Archive, err error) Info {
+	output := Info{
+		Level:    LevelUnknown,
+		Vservers: make(map[string]int),
+		Files:    a.Entries,
+	}
+	if output.Files == nil {
+		output.Files = []Entry{}
+	}
+	sort.Slice(output.Files, func(i, j int) bool {
+		return output.Files[i].Name < output.Files[j].Name
+	})
+
+	for _, e := range output.Files {
+		output.FileCount++
+		output.Size += e.Size
+		if output.Level != LevelFull {
+			for _, prefix := range fullLevelPrefixes {
+				if strings.HasPrefix(e.Name, prefix) {
+					output.Level = LevelFull
+				}
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		output.Problems = append(output.Problems, "archive is truncated")
+	default:
+		output.Problems = append(output.Problems, fmt.Sprintf("archive is corrupt: %v", err))
+	}
+	if len(output.Files) == 0 {
+		output.Problems = append(output.Problems, "archive holds no files")
+		return output
+	}
+
+	f, ok := Find(a.Files, ConfigName)
+	switch {
+	case !ok:
+		if _, found := a.Entry(ConfigName); !found {
+			output.Problems = append(output.Problems, ConfigName+" is missing")
+		} else {
+			output.Problems = append(output.Problems, ConfigName+" could not be read")
+		}
+	case len(f.Content) == 0:
+		output.Problems = append(output.Problems, ConfigName+" is empty")
+	case !IsText(f.Content):
+		output.Problems = append(output.Problems, ConfigName+" is not a text file")
+	default:
+		if output.Level == LevelUnknown {
+			output.Level = LevelBasic
+		}
+		parseConfig(NormalizeConfig(string(f.Content)), &output)
+		if output.Firmware == "" {
+			output.Problems = append(output.Problems, ConfigName+" has no firmware version header")
+		}
+	}
+	return output
+}
+
+// parseConfig reads the identity of an ADC and the number of objects from its configuration
+func parseConfig(config string, info *Info) {
+	info.Firmware = GetFirmwareVersion([]byte(config))
+	if m := firmwareBuild.FindStringSubmatch(info.Firmware); m != nil {
+		info.Release = m[1]
+		info.Build = m[2]
+	}
+
+	for _, l := range strings.Split(config, "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 3 || (!strings.EqualFold(fields[0], "add") && !strings.EqualFold(fields[0], "set")) {
+			continue
+		}
+		verb := strings.ToLower(fields[0])
+		group := strings.ToLower(fields[1])
+		object := strings.ToLower(fields[2])
+
+		switch {
+		case verb == "set" && group == "ns" && object == "hostname" && len(fields) > 3:
+			info.Hostname = strings.Trim(fields[3], `"`)
+		case verb == "set" && group == "ns" && object == "config":
+			if v, ok := getOption(fields, "-IPAddress"); ok {
+				info.Nsip = v
+			}
+		case verb == "add" && group == "ha" && object == "node" && len(fields) > 4:
+			info.HaPeers = append(info.HaPeers, fields[4])
+		case verb == "add" && object == "vserver":
+			info.Vservers[group]++
+		case verb == "add" && group == "ssl" && object == "certkey":
+			info.CertKeys++
+		case verb == "add" && strings.HasSuffix(object, "policy"):
+			info.Policies++
+		}
+	}
+}
+
+// getOption returns the value of an option of a configuration line, e.g. -IPAddress
+func getOption(fields []string, option string) (string, bool) {
+	for i := 0; i+1 < len(fields); i++ {
+		if strings.EqualFold(fields[i], option) {
+			return fields[i+1], true
+		}
+	}
+	return "", false
+}
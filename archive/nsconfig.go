@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ConfigName is the name of the saved configuration in a system backup
+const ConfigName = "nsconfig/ns.conf"
+
+// volatileConfigLine matches the header lines of a configuration which change when the configuration is saved, even when nothing else changed
+var volatileConfigLine = regexp.MustCompile(`^#\s*Last modified\b`)
+
+// firmwareVersionLine matches the first line of a configuration, which holds the firmware version, e.g. #NS13.0 Build 85.19
+var firmwareVersionLine = regexp.MustCompile(`^#(NS\S+\s+Build\s+\S+)`)
+
+// keyFileExtensions are the extensions of the text files in /nsconfig which describe the configuration of an ADC
+var keyFileExtensions = []string{".conf", ".sh", ".lic", ".pl", ".xml", ".txt"}
+
+// keyFileNames are the text files in /nsconfig without one of keyFileExtensions
+var keyFileNames = []string{"rc.netscaler", "crontab"}
+
+// NormalizeConfig removes the differences between two exports of the same configuration.
+// Line endings and trailing whitespace are made consistent, the timestamp of the last save is removed,
+// and the Done which closes the output of the CLI is dropped.
+func NormalizeConfig(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var output []string
+	for _, l := range lines {
+		l = strings.TrimRight(l, " \t\r")
+		if volatileConfigLine.MatchString(l) {
+			l = "# Last modified"
+		}
+		output = append(output, l)
+	}
+
+	for len(output) > 0 && (output[len(output)-1] == "" || strings.TrimSpace(output[len(output)-1]) == "Done") {
+		output = output[:len(output)-1]
+	}
+	for len(output) > 0 && output[0] == "" {
+		output = output[1:]
+	}
+	return strings.Join(output, "\n") + "\n"
+}
+
+// GetFirmwareVersion returns the firmware version from the header of a configuration, or an empty string when it has none
+func GetFirmwareVersion(config []byte) string {
+	for _, l := range strings.SplitN(string(config), "\n", 3) {
+		if m := firmwareVersionLine.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// IsKeyFile reports whether a member of a system backup is one of the text files which describe the configuration of an ADC.
+// Certificates and keys in /nsconfig/ssl are never key files, so they are not copied out of the archive.
+func IsKeyFile(name string) bool {
+	if !strings.HasPrefix(name, "nsconfig/") || strings.HasPrefix(name, "nsconfig/ssl/") {
+		return false
+	}
+
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	for _, n := range keyFileNames {
+		if base == n {
+			return true
+		}
+	}
+	for _, e := range keyFileExtensions {
+		if strings.HasSuffix(base, e) {
+			return true
+		}
+	}
+	return false
+}
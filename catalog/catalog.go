@@ -0,0 +1,239 @@
+package catalog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filename is the name of the catalog in OutputBasePath
+const Filename = "catalog.db"
+
+// openTimeout is how long Open waits for another process which has the catalog open
+const openTimeout = 10 * time.Second
+
+var (
+	archivesBucket  = []byte("archives")
+	filenamesBucket = []byte("filenames")
+)
+
+// ErrNotFound is returned when an archive is not in the catalog
+var ErrNotFound = errors.New("archive is not in the catalog")
+
+// Entry is a stored archive of a node. Locations lists every destination where the archive is stored.
+type Entry struct {
+	Id          uint64    `json:"id" yaml:"id"`
+	Target      string    `json:"target" yaml:"target"`
+	Node        string    `json:"node" yaml:"node"`
+	Level       string    `json:"level" yaml:"level"`
+	Timestamp   time.Time `json:"timestamp" yaml:"timestamp"`
+	Filename    string    `json:"filename" yaml:"filename"`
+	Size        int64     `json:"size" yaml:"size"`
+	Sha256      string    `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	Encryption  string    `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	Locations   []string  `json:"locations" yaml:"locations"`
+	Configs     []string  `json:"configs,omitempty" yaml:"configs,omitempty"`
+	Tags        []string  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Hostname    string    `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Firmware    string    `json:"firmware,omitempty" yaml:"firmware,omitempty"`
+	HaState     string    `json:"ha_state,omitempty" yaml:"ha_state,omitempty"`
+	ConfigState string    `json:"config_state,omitempty" yaml:"config_state,omitempty"`
+	Recorded    time.Time `json:"recorded" yaml:"recorded"`
+}
+
+// HasTag reports whether the entry has a tag, ignoring case
+func (e Entry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter selects entries of the catalog. Empty fields match every entry.
+type Filter struct {
+	Target string
+	Node   string
+	Level  string
+	// Tags must all be set on an entry
+	Tags  []string
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether an entry matches the filter
+func (f Filter) Match(e Entry) bool {
+	switch {
+	case f.Target != "" && !strings.EqualFold(f.Target, e.Target):
+		return false
+	case f.Node != "" && !strings.EqualFold(f.Node, e.Node):
+		return false
+	case f.Level != "" && !strings.EqualFold(f.Level, e.Level):
+		return false
+	case !f.Since.IsZero() && e.Timestamp.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Timestamp.Before(f.Until):
+		return false
+	}
+	for _, tag := range f.Tags {
+		if !e.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Catalog is an index of the stored archives, kept in a single file.
+// Only one process can open the catalog at a time, so it should be closed as soon as possible.
+type Catalog struct {
+	db *bolt.DB
+}
+
+// Open opens the catalog at path, and creates it when it does not exist
+func Open(path string) (*Catalog, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("could not open catalog %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{archivesBucket, filenamesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Catalog{db: db}, nil
+}
+
+func (c *Catalog) Close() error {
+	return c.db.Close()
+}
+
+// Put adds an entry, or replaces the entry of the same archive of a target. The id of the entry is set.
+func (c *Catalog) Put(e *Entry) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		archives := tx.Bucket(archivesBucket)
+		filenames := tx.Bucket(filenamesBucket)
+
+		key := filenameKey(e.Target, e.Filename)
+		if id := filenames.Get(key); id != nil {
+			e.Id = binary.BigEndian.Uint64(id)
+		} else {
+			id, err := archives.NextSequence()
+			if err != nil {
+				return err
+			}
+			e.Id = id
+		}
+
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = archives.Put(idKey(e.Id), value)
+		if err != nil {
+			return err
+		}
+		return filenames.Put(key, idKey(e.Id))
+	})
+}
+
+// Get returns the entry with an id
+func (c *Catalog) Get(id uint64) (Entry, error) {
+	var output Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(archivesBucket).Get(idKey(id))
+		if value == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(value, &output)
+	})
+	return output, err
+}
+
+// Find returns the entry of an archive of a target
+func (c *Catalog) Find(target string, filename string) (Entry, error) {
+	var id uint64
+	err := c.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(filenamesBucket).Get(filenameKey(target, filename))
+		if value == nil {
+			return ErrNotFound
+		}
+		id = binary.BigEndian.Uint64(value)
+		return nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	return c.Get(id)
+}
+
+// Delete removes an entry
+func (c *Catalog) Delete(id uint64) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		archives := tx.Bucket(archivesBucket)
+		value := archives.Get(idKey(id))
+		if value == nil {
+			return nil
+		}
+
+		var e Entry
+		err := json.Unmarshal(value, &e)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(filenamesBucket).Delete(filenameKey(e.Target, e.Filename))
+		if err != nil {
+			return err
+		}
+		return archives.Delete(idKey(id))
+	})
+}
+
+// List returns the entries which match a filter, sorted by timestamp, oldest first
+func (c *Catalog) List(f Filter) ([]Entry, error) {
+	var output []Entry
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(archivesBucket).ForEach(func(k, v []byte) error {
+			var e Entry
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return fmt.Errorf("invalid catalog entry %d: %v", binary.BigEndian.Uint64(k), err)
+			}
+			if f.Match(e) {
+				output = append(output, e)
+			}
+			return nil
+		})
+	})
+
+	sort.SliceStable(output, func(i, j int) bool {
+		if output[i].Timestamp.Equal(output[j].Timestamp) {
+			return output[i].Id < output[j].Id
+		}
+		return output[i].Timestamp.Before(output[j].Timestamp)
+	})
+	return output, err
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func filenameKey(target string, filename string) []byte {
+	return []byte(target + "/" + filename)
+}
@@ -16,39 +16,149 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
 	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/jantytgat/citrixadc-backup/models"
 	"github.com/spf13/cobra"
+	"io"
 	"log"
+	"os"
 )
 
+// Exit codes when one or more targets could not be backed up
+const (
+	exitCodePartialFailure = 2
+	exitCodeTotalFailure   = 3
+)
+
+var backupTargets []string
+var backupReportFile string
+var backupReportFormat string
+var backupMetricsTextfile string
+
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Backup all targets defined in the configuration file",
-	//	Long: `A longer description that spans multiple lines and likely contains examples
-	//and usage of using your command. For example:
-	//
-	//Cobra is a CLI library for Go that empowers applications.
-	//This application is a tool to generate the needed files
-	//to quickly create a Cobra application.`,
+	Long: `Backup all targets defined in the configuration file.
+
+Use --report-file to write a report of the run, with the outcome for each target and node.
+With --report-file -, the report is written to stdout and the progress of the run to stderr.
+When all targets fail, the exit code is 3. When only some targets fail, the exit code is 2.
+
+Targets run in parallel, within the limits of MaxConcurrentTargets and MaxConcurrentPerNode in Settings.
+Two targets never run against the same node address at the same time, unless MaxConcurrentPerNode is raised.
+The targets of each of the Sequences in Settings run one after another.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		runBackup()
+		runBackup(cmd)
 	},
 }
 
-func runBackup() {
+func runBackup(cmd *cobra.Command) {
+	// The controllers print their progress to stdout, so it is redirected to stderr when stdout only holds the report
+	stdout := os.Stdout
+	if backupReportFile == "-" {
+		os.Stdout = os.Stderr
+	}
+
 	s, err := getBackupConfiguration()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	c:= controllers.BackupController{}
-	c.Run(s)
+	s, err = filterTargets(s, backupTargets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s = applyConcurrencyFlags(cmd, s)
+
+	if backupReportFormat != "json" && backupReportFormat != "yaml" {
+		log.Fatal("Unknown report format ", backupReportFormat)
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.BackupController{}
+	report := c.Run(ctx, s)
+
+	if backupReportFile != "" {
+		r := controllers.ReportController{}
+		if backupReportFile == "-" {
+			err = r.Encode(report, backupReportFormat, stdout)
+		} else {
+			err = r.Write(report, backupReportFile, backupReportFormat)
+		}
+		if err != nil {
+			log.Println("Could not write report:", err)
+		}
+	}
+
+	if backupMetricsTextfile != "" {
+		s.Settings.Metrics.TextfilePath = backupMetricsTextfile
+	}
+	if s.Settings.Metrics.TextfilePath != "" {
+		writeMetricsTextfile(s, report)
+	}
+
+	n := controllers.NotificationController{}
+	n.Notify(s.Targets, s.Settings, report)
+
+	exitOnFailure(report, backupReportFile == "-")
+}
+
+// exitOnFailure prints a summary of the run, and exits with a non-zero code when targets failed.
+// The summary goes to stderr when the report is written to stdout.
+func exitOnFailure(report models.RunReport, reportOnStdout bool) {
+	var w io.Writer = os.Stdout
+	if reportOnStdout {
+		w = os.Stderr
+	}
+
+	fmt.Fprintln(w)
+	r := controllers.ReportController{}
+	err := r.WriteSummary(report, w)
+	if err != nil {
+		log.Println("Could not write summary:", err)
+	}
+
+	switch report.Status {
+	case models.ReportStatusFailed:
+		fmt.Fprintf(os.Stderr, "Total failure: all %d targets failed\n", len(report.Targets))
+		os.Exit(exitCodeTotalFailure)
+	case models.ReportStatusPartial:
+		fmt.Fprintf(os.Stderr, "Partial failure: %d of %d targets failed\n", report.FailedTargets(), len(report.Targets))
+		os.Exit(exitCodePartialFailure)
+	}
+}
+
+func writeMetricsTextfile(s models.BackupConfiguration, report models.RunReport) {
+	m := controllers.NewMetricsController()
+	err := m.LoadTextfile(s.Settings.Metrics.TextfilePath)
+	if err != nil {
+		log.Println("Could not load previous metrics:", err)
+	}
+
+	for i, t := range s.Targets {
+		m.Update(t, report.Targets[i])
+	}
+
+	err = m.WriteTextfile(s.Settings.Metrics.TextfilePath)
+	if err != nil {
+		log.Println("Could not write metrics:", err)
+	}
 }
 
 func init() {
 	rootCmd.AddCommand(backupCmd)
 
+	backupCmd.Flags().StringArrayVar(&backupTargets, "target", nil, "only backup the target with this name, can be repeated")
+	backupCmd.Flags().StringVar(&backupReportFile, "report-file", "", "write a report of the run to this file, use - for stdout")
+	backupCmd.Flags().StringVar(&backupReportFormat, "report-format", "json", "format of the report: json | yaml")
+	backupCmd.Flags().StringVar(&backupMetricsTextfile, "metrics-textfile", "", "write metrics to this .prom file for the node_exporter textfile collector")
+	addConcurrencyFlags(backupCmd)
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// backupTestConfigVariable holds the configuration file when the test binary runs the backup command itself
+const backupTestConfigVariable = "CITRIXADC_BACKUP_TEST_BACKUP_CONFIG"
+
+const backupTestConfig = `
+Targets:
+  - Name: adc1
+    Type: standalone
+    Username: nsbackup
+    Password: s3cret
+    Nodes:
+      - Name: node1
+        Address: http://127.0.0.1:1
+  - Name: adc2
+    Type: hapair
+    Username: nsbackup
+    Password: s3cret
+    Nodes:
+      - Name: node2
+        Address: http://127.0.0.1:1
+      - Name: node3
+        Address: http://127.0.0.1:1
+Settings:
+  OutputBasePath: %s
+  Retry:
+    MaxAttempts: 1
+`
+
+func TestBackupReportOnStdout(t *testing.T) {
+	// A run in which targets fail exits the process, so the command runs in a process of its own
+	if filename := os.Getenv(backupTestConfigVariable); filename != "" {
+		rootCmd.SetArgs([]string{"backup", "--config", filename, "--report-file", "-"})
+		Execute()
+		return
+	}
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "citrixadc-backup.yaml")
+	config := strings.Replace(backupTestConfig, "%s", filepath.Join(dir, "backups"), 1)
+	if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestBackupReportOnStdout$")
+	cmd.Env = append(os.Environ(), backupTestConfigVariable+"="+filename)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitCodeTotalFailure {
+		t.Fatalf("backup exited with %v, want exit code %d\n%s", err, exitCodeTotalFailure, stderr.String())
+	}
+
+	var report models.RunReport
+	if err = json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("stdout is not a report: %v\n%s", err, stdout.String())
+	}
+	if report.Status != models.ReportStatusFailed || len(report.Targets) != 2 {
+		t.Errorf("report has status %s with %d targets, want %s with 2", report.Status, len(report.Targets), models.ReportStatusFailed)
+	}
+	if !strings.Contains(stderr.String(), "TARGET") {
+		t.Errorf("stderr does not hold the progress and summary:\n%s", stderr.String())
+	}
+}
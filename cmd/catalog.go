@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+// catalogCmd represents the catalog command
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "Manage the catalog of stored archives",
+	Long: `Manage the catalog of stored archives.
+
+The catalog is kept in OutputBasePath, or at CatalogPath in Settings. Every backup adds its archives, and pruning removes them.`,
+}
+
+// catalogRebuildCmd represents the catalog rebuild command
+var catalogRebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "Rebuild the catalog from the archives on the destinations of all targets",
+	Long: `Rebuild the catalog from the archives on the destinations of all targets.
+
+Archives are described by their manifest. Archives without a manifest are added with an unknown level and hash.
+Archives which are no longer stored are removed from the catalog, the others keep their id.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalogRebuild()
+	},
+}
+
+func runCatalogRebuild() {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.CatalogController{}
+	count, err := c.Rebuild(ctx, s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Catalog holds", count, "archives")
+}
+
+func init() {
+	rootCmd.AddCommand(catalogCmd)
+	catalogCmd.AddCommand(catalogRebuildCmd)
+}
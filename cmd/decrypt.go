@@ -0,0 +1,80 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var decryptOutput string
+var decryptIdentityFile string
+var decryptSecretKeyFile string
+var decryptKeyFile string
+
+// decryptCmd represents the decrypt command
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt <file>",
+	Short: "Decrypt an encrypted backup archive",
+	Long: `Decrypt an encrypted backup archive, so it can be restored.
+
+The encryption type is detected from the extension of the archive:
+  .tgz.age  needs an age identity file (--identity)
+  .tgz.gpg  needs an OpenPGP secret key file (--secret-key), its passphrase is read from ` + encryption.PgpPassphraseEnvironmentVariable + ` or asked on the terminal
+  .tgz.enc  needs the key file (--key-file), which defaults to the KeyFile in the Encryption settings
+
+Exported configurations (.ns.conf) are decrypted in the same way.
+The decrypted archive is written next to the encrypted archive, unless --output is set.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runDecrypt(args[0])
+	},
+}
+
+func runDecrypt(filename string) {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	o := encryption.DecryptOptions{
+		IdentityFile:  decryptIdentityFile,
+		SecretKeyFile: decryptSecretKeyFile,
+		KeyFile:       decryptKeyFile,
+	}
+	if o.KeyFile == "" {
+		o.KeyFile = s.Settings.Encryption.KeyFile
+	}
+
+	c := controllers.DecryptController{}
+	output, err := c.Run(filename, decryptOutput, o)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Decrypted", filename, "to", output)
+}
+
+func init() {
+	rootCmd.AddCommand(decryptCmd)
+
+	decryptCmd.Flags().StringVarP(&decryptOutput, "output", "o", "", "path of the decrypted archive")
+	decryptCmd.Flags().StringVar(&decryptIdentityFile, "identity", "", "age identity file")
+	decryptCmd.Flags().StringVar(&decryptSecretKeyFile, "secret-key", "", "OpenPGP secret key file")
+	decryptCmd.Flags().StringVar(&decryptKeyFile, "key-file", "", "aes key file")
+}
@@ -0,0 +1,128 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+var diffTarget string
+var diffNode string
+var diffToNode string
+var diffFrom string
+var diffTo string
+var diffHa bool
+var diffDestination string
+var diffContext int
+var diffIdentityFile string
+var diffSecretKeyFile string
+var diffKeyFile string
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [<from archive> <to archive>]",
+	Short: "Compare two backups of the same or different nodes",
+	Long: `Compare two backups of the same or different nodes.
+
+Both archives are read in memory. The output lists the files which were added, removed or changed in the archive,
+the number of added and removed commands per type in ns.conf, such as add lb vserver, and a unified diff of ns.conf.
+
+Compare two archives by their path:
+  citrixadc-backup diff 20220101_020000_prod-adc_vpx-001.tgz 20220102_020000_prod-adc_vpx-001.tgz
+
+Or select the archives of a target with --target:
+  --from and --to take a timestamp, or the start of one such as 20220101, or latest. --to is latest by default.
+  --from is the archive before --to by default, or the archive of the same run when --to-node is set.
+  --node selects the node, --to-node compares it with the archive of another node.
+  --ha compares the archives of both nodes of an HA pair from the same run, to detect HA configuration drift.
+
+Archives are read from OutputBasePath, or from the first destination of the target. Use --destination to select another destination.
+Encrypted archives are decrypted with --identity, --secret-key or --key-file, see the decrypt command.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(2)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		runDiff(args)
+	},
+}
+
+func runDiff(args []string) {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	o := controllers.DiffOptions{
+		Destination: diffDestination,
+		Node:        diffNode,
+		ToNode:      diffToNode,
+		From:        diffFrom,
+		To:          diffTo,
+		Ha:          diffHa,
+		Context:     diffContext,
+		Decrypt: encryption.DecryptOptions{
+			IdentityFile:  diffIdentityFile,
+			SecretKeyFile: diffSecretKeyFile,
+			KeyFile:       diffKeyFile,
+		},
+	}
+	if o.Decrypt.KeyFile == "" {
+		o.Decrypt.KeyFile = s.Settings.Encryption.KeyFile
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.DiffController{}
+	if len(args) == 2 {
+		err = c.RunFiles(ctx, args[0], args[1], o, os.Stdout)
+	} else {
+		if diffTarget == "" {
+			log.Fatal("Specify two archives, or a target with --target")
+		}
+		s, err = filterTargets(s, []string{diffTarget})
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = c.RunTarget(ctx, s.Targets[0], s.Settings, o, os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVar(&diffTarget, "target", "", "name of the target")
+	diffCmd.Flags().StringVar(&diffNode, "node", "", "name of the node, required for targets with more than one node")
+	diffCmd.Flags().StringVar(&diffToNode, "to-node", "", "name of the node to compare with, the same node by default")
+	diffCmd.Flags().StringVar(&diffFrom, "from", "", "timestamp of the first archive, or latest")
+	diffCmd.Flags().StringVar(&diffTo, "to", controllers.DiffLatest, "timestamp of the second archive, or latest")
+	diffCmd.Flags().BoolVar(&diffHa, "ha", false, "compare both nodes of an HA pair from the same run")
+	diffCmd.Flags().StringVar(&diffDestination, "destination", "", "name of the destination to read the archives from")
+	diffCmd.Flags().IntVarP(&diffContext, "unified", "U", 3, "number of context lines in the diff of ns.conf")
+	diffCmd.Flags().StringVar(&diffIdentityFile, "identity", "", "age identity file")
+	diffCmd.Flags().StringVar(&diffSecretKeyFile, "secret-key", "", "OpenPGP secret key file")
+	diffCmd.Flags().StringVar(&diffKeyFile, "key-file", "", "aes key file")
+}
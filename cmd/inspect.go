@@ -0,0 +1,86 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+var inspectFormat string
+var inspectIdentityFile string
+var inspectSecretKeyFile string
+var inspectKeyFile string
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <archive>",
+	Short: "Show what is inside a backup archive",
+	Long: `Show what is inside a backup archive.
+
+The archive is read as a stream, without extracting it. The summary shows the backup level, inferred from the contents,
+the firmware release and build, hostname, NSIP and HA peer of the node, and the number of vservers, certkeys and policies in ns.conf,
+followed by the tree of files in the archive with their size.
+
+An archive which is truncated, corrupt, or lacks a readable ns.conf is reported under Problems, and the command exits with status 1.
+
+Encrypted archives are decrypted with --identity, --secret-key or --key-file, see the decrypt command.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runInspect(args[0])
+	},
+}
+
+func runInspect(filename string) {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	o := encryption.DecryptOptions{
+		IdentityFile:  inspectIdentityFile,
+		SecretKeyFile: inspectSecretKeyFile,
+		KeyFile:       inspectKeyFile,
+	}
+	if o.KeyFile == "" {
+		o.KeyFile = s.Settings.Encryption.KeyFile
+	}
+
+	c := controllers.InspectController{}
+	info, err := c.Run(filename, o)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.Write(info, inspectFormat, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(info.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringVarP(&inspectFormat, "output", "o", "table", "output format: table | json | yaml")
+	inspectCmd.Flags().StringVar(&inspectIdentityFile, "identity", "", "age identity file")
+	inspectCmd.Flags().StringVar(&inspectSecretKeyFile, "secret-key", "", "OpenPGP secret key file")
+	inspectCmd.Flags().StringVar(&inspectKeyFile, "key-file", "", "aes key file")
+}
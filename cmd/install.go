@@ -21,6 +21,8 @@ import (
 	"log"
 )
 
+var installAllowRestore bool
+
 // installCmd represents the install command
 var installCmd = &cobra.Command{
 	Use:   "install",
@@ -32,23 +34,32 @@ var installCmd = &cobra.Command{
 //This application is a tool to generate the needed files
 //to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		runInstall()
+		runInstall(cmd)
 	},
 }
 
-func runInstall() {
+func runInstall(cmd *cobra.Command) {
 	s, err := getBackupConfiguration()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	s = applyConcurrencyFlags(cmd, s)
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
 	c := controllers.SetupController{}
-	c.RunInstall(s)
+	report := c.RunInstall(ctx, s, installAllowRestore)
+	exitOnFailure(report, false)
 }
 
 func init() {
 	rootCmd.AddCommand(installCmd)
 
+	installCmd.Flags().BoolVar(&installAllowRestore, "allow-restore", false, "also allow the backup user to upload and restore backups")
+	addConcurrencyFlags(installCmd)
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
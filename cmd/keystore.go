@@ -0,0 +1,126 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+// keystoreCmd represents the keystore command
+var keystoreCmd = &cobra.Command{
+	Use:   "keystore",
+	Short: "Manage the encrypted keystore for target credentials",
+	Long: `Manage the encrypted keystore for target credentials.
+
+Secrets in the keystore are referenced as keystore:<name> in the Username or Password of a target.
+The keystore is stored at KeystorePath in Settings, or next to the configuration file.
+The passphrase is read from ` + secrets.PassphraseEnvironmentVariable + `, or asked on the terminal.`,
+}
+
+// keystoreSetCmd represents the keystore set command
+var keystoreSetCmd = &cobra.Command{
+	Use:   "set <name>",
+	Short: "Add or replace a secret, read from the terminal or stdin",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeystoreSet(args[0])
+	},
+}
+
+// keystoreListCmd represents the keystore list command
+var keystoreListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the names of the secrets in the keystore",
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeystoreList()
+	},
+}
+
+// keystoreDeleteCmd represents the keystore delete command
+var keystoreDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a secret from the keystore",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runKeystoreDelete(args[0])
+	},
+}
+
+func openKeystore() *secrets.Keystore {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = os.Stat(s.Settings.KeystorePath)
+	passphrase, err := secrets.GetPassphrase(os.IsNotExist(err))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	k, err := secrets.OpenKeystore(s.Settings.KeystorePath, passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return k
+}
+
+func runKeystoreSet(name string) {
+	k := openKeystore()
+
+	value, err := secrets.ReadSecret("Secret for " + name + ": ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	k.Set(name, value)
+	err = k.Save()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Stored secret", name, "- reference it as", secrets.PrefixKeystore+name)
+}
+
+func runKeystoreList() {
+	k := openKeystore()
+	for _, name := range k.Names() {
+		fmt.Println(name)
+	}
+}
+
+func runKeystoreDelete(name string) {
+	k := openKeystore()
+	if !k.Delete(name) {
+		log.Fatal("Secret ", name, " not found")
+	}
+
+	err := k.Save()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Deleted secret", name)
+}
+
+func init() {
+	rootCmd.AddCommand(keystoreCmd)
+	keystoreCmd.AddCommand(keystoreSetCmd)
+	keystoreCmd.AddCommand(keystoreListCmd)
+	keystoreCmd.AddCommand(keystoreDeleteCmd)
+}
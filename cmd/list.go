@@ -0,0 +1,125 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/catalog"
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"time"
+)
+
+var listTarget string
+var listNode string
+var listLevel string
+var listTags []string
+var listSince string
+var listBefore string
+var listLast bool
+var listFormat string
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the archives in the catalog",
+	Long: `List the archives in the catalog.
+
+The catalog records every stored archive with its target, node, level, timestamp, size, hash, locations and the tags of its target.
+It is kept in OutputBasePath, or at CatalogPath in Settings, and is built from the stored archives when it does not exist yet.
+
+Filter the archives with --target, --node, --level and --tag.
+--since and --before take an age such as 12h, 7d or 2w, a date such as 2022-01-31, or a timestamp such as 20220131_020000.
+Add --last to only list the newest archive of every node which matches, for example:
+  citrixadc-backup list --target prod-adc --node vpx-002 --level full --before 2022-01-25 --last
+
+Use show <id> to see the details of an archive.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runList()
+	},
+}
+
+func runList() {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f := catalog.Filter{
+		Target: listTarget,
+		Node:   listNode,
+		Level:  listLevel,
+		Tags:   listTags,
+	}
+	now := time.Now()
+	if listSince != "" {
+		f.Since, err = controllers.ParseTimeFilter(listSince, now)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if listBefore != "" {
+		f.Until, err = controllers.ParseTimeFilter(listBefore, now)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.CatalogController{}
+	entries, err := c.List(ctx, s, f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if listLast {
+		// Entries are sorted oldest first, so the last entry of a node is its newest
+		index := make(map[string]int)
+		var last []catalog.Entry
+		for _, e := range entries {
+			key := e.Target + "/" + e.Node
+			if i, ok := index[key]; ok {
+				last[i] = e
+				continue
+			}
+			index[key] = len(last)
+			last = append(last, e)
+		}
+		entries = last
+	}
+
+	err = c.WriteList(entries, listFormat, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringVar(&listTarget, "target", "", "only list archives of this target")
+	listCmd.Flags().StringVar(&listNode, "node", "", "only list archives of this node")
+	listCmd.Flags().StringVar(&listLevel, "level", "", "only list archives of this level: basic | full")
+	listCmd.Flags().StringArrayVar(&listTags, "tag", nil, "only list archives of targets with this tag, can be repeated")
+	listCmd.Flags().StringVar(&listSince, "since", "", "only list archives taken since this age, date or timestamp")
+	listCmd.Flags().StringVar(&listBefore, "before", "", "only list archives taken before this age, date or timestamp")
+	listCmd.Flags().BoolVar(&listLast, "last", false, "only list the newest archive of every node")
+	listCmd.Flags().StringVarP(&listFormat, "output", "o", "table", "output format: table | json | yaml")
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var notifyTestChannel string
+
+// notifyCmd represents the notify command
+var notifyCmd = &cobra.Command{
+	Use:   "notify",
+	Short: "Manage the notification channels",
+	Long: `Manage the notification channels.
+
+Channels are defined in Notifications in Settings. After every backup, each channel is notified of the outcome of the targets which are routed to it.`,
+}
+
+// notifyTestCmd represents the notify test command
+var notifyTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Send a test notification to the notification channels",
+	Long: `Send a test notification to the notification channels.
+
+The test notification lists all targets, and is sent regardless of the events and tags of the channels.
+Use --channel to only send it to the channel with this name.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runNotifyTest()
+	},
+}
+
+func runNotifyTest() {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := controllers.NotificationController{}
+	err = c.Test(s, notifyTestChannel)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(notifyCmd)
+	notifyCmd.AddCommand(notifyTestCmd)
+
+	notifyTestCmd.Flags().StringVar(&notifyTestChannel, "channel", "", "only send the test notification to the channel with this name")
+}
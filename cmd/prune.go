@@ -0,0 +1,56 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+var pruneDryRun bool
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete stored backups according to the retention settings",
+	Long: `Delete stored backups according to the retention settings.
+
+Retention is configured in Settings and can be overridden per target.
+Archives are evaluated per target and node, based on the timestamp in their filename.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runPrune()
+	},
+}
+
+func runPrune() {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.RetentionController{}
+	c.Run(ctx, s, pruneDryRun)
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "list the backups which would be deleted, without deleting them")
+}
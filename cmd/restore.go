@@ -0,0 +1,99 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+var restoreTarget string
+var restoreNode string
+var restoreDestination string
+var restoreFile string
+var restoreStageOnly bool
+var restoreYes bool
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Upload a backup to a node and restore it",
+	Long: `Upload a backup to a node and restore it.
+
+The archive is uploaded to /var/ns_sys_backup on the node, after which the system backup is restored.
+Use --stage-only to only upload the archive.
+
+Use --destination to read the archive from one of the destinations of the target, --file is then the filename of the archive.
+
+The backup user needs restore permissions, see the --allow-restore flag of the install command.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runRestore()
+	},
+}
+
+func runRestore() {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err = filterTargets(s, []string{restoreTarget})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if restoreDestination == "" {
+		if _, err = os.Stat(restoreFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !restoreYes {
+		action := "Restore"
+		if restoreStageOnly {
+			action = "Upload"
+		}
+		if !askConfirmation(fmt.Sprintf("%s %s on target %s node %s?", action, restoreFile, restoreTarget, restoreNode)) {
+			os.Exit(0)
+		}
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.RestoreController{}
+	err = c.Run(ctx, s.Targets[0], s.Settings, restoreNode, restoreDestination, restoreFile, restoreStageOnly)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+
+	restoreCmd.Flags().StringVar(&restoreTarget, "target", "", "name of the target")
+	restoreCmd.Flags().StringVar(&restoreNode, "node", "", "name of the node to restore")
+	restoreCmd.Flags().StringVar(&restoreFile, "file", "", "path of the backup archive")
+	restoreCmd.Flags().StringVar(&restoreDestination, "destination", "", "name of the destination to read the archive from")
+	restoreCmd.Flags().BoolVar(&restoreStageOnly, "stage-only", false, "only upload the archive, without restoring it")
+	restoreCmd.Flags().BoolVarP(&restoreYes, "yes", "y", false, "do not ask for confirmation")
+	restoreCmd.MarkFlagRequired("target")
+	restoreCmd.MarkFlagRequired("node")
+	restoreCmd.MarkFlagRequired("file")
+}
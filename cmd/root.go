@@ -18,21 +18,28 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/jantytgat/citrixadc-backup/models"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 var configFile string
+var maxConcurrentTargets int
+var maxConcurrentPerNode int
+var sequences []string
 var yamlExample = []byte(`
 Targets:
   - Name: HighAvailableTarget
     Type: hapair
-    Username: nsroot
-    Password: nsroot
+    Username: nsbackup
+    Password: env:ADC_HA_PASSWORD
     Level: full
     ValidateCertificate: false
     Nodes:
@@ -42,12 +49,18 @@ Targets:
         address: https://dummy-vpx-002.domain.local
   - Name: StandaloneTarget
     Type: standalone
-    Username: nsroot
-    Password: nsroot
+    Username: nsbackup
+    Password: keystore:standalone
     ValidateCertificate: false
     Nodes:
       - name: dummy-vpx-001
         address: http://dummy-vpx-001
+  - Name: ClusterTarget
+    Type: cluster
+    Username: nsbackup
+    Password: keystore:cluster
+    ValidateCertificate: false
+    ClusterAddress: https://dummy-cluster.domain.local
 Settings:
   OutputBasePath: /var/citrixadc/backup
   FolderPerTarget: true
@@ -118,10 +131,89 @@ func verifyLoading() {
 	}
 }
 
+// getDefaultKeystorePath returns the path of the keystore when none is configured, next to the configuration file
+func getDefaultKeystorePath() string {
+	return filepath.Join(filepath.Dir(configFile), "citrixadc-backup.keystore")
+}
+
+// askConfirmation asks a yes/no question on stdin, and reports whether it was answered with y
+func askConfirmation(question string) bool {
+	fmt.Printf("%s [y/n]: ", question)
+
+	reader := bufio.NewReader(os.Stdin)
+	answer, _ := reader.ReadString('\n')
+	// convert CRLF to LF
+	answer = strings.Replace(answer, "\r\n", "", -1)
+	answer = strings.Replace(answer, "\n", "", -1)
+
+	return answer == "y"
+}
+
 func getBackupConfiguration() (models.BackupConfiguration, error) {
 	var config models.BackupConfiguration
 	err := viper.Unmarshal(&config)
+	if config.Settings.KeystorePath == "" {
+		config.Settings.KeystorePath = getDefaultKeystorePath()
+	}
 
 	return config, err
 }
 
+// addConcurrencyFlags adds the flags which override the concurrency settings to cmd
+func addConcurrencyFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(&maxConcurrentTargets, "max-concurrent-targets", 0, "maximum number of targets which run at the same time, 0 is unlimited")
+	cmd.Flags().IntVar(&maxConcurrentPerNode, "max-concurrent-per-node", 1, "maximum number of targets which run against the same node address at the same time")
+	cmd.Flags().StringArrayVar(&sequences, "sequence", nil, "comma-separated targets which run one after another, can be repeated")
+}
+
+// applyConcurrencyFlags overrides the concurrency settings with the flags which were set on cmd
+func applyConcurrencyFlags(cmd *cobra.Command, s models.BackupConfiguration) models.BackupConfiguration {
+	if cmd.Flags().Changed("max-concurrent-targets") {
+		s.Settings.MaxConcurrentTargets = maxConcurrentTargets
+	}
+	if cmd.Flags().Changed("max-concurrent-per-node") {
+		s.Settings.MaxConcurrentPerNode = maxConcurrentPerNode
+	}
+	if cmd.Flags().Changed("sequence") {
+		s.Settings.Sequences = nil
+		for _, sequence := range sequences {
+			s.Settings.Sequences = append(s.Settings.Sequences, strings.Split(sequence, ","))
+		}
+	}
+	return s
+}
+
+// newInterruptContext returns a context which is cancelled on SIGINT or SIGTERM, so running targets can stop and clean up.
+// A second signal terminates the process immediately.
+func newInterruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// filterTargets returns the configuration with only the targets in names, or all targets when names is empty
+func filterTargets(s models.BackupConfiguration, names []string) (models.BackupConfiguration, error) {
+	if len(names) == 0 {
+		return s, nil
+	}
+
+	var targets []models.BackupTarget
+	for _, name := range names {
+		found := false
+		for _, t := range s.Targets {
+			if t.Name == name {
+				targets = append(targets, t)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return s, fmt.Errorf("target %s is not defined in %s", name, configFile)
+		}
+	}
+	s.Targets = targets
+	return s, nil
+}
@@ -17,46 +17,140 @@ package cmd
 
 import (
 	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/jantytgat/citrixadc-backup/models"
 	"log"
 
 	"github.com/spf13/cobra"
 )
 
+var scheduleDaemon bool
+var scheduleType string
+var scheduleMetricsListen string
+
 // scheduleCmd represents the schedule command
 var scheduleCmd = &cobra.Command{
 	Use:   "schedule",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Schedule backups of all targets defined in the configuration file",
+	Long: `Schedule backups of all targets defined in the configuration file.
+
+With --daemon, citrixadc-backup keeps running and starts the backups itself.
+Each target is backed up according to its Schedule, or the Schedule in Settings when it has none.
+A schedule is a cron expression, for example "0 */6 * * *" or "@every 6h".
+When no schedule is configured, Interval in Settings is used as the number of hours between backups.
+
+The configuration file is reloaded when it changes on disk, which also reads the secrets in the keystore again.
+SIGINT or SIGTERM stops the daemon. Running backups are cancelled, and the backups they already created on the ADC are deleted before it exits.
+
+Use the install, remove and status commands to manage the schedules in crontab or systemd instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if scheduleDaemon {
+			runScheduler(cmd)
+		} else {
+			cmd.Help()
+		}
+	},
+}
+
+// scheduleInstallCmd represents the schedule install command
+var scheduleInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install the schedules in the user crontab or as systemd timers",
+	Long: `Install the schedules in the user crontab or as systemd timers.
+
+The installed jobs run the backup command with the absolute path of the configuration file.
+Installing again replaces the jobs installed earlier for the same configuration file.
+Systemd timers are installed as system units when running as root, and as user units otherwise.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runScheduleInstall()
+	},
+}
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+// scheduleRemoveCmd represents the schedule remove command
+var scheduleRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove the schedules from the user crontab or systemd timers",
 	Run: func(cmd *cobra.Command, args []string) {
-		runScheduler()
+		runScheduleRemove()
 	},
 }
 
-func runScheduler() {
+// scheduleStatusCmd represents the schedule status command
+var scheduleStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the schedules installed for the configuration file",
+	Run: func(cmd *cobra.Command, args []string) {
+		runScheduleStatus()
+	},
+}
+
+func runScheduler(cmd *cobra.Command) {
+	load := newSchedulerLoader(cmd)
+	s, err := load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.ScheduleController{}
+	c.RunDaemon(ctx, s, load)
+}
+
+// newSchedulerLoader returns the loader of the configuration of the daemon, which is also used when the configuration file is reloaded,
+// so the reloaded configuration keeps its defaults and the flags of the command line
+func newSchedulerLoader(cmd *cobra.Command) controllers.ConfigurationLoader {
+	return func() (models.BackupConfiguration, error) {
+		s, err := getBackupConfiguration()
+		if err != nil {
+			return s, err
+		}
+
+		if scheduleMetricsListen != "" {
+			s.Settings.Metrics.ListenAddress = scheduleMetricsListen
+		}
+		return applyConcurrencyFlags(cmd, s), nil
+	}
+}
+
+func runScheduleInstall() {
 	s, err := getBackupConfiguration()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	c := controllers.ScheduleController{}
-	c.Run(s, configFile)
+	err = c.Install(s, configFile, scheduleType)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func init() {
-	rootCmd.AddCommand(scheduleCmd)
+func runScheduleRemove() {
+	c := controllers.ScheduleController{}
+	err := c.Remove(configFile, scheduleType)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Here you will define your flags and configuration settings.
+func runScheduleStatus() {
+	c := controllers.ScheduleController{}
+	err := c.Status(configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// scheduleCmd.PersistentFlags().String("foo", "", "A help for foo")
+func init() {
+	rootCmd.AddCommand(scheduleCmd)
+	scheduleCmd.AddCommand(scheduleInstallCmd)
+	scheduleCmd.AddCommand(scheduleRemoveCmd)
+	scheduleCmd.AddCommand(scheduleStatusCmd)
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// scheduleCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	scheduleCmd.Flags().BoolVar(&scheduleDaemon, "daemon", false, "run as a long-lived process which starts the scheduled backups")
+	scheduleCmd.Flags().StringVar(&scheduleMetricsListen, "metrics-listen", "", "serve metrics on /metrics at this address, e.g. :9469")
+	addConcurrencyFlags(scheduleCmd)
+	scheduleInstallCmd.Flags().StringVar(&scheduleType, "type", "cron", "type of system schedule: cron | systemd")
+	scheduleRemoveCmd.Flags().StringVar(&scheduleType, "type", "cron", "type of system schedule: cron | systemd")
 }
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const scheduleTestConfig = `
+Targets:
+  - Name: %s
+    Type: standalone
+    Username: nsbackup
+    Password: keystore:adc
+    Schedule: "@every 1h"
+    Nodes:
+      - Name: node1
+        Address: http://127.0.0.1:1
+Settings:
+  OutputBasePath: /tmp/citrixadc-backup-test
+`
+
+func TestSchedulerLoaderKeepsDefaultsOnReload(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(secrets.PassphraseEnvironmentVariable, "passphrase")
+
+	k, err := secrets.OpenKeystore(filepath.Join(dir, "citrixadc-backup.keystore"), "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("adc", "s3cret")
+	if err = k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	previousConfigFile := configFile
+	configFile = filepath.Join(dir, "citrixadc-backup.yaml")
+	t.Cleanup(func() {
+		configFile = previousConfigFile
+		scheduleCmd.Flags().Set("max-concurrent-targets", "0")
+	})
+	viper.SetConfigFile(configFile)
+	viper.SetConfigType("yaml")
+
+	err = scheduleCmd.Flags().Set("max-concurrent-targets", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := newSchedulerLoader(scheduleCmd)
+
+	// The second configuration is what the daemon loads when the file changes
+	for _, name := range []string{"before-reload", "after-reload"} {
+		writeScheduleTestConfig(t, name)
+		if err = viper.ReadInConfig(); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Targets) != 1 || s.Targets[0].Name != name {
+			t.Fatalf("loaded targets %v, want %s", s.Targets, name)
+		}
+		if s.Settings.KeystorePath != getDefaultKeystorePath() {
+			t.Errorf("%s: KeystorePath is %q, want %q", name, s.Settings.KeystorePath, getDefaultKeystorePath())
+		}
+		if s.Settings.MaxConcurrentTargets != 3 {
+			t.Errorf("%s: MaxConcurrentTargets is %d, want the flag value 3", name, s.Settings.MaxConcurrentTargets)
+		}
+
+		password, err := secrets.Resolve(s.Targets[0].Password, s.Settings.KeystorePath)
+		if err != nil {
+			t.Fatalf("%s: could not resolve password: %v", name, err)
+		}
+		if password != "s3cret" {
+			t.Errorf("%s: password is %q, want s3cret", name, password)
+		}
+	}
+}
+
+func writeScheduleTestConfig(t *testing.T, name string) {
+	t.Helper()
+	content := []byte(fmt.Sprintf(scheduleTestConfig, name))
+	if err := ioutil.WriteFile(configFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
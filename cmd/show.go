@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"strconv"
+)
+
+var showFormat string
+
+// showCmd represents the show command
+var showCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show an archive from the catalog",
+	Long: `Show an archive from the catalog, with all of its locations and exported configurations.
+
+The id of an archive is listed by the list command.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runShow(args[0])
+	},
+}
+
+func runShow(value string) {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid id %s", value)
+	}
+
+	c := controllers.CatalogController{}
+	e, err := c.Show(s, id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.WriteEntry(e, showFormat, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(showCmd)
+
+	showCmd.Flags().StringVarP(&showFormat, "output", "o", "table", "output format: table | json | yaml")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+var statsTargets []string
+var statsFormat string
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the space taken by the stored archives",
+	Long: `Show the space taken by the stored archives of every target, on each of its destinations.
+
+The logical size is the sum of the sizes of the archives, their manifests and exported configurations.
+With Deduplicate in Settings, identical files are stored once on local destinations, and the physical size counts them once.
+The difference is the space saved by deduplication. The totals of a destination count files which are shared by targets once.
+Encrypted archives are never identical, so nothing is saved while Encryption is configured.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runStats()
+	},
+}
+
+func runStats() {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s, err = filterTargets(s, statsTargets)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
+	c := controllers.StatsController{}
+	report, err := c.Run(ctx, s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.Write(report, statsFormat, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().StringArrayVar(&statsTargets, "target", nil, "only show the archives of the target with this name, can be repeated")
+	statsCmd.Flags().StringVarP(&statsFormat, "output", "o", "table", "output format: table | json | yaml")
+}
@@ -32,22 +32,29 @@ var uninstallCmd = &cobra.Command{
 	//This application is a tool to generate the needed files
 	//to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		runUninstall()
+		runUninstall(cmd)
 	},
 }
 
-func runUninstall() {
+func runUninstall(cmd *cobra.Command) {
 	s, err := getBackupConfiguration()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	s = applyConcurrencyFlags(cmd, s)
+
+	ctx, cancel := newInterruptContext()
+	defer cancel()
+
 	c := controllers.SetupController{}
-	c.RunUninstall(s)
+	report := c.RunUninstall(ctx, s)
+	exitOnFailure(report, false)
 }
 
 func init() {
 	rootCmd.AddCommand(uninstallCmd)
+	addConcurrencyFlags(uninstallCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -0,0 +1,81 @@
+/*
+Copyright © 2021 Jan Tytgat
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/jantytgat/citrixadc-backup/controllers"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+var verifyFormat string
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [<archive or directory>...]",
+	Short: "Verify stored archives against their manifests",
+	Long: `Verify stored archives against their manifests.
+
+Every stored archive has a manifest next to it, <archive>.manifest.json, which holds the size and sha256 hash of the archive
+with a description of its content. Verify checks the archives against their manifests, to detect bit-rot or tampering.
+Archives which are not encrypted are also checked to be a valid gzipped tar archive which holds nsconfig/ns.conf.
+
+Without arguments, the archives in OutputBasePath and its subdirectories are verified.
+Directories are searched for archives, manifests without an archive are reported as missing.
+
+The command exits with status 1 when an archive is modified, corrupt or missing, or has an invalid manifest.
+Archives without a manifest, such as archives of earlier versions, are listed but do not fail verification.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runVerify(args)
+	},
+}
+
+func runVerify(args []string) {
+	s, err := getBackupConfiguration()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	paths := args
+	if len(paths) == 0 {
+		if s.Settings.OutputBasePath == "" {
+			log.Fatal("Specify archives or directories to verify, or set OutputBasePath")
+		}
+		paths = []string{s.Settings.OutputBasePath}
+	}
+
+	c := controllers.VerifyController{}
+	results, err := c.Run(paths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.Write(results, verifyFormat, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range results {
+		if r.IsProblem() {
+			os.Exit(1)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVarP(&verifyFormat, "output", "o", "table", "output format: table | json | yaml")
+}
@@ -1,133 +1,527 @@
 package controllers
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/citrix/adc-nitro-go/service"
+	"github.com/jantytgat/citrixadc-backup/archive"
 	"github.com/jantytgat/citrixadc-backup/data"
+	"github.com/jantytgat/citrixadc-backup/encryption"
 	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
-type BackupController struct{}
+// BackupController creates the backups of targets.
+// When scheduler is set, the targets hold a slot in it while they run, so the members of a cluster are added to it once they are discovered.
+type BackupController struct {
+	scheduler *targetScheduler
+}
 type BackupControllerLauncher interface {
-	Run(s models.BackupConfiguration)
-	runBackupCommands(t models.BackupTarget, s models.BackupSettings, wg *sync.WaitGroup)
-	createSystemBackup(nitroClient service.NitroClient, name string, level string) error
-	downloadSystemBackup(nitroClient service.NitroClient, name string) (string, error)
-	deleteSystemBackup(nitroClient service.NitroClient, name string) error
+	Run(ctx context.Context, s models.BackupConfiguration) models.RunReport
+	RunTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings) models.TargetReport
+	runBackupCommands(ctx context.Context, t models.BackupTarget, s models.BackupSettings, report *models.TargetReport)
+	backupNode(ctx context.Context, nitroClient *service.NitroClient, t models.BackupTarget, n models.BackupNode, timestamp string, s models.BackupSettings, deleteFromNode bool, cluster *models.ClusterReport, report *models.NodeReport, history *nodeHistory) error
+	backupSystemBackup(ctx context.Context, nitroClient *service.NitroClient, t models.BackupTarget, n models.BackupNode, timestamp string, s models.BackupSettings, encrypter encryption.Encrypter, deleteFromNode bool, cluster *models.ClusterReport, report *models.NodeReport, history *nodeHistory) error
+	createSystemBackup(ctx context.Context, nitroClient *service.NitroClient, name string, level string) error
+	downloadSystemBackup(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, name string, encrypter encryption.Encrypter, extract io.Writer) (string, int64, string, error)
+	deleteSystemBackup(ctx context.Context, nitroClient *service.NitroClient, name string) error
+	exportConfig(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, timestamp string, config string, encrypter encryption.Encrypter, history *nodeHistory) (models.ConfigReport, int, error)
+	fetchConfig(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, config string) (string, error)
+	getConfigResource(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, resourceType string, field string) (string, error)
+	getConfigState(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, method string) (string, error)
+	detectChanges(ctx context.Context, t models.BackupTarget, s models.BackupSettings, detection models.ChangeDetectionSettings) (map[string]string, string)
+	spoolConfig(t models.BackupTarget, s models.BackupSettings, name string, text string, encrypter encryption.Encrypter) (string, int64, string, error)
+	newManifest(t models.BackupTarget, n models.BackupNode, s models.BackupSettings, timestamp string, report *models.NodeReport, cluster *models.ClusterReport, encrypter encryption.Encrypter, a archive.Archive) models.Manifest
+	storeManifest(ctx context.Context, t models.BackupTarget, s models.BackupSettings, m models.Manifest) ([]string, error)
+	getCleanupNodes(t models.BackupTarget, start int) []models.BackupNode
+	addClusterNitroClient(t models.BackupTarget, s models.BackupSettings, nitroClients map[string]*service.NitroClient) (models.BackupNode, error)
+	cleanupSystemBackup(nitroClients map[string]*service.NitroClient, t models.BackupTarget, nodes []models.BackupNode, name string, timeout time.Duration)
 	getTimestamp() string
 	generateFilename(timestamp string, target string, node string) string
+	generateConfigFilename(timestamp string, target string, node string, config string) string
 	createDirectory(path string) error
-	writeFileToDisk(filename string, targetName string, data string, settings models.BackupSettings) error
+	getSpoolDirectory(t models.BackupTarget, s models.BackupSettings) (string, error)
+	storeArchive(ctx context.Context, filename string, t models.BackupTarget, spool string, hash string, settings models.BackupSettings) ([]string, error)
+	putArchive(ctx context.Context, st storage.Storage, name string, spool string, hash string) error
 }
 
-func (c *BackupController) Run(s models.BackupConfiguration) {
-	err := c.createDirectory(s.Settings.OutputBasePath)
-	if err != nil {
-		log.Fatal("Access denied to ", s.Settings.OutputBasePath)
+// Run creates a backup of all targets, and returns when all targets are done or ctx is done
+func (c *BackupController) Run(ctx context.Context, s models.BackupConfiguration) models.RunReport {
+	report := models.RunReport{
+		Start:   time.Now(),
+		Targets: make([]models.TargetReport, len(s.Targets)),
+	}
+
+	for _, w := range getSettingsWarnings(s.Settings) {
+		fmt.Println("Warning:", w)
 	}
 
-	var wg sync.WaitGroup
-	for _, t := range s.Targets {
-		wg.Add(1)
-		go c.runBackupCommands(t, s.Settings, &wg)
+	// Targets with destinations of their own still run when OutputBasePath is not accessible
+	var outputErr error
+	if usesOutputBasePath(s.Targets) {
+		err := c.createDirectory(s.Settings.OutputBasePath)
+		if err != nil {
+			outputErr = newOutputBasePathError(s.Settings)
+		}
 	}
-	wg.Wait()
+
+	ctx, cancel := withTimeout(ctx, s.Settings.Timeouts.Run)
+	defer cancel()
+
+	b := BackupController{scheduler: newTargetScheduler(s.Settings)}
+	b.scheduler.run(ctx, s.Targets, s.Settings, func(i int) {
+		t := s.Targets[i]
+		if outputErr != nil && usesOutputBasePath([]models.BackupTarget{t}) {
+			report.Targets[i].Target = t.Name
+			report.Targets[i].Type = t.Type
+			failTarget(&report.Targets[i], outputErr)
+			return
+		}
+		b.runBackupCommands(ctx, t, s.Settings, &report.Targets[i])
+	})
+
+	setRunStatus(&report)
+	return report
 }
 
-func (c *BackupController) runBackupCommands(t models.BackupTarget, s models.BackupSettings, wg *sync.WaitGroup) {
-	var primaryNode models.BackupNode
-	var err error
-	var nitroClient = make(map[string]service.NitroClient, len(t.Nodes))
+// RunTarget creates a backup of a single target and waits for it to complete
+func (c *BackupController) RunTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings) models.TargetReport {
+	var report models.TargetReport
+
+	if usesOutputBasePath([]models.BackupTarget{t}) {
+		err := c.createDirectory(s.OutputBasePath)
+		if err != nil {
+			report.Target = t.Name
+			report.Type = t.Type
+			failTarget(&report, newOutputBasePathError(s))
+			return report
+		}
+	}
+
+	c.runBackupCommands(ctx, t, s, &report)
+	return report
+}
+
+// newOutputBasePathError is the error of the targets which are stored in OutputBasePath when it cannot be created
+func newOutputBasePathError(s models.BackupSettings) error {
+	return newStageError(StageWrite, "", fmt.Errorf("access denied to %s", s.OutputBasePath))
+}
+
+func (c *BackupController) runBackupCommands(ctx context.Context, t models.BackupTarget, s models.BackupSettings, report *models.TargetReport) {
+	start := time.Now()
+	report.Target = t.Name
+	report.Type = t.Type
+	report.Status = models.ReportStatusSuccess
+	defer func() {
+		report.DurationSeconds = time.Since(start).Seconds()
+	}()
+
+	if err := ctx.Err(); err != nil {
+		failTarget(report, fmt.Errorf("target was not started: %v", err))
+		return
+	}
+
+	timeouts := getTimeouts(t, s)
+	ctx, cancel := withTimeout(ctx, timeouts.Target)
+	defer cancel()
 
-	nitroClient, err = createNitroClientsForNodes(t)
+	// Invalid encryption settings must not leave an unencrypted archive behind, so they are checked before the backup is created
+	_, err := encryption.NewEncrypter(s.Encryption)
 	if err != nil {
-		log.Fatal("Error creating nitro clients")
-		wg.Done()
+		failTarget(report, newStageError(StageConfiguration, "", err))
 		return
 	}
 
-	primaryNode, err = getPrimaryNode(nitroClient, t)
+	// Likewise, invalid destinations are detected before anything is created on the target
+	_, err = getDestinations(t, s)
 	if err != nil {
-		wg.Done()
+		failTarget(report, newStageError(StageConfiguration, "", err))
 		return
 	}
 
-	timestamp := c.getTimestamp()
-	err = c.createSystemBackup(nitroClient[primaryNode.Name], timestamp, t.Level)
+	_, err = getConfigExports(t)
 	if err != nil {
-		wg.Done()
+		failTarget(report, newStageError(StageConfiguration, "", err))
 		return
 	}
 
-	for _, n := range t.Nodes {
-		var f string
-		f, err = c.downloadSystemBackup(nitroClient[n.Name], timestamp+".tgz")
+	detection, err := getChangeDetection(t, s)
+	if err != nil {
+		failTarget(report, newStageError(StageConfiguration, "", err))
+		return
+	}
+
+	if isCluster(t) {
+		t, report.Cluster, err = discoverClusterMembers(ctx, t, s, timeouts.Connect)
 		if err != nil {
-			fmt.Println(err)
-			wg.Done()
+			failTarget(report, err)
 			return
 		}
+		if c.scheduler != nil && !c.scheduler.addNodes(ctx, t) {
+			failTarget(report, fmt.Errorf("cluster members were not available: %v", ctx.Err()))
+			return
+		}
+	}
 
-		err = c.writeFileToDisk(c.generateFilename(timestamp, t.Name, n.Name), t.Name, f, s)
+	nitroClient, err := createNitroClientsForNodes(t, s)
+	if err != nil {
+		failTarget(report, err)
+		return
+	}
+
+	primaryNode, topology, err := getPrimaryNode(ctx, nitroClient, t, timeouts.Connect)
+	report.Topology = topology
+	if err != nil {
+		failTarget(report, err)
+		return
+	}
+	report.PrimaryNode = primaryNode.Name
+
+	// Configuration operations on a cluster go through the cluster IP address, its members are only reached on their NSIP to download their archive
+	operationNode := primaryNode
+	if isCluster(t) {
+		operationNode, err = c.addClusterNitroClient(t, s, nitroClient)
 		if err != nil {
-			fmt.Println(err)
-			wg.Done()
+			failTarget(report, err)
 			return
 		}
+	}
 
-		err = c.deleteSystemBackup(nitroClient[n.Name], timestamp+".tgz")
+	// Targets which only export their configuration are not in the catalog, so they are always backed up
+	var configStates map[string]string
+	if detection.Enabled && !t.ConfigOnly {
+		var reason string
+		configStates, reason = c.detectChanges(ctx, t, s, detection)
+		if reason != "" {
+			skipTarget(report, t, reason, configStates)
+			return
+		}
+	}
+
+	timestamp := c.getTimestamp()
+	if !t.ConfigOnly {
+		report.Retries, err = retry(ctx, getRetryPolicy(t, s, OperationCreate), timeouts.Create, OperationCreate, t.Name, operationNode.Name, func(ctx context.Context) error {
+			return c.createSystemBackup(ctx, nitroClient[operationNode.Name], timestamp, t.Level)
+		})
 		if err != nil {
-			wg.Done()
+			failTarget(report, newStageError(StageCreate, operationNode.Name, err))
+			if ctx.Err() != nil {
+				c.cleanupSystemBackup(nitroClient, t, c.getCleanupNodes(t, 0), timestamp+".tgz", timeouts.Delete)
+			}
 			return
 		}
 	}
 
-	wg.Done()
+	// The members of a cluster share the backup, so it is deleted once through the cluster IP address when all members are done
+	deleteFromNode := !isCluster(t)
+	var histories []nodeHistory
+	for i, n := range t.Nodes {
+		nodeReport := models.NodeReport{
+			Node:        n.Name,
+			Primary:     n.Name == primaryNode.Name,
+			HaState:     getNodeHaState(t, report, n),
+			ConfigState: configStates[n.Name],
+			Status:      models.ReportStatusSuccess,
+		}
+
+		var history *nodeHistory
+		if s.History.IsEnabled() {
+			history = &nodeHistory{Node: n.Name}
+		}
+
+		err = c.backupNode(ctx, nitroClient[n.Name], t, n, timestamp, s, deleteFromNode, report.Cluster, &nodeReport, history)
+		report.Nodes = append(report.Nodes, nodeReport)
+		if err == nil {
+			cat := CatalogController{}
+			cat.Record(t, s, timestamp, nodeReport)
+		}
+		if history != nil && err == nil {
+			histories = append(histories, *history)
+		}
+		report.Retries += nodeReport.Retries
+		if err != nil {
+			failTarget(report, err)
+			if ctx.Err() != nil && !t.ConfigOnly {
+				c.cleanupSystemBackup(nitroClient, t, c.getCleanupNodes(t, i), timestamp+".tgz", timeouts.Delete)
+			}
+			return
+		}
+	}
+
+	if !deleteFromNode && !t.ConfigOnly {
+		var retries int
+		retries, err = retry(ctx, getRetryPolicy(t, s, OperationDelete), timeouts.Delete, OperationDelete, t.Name, operationNode.Name, func(ctx context.Context) error {
+			return c.deleteSystemBackup(ctx, nitroClient[operationNode.Name], timestamp+".tgz")
+		})
+		report.Retries += retries
+		if err != nil {
+			err = newStageError(StageCleanup, operationNode.Name, err)
+			failNode(&report.Nodes[0], err)
+			failTarget(report, err)
+			if ctx.Err() != nil {
+				c.cleanupSystemBackup(nitroClient, t, c.getCleanupNodes(t, 0), timestamp+".tgz", timeouts.Delete)
+			}
+			return
+		}
+	}
+
+	if s.History.IsEnabled() {
+		h := HistoryController{}
+		report.History = h.Commit(ctx, t, s, timestamp, histories)
+	}
+
+	r := RetentionController{}
+	_, err = r.PruneTarget(ctx, t, s, false)
+	if err != nil {
+		fmt.Println("Error pruning target", t.Name, ":", err)
+	}
+}
+
+// backupNode stores the system backup and the exported configurations of a node.
+// The system backup is only deleted from the node when deleteFromNode is set.
+// The files for the history repository are collected in history, unless it is nil.
+func (c *BackupController) backupNode(ctx context.Context, nitroClient *service.NitroClient, t models.BackupTarget, n models.BackupNode, timestamp string, s models.BackupSettings, deleteFromNode bool, cluster *models.ClusterReport, report *models.NodeReport, history *nodeHistory) error {
+	start := time.Now()
+	defer func() {
+		report.DurationSeconds = time.Since(start).Seconds()
+	}()
+
+	encrypter, err := encryption.NewEncrypter(s.Encryption)
+	if err != nil {
+		err = newStageError(StageConfiguration, n.Name, err)
+		failNode(report, err)
+		return err
+	}
+
+	configs, err := getConfigExports(t)
+	if err != nil {
+		err = newStageError(StageConfiguration, n.Name, err)
+		failNode(report, err)
+		return err
+	}
+
+	if !t.ConfigOnly {
+		err = c.backupSystemBackup(ctx, nitroClient, t, n, timestamp, s, encrypter, deleteFromNode, cluster, report, history)
+		if err != nil {
+			failNode(report, err)
+			return err
+		}
+	}
+
+	for _, config := range configs {
+		configReport, retries, err := c.exportConfig(ctx, t, n, s, timestamp, config, encrypter, history)
+		report.Retries += retries
+		if err != nil {
+			failNode(report, err)
+			return err
+		}
+		report.Configs = append(report.Configs, configReport)
+	}
+	return nil
 }
 
+// backupSystemBackup downloads the system backup from a node, stores it with its manifest and deletes it from the node
+// The backup is only deleted from the node when deleteFromNode is set.
+// The backup is read while it is downloaded, so an invalid archive is never stored, and its key text files are added to history unless it is nil.
+// The state of the cluster is added to the manifest of the backups of cluster members, unless cluster is nil.
+func (c *BackupController) backupSystemBackup(ctx context.Context, nitroClient *service.NitroClient, t models.BackupTarget, n models.BackupNode, timestamp string, s models.BackupSettings, encrypter encryption.Encrypter, deleteFromNode bool, cluster *models.ClusterReport, report *models.NodeReport, history *nodeHistory) error {
+	timeouts := getTimeouts(t, s)
+
+	keep := func(name string) bool {
+		return name == archive.ConfigName
+	}
+	if history != nil {
+		keep = archive.IsKeyFile
+	}
+
+	var spool, hash string
+	var size int64
+	var content archive.Archive
+	retries, err := retry(ctx, getRetryPolicy(t, s, OperationDownload), timeouts.Download, OperationDownload, t.Name, n.Name, func(ctx context.Context) error {
+		extractor := archive.NewExtractor(keep)
+
+		var err error
+		spool, size, hash, err = c.downloadSystemBackup(ctx, t, n, s, timestamp+".tgz", encrypter, extractor)
+		var extractErr error
+		content, extractErr = extractor.Close()
+		if err == nil && extractErr != nil {
+			os.Remove(spool)
+			return fmt.Errorf("system backup %s is not a valid archive: %v", timestamp+".tgz", extractErr)
+		}
+		return err
+	})
+	report.Retries += retries
+	if err != nil {
+		return newStageError(StageDownload, n.Name, err)
+	}
+	defer os.Remove(spool)
+
+	report.Filename = c.generateFilename(timestamp, t.Name, n.Name)
+	if encrypter != nil {
+		report.Filename += encrypter.Extension()
+	}
+	report.Size = size
+	report.Sha256 = hash
+
+	for _, name := range content.MissingMembers() {
+		fmt.Println("System backup", timestamp+".tgz", "of", n.Name, "has no", name)
+	}
+
+	report.Locations, err = c.storeArchive(ctx, report.Filename, t, spool, report.Sha256, s)
+	if err != nil {
+		return newStageError(StageWrite, n.Name, err)
+	}
+	manifest := c.newManifest(t, n, s, timestamp, report, cluster, encrypter, content)
+	_, err = c.storeManifest(ctx, t, s, manifest)
+	if err != nil {
+		return newStageError(StageWrite, n.Name, fmt.Errorf("could not store manifest: %v", err))
+	}
+	report.Manifest = report.Filename + models.ManifestExtension
+	report.Hostname = manifest.Hostname
+	report.Firmware = manifest.Firmware
+	if history != nil {
+		history.addArchiveFiles(content.Files)
+	}
+
+	if !deleteFromNode {
+		return nil
+	}
+
+	retries, err = retry(ctx, getRetryPolicy(t, s, OperationDelete), timeouts.Delete, OperationDelete, t.Name, n.Name, func(ctx context.Context) error {
+		return c.deleteSystemBackup(ctx, nitroClient, timestamp+".tgz")
+	})
+	report.Retries += retries
+	return newStageError(StageCleanup, n.Name, err)
+}
 
-func (c *BackupController) createSystemBackup(nitroClient service.NitroClient, name string, level string) error {
+func (c *BackupController) createSystemBackup(ctx context.Context, nitroClient *service.NitroClient, name string, level string) error {
 	// Filename must have no extension
 	name = strings.TrimSuffix(name, ".tgz")
 	request := data.GetSystemBackupCreateData(name, level)
 
-	err := nitroClient.ActOnResource(service.Systembackup.Type(), request, "create")
-	return err
+	return runWithContext(ctx, func() error {
+		return nitroClient.ActOnResource(service.Systembackup.Type(), request, "create")
+	})
 }
 
-func (c *BackupController) downloadSystemBackup(nitroClient service.NitroClient, name string) (string, error) {
-	var output string
-	params := service.FindParams{
-		ArgsMap:                  map[string]string{"fileLocation": url.PathEscape("/var/ns_sys_backup")},
-		ResourceType:             "systemfile",
-		ResourceName:             name,
-		ResourceMissingErrorCode: 0,
+// downloadSystemBackup streams a system backup from a node to a spool file, decoding and optionally encrypting it on the way.
+// NITRO returns the archive base64 encoded in a JSON response, which is decoded as it is received, so memory use does not depend on the size of the archive.
+// The decoded archive is also written to extract, unless it is nil.
+// It returns the path of the spool file, with the size and sha256 hash of its content.
+func (c *BackupController) downloadSystemBackup(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, name string, encrypter encryption.Encrypter, extract io.Writer) (string, int64, string, error) {
+	request, err := newNitroRequest(ctx, t, n, s, "/nitro/v1/config/systemfile/"+url.PathEscape(name)+"?args=fileLocation:"+url.PathEscape("/var/ns_sys_backup"))
+	if err != nil {
+		return "", 0, "", err
 	}
 
-	response, err := nitroClient.FindResourceArrayWithParams(params)
-	if err == nil {
-		if response[0]["filecontent"] != "" {
-			output = response[0]["filecontent"].(string)
-		} else {
-			output = ""
+	response, err := newNitroHttpClient(t, s).Do(request)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return "", 0, "", fmt.Errorf("could not download system backup %s: %s %s", name, response.Status, strings.TrimSpace(string(body)))
+	}
+
+	directory, err := c.getSpoolDirectory(t, s)
+	if err != nil {
+		return "", 0, "", err
+	}
+	spool, err := ioutil.TempFile(directory, "."+name+".*")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	var writer io.Writer = io.MultiWriter(spool, hash)
+	var encryptedWriter io.WriteCloser
+	if encrypter != nil {
+		encryptedWriter, err = encrypter.Encrypt(writer)
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return "", 0, "", err
 		}
+		writer = encryptedWriter
 	}
-	return output, err
+	if extract != nil {
+		writer = io.MultiWriter(writer, extract)
+	}
+
+	size, err := io.Copy(writer, base64.NewDecoder(base64.StdEncoding, newSystemFileContentReader(response.Body)))
+	if err == nil && size == 0 {
+		err = fmt.Errorf("system backup %s is empty", name)
+	}
+	if err == nil && encryptedWriter != nil {
+		err = encryptedWriter.Close()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = spool.Stat()
+	}
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(spool.Name())
+		return "", 0, "", fmt.Errorf("could not download system backup %s: %v", name, err)
+	}
+	return spool.Name(), info.Size(), hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func (c *BackupController) deleteSystemBackup(nitroClient service.NitroClient, name string) error {
-	err := nitroClient.DeleteResource(service.Systembackup.Type(), name)
-	return err
+func (c *BackupController) deleteSystemBackup(ctx context.Context, nitroClient *service.NitroClient, name string) error {
+	return runWithContext(ctx, func() error {
+		return nitroClient.DeleteResource(service.Systembackup.Type(), name)
+	})
+}
+
+// getCleanupNodes returns the nodes from which the backup still has to be deleted, when the nodes before start are done.
+// Clusters delete the backup from all members through the cluster IP address.
+func (c *BackupController) getCleanupNodes(t models.BackupTarget, start int) []models.BackupNode {
+	if isCluster(t) {
+		return []models.BackupNode{getClusterNode(t)}
+	}
+	return t.Nodes[start:]
+}
+
+// addClusterNitroClient adds a NITRO client for the cluster IP address of a cluster to nitroClients, and returns the node for the cluster IP address
+func (c *BackupController) addClusterNitroClient(t models.BackupTarget, s models.BackupSettings, nitroClients map[string]*service.NitroClient) (models.BackupNode, error) {
+	clusterTarget := t
+	clusterTarget.Nodes = []models.BackupNode{getClusterNode(t)}
+	clients, err := createNitroClientsForNodes(clusterTarget, s)
+	if err != nil {
+		return models.BackupNode{}, err
+	}
+	nitroClients[clusterNodeName] = clients[clusterNodeName]
+	return clusterTarget.Nodes[0], nil
+}
+
+// cleanupSystemBackup makes a best-effort attempt to delete the system backup from the nodes after a run was interrupted.
+// The context of the run is already done at that point, so every node gets a context of its own.
+func (c *BackupController) cleanupSystemBackup(nitroClients map[string]*service.NitroClient, t models.BackupTarget, nodes []models.BackupNode, name string, timeout time.Duration) {
+	for _, n := range nodes {
+		fmt.Println("Removing", name, "from", n.Name, "for interrupted target", t.Name)
+		err := runWithTimeout(context.Background(), timeout, func(ctx context.Context) error {
+			return c.deleteSystemBackup(ctx, nitroClients[n.Name], name)
+		})
+		if err != nil {
+			fmt.Println("Could not remove", name, "from", n.Name, ":", err)
+		}
+	}
 }
 
 func (c *BackupController) getTimestamp() string {
@@ -157,6 +551,8 @@ func (c *BackupController) createDirectory(path string) error {
 
 	if os.IsNotExist(err) {
 		return os.MkdirAll(path, 0755)
+	} else if err != nil {
+		return err
 	} else if src.Mode().IsRegular() {
 		return os.ErrExist
 	} else {
@@ -164,30 +560,75 @@ func (c *BackupController) createDirectory(path string) error {
 	}
 }
 
-func (c *BackupController) writeFileToDisk(filename string, targetName string, data string, settings models.BackupSettings) error {
-	var outputFile string
+// getSpoolDirectory returns the directory where archives are downloaded to before they are stored.
+// Targets which are stored in OutputBasePath are spooled in their output directory, so the archive can be linked into place instead of copied.
+func (c *BackupController) getSpoolDirectory(t models.BackupTarget, s models.BackupSettings) (string, error) {
+	if s.TempPath != "" {
+		return s.TempPath, c.createDirectory(s.TempPath)
+	}
+	if len(t.Destinations) == 0 {
+		directory := filepath.Join(s.OutputBasePath, getTargetDirectory(t.Name, s))
+		return directory, c.createDirectory(directory)
+	}
+	return os.TempDir(), nil
+}
+
+// storeArchive writes the spooled archive to every destination of the target.
+// When Deduplicate is set, the archive is linked to the store of destinations which support it, by its sha256 hash. Files without a hash are not deduplicated.
+// It returns the locations where the archive was stored, even when some of the destinations failed.
+func (c *BackupController) storeArchive(ctx context.Context, filename string, t models.BackupTarget, spool string, hash string, settings models.BackupSettings) ([]string, error) {
+	var locations []string
+	if !settings.Deduplicate {
+		hash = ""
+	}
+
+	destinations, err := getDestinations(t, settings)
+	if err != nil {
+		return locations, err
+	}
+
+	name := storage.Join(getTargetDirectory(t.Name, settings), filename)
 
-	if settings.FolderPerTarget {
-		err := c.createDirectory(filepath.Join(settings.OutputBasePath, targetName))
+	var failed []string
+	for _, d := range destinations {
+		location := d.Storage.Location(name)
+		fmt.Println("Writing to", location)
+
+		err = c.putArchive(ctx, d.Storage, name, spool, hash)
+		var dedupErr *storage.DeduplicationError
+		if errors.As(err, &dedupErr) {
+			fmt.Println("Stored", location, "without deduplication:", dedupErr.Err)
+			err = nil
+		}
+		if err != nil && ctx.Err() != nil {
+			return locations, ctx.Err()
+		}
 		if err != nil {
-			return err
+			failed = append(failed, fmt.Sprintf("destination %s: %v", d.Name, err))
+			continue
 		}
-		outputFile = filepath.Join(settings.OutputBasePath, targetName, filename)
-	} else {
-		outputFile = filepath.Join(settings.OutputBasePath, filename)
+		locations = append(locations, location)
+	}
+
+	if len(failed) > 0 {
+		err = errors.New(strings.Join(failed, "; "))
 	}
+	return locations, err
+}
 
-	fmt.Println("Writing to file", outputFile)
-	reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
-	buffer := bytes.Buffer{}
+func (c *BackupController) putArchive(ctx context.Context, st storage.Storage, name string, spool string, hash string) error {
+	if d, ok := st.(storage.Deduplicator); ok && hash != "" {
+		return d.PutDeduplicated(ctx, name, spool, hash)
+	}
+	if p, ok := st.(storage.FilePutter); ok {
+		return p.PutFile(ctx, name, spool)
+	}
 
-	_, err := buffer.ReadFrom(reader)
+	f, err := os.Open(spool)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	err = ioutil.WriteFile(outputFile, buffer.Bytes(), 0644)
-	return err
+	return st.Put(ctx, name, f)
 }
-
-
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunReportsInaccessibleOutputBasePath(t *testing.T) {
+	// A directory cannot be created below a file, not even by root
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := models.BackupConfiguration{
+		Targets: []models.BackupTarget{
+			{Name: "adc1", Type: models.TargetTypeStandalone, Nodes: []models.BackupNode{{Name: "node1", Address: "http://127.0.0.1:1"}}},
+			{Name: "adc2", Type: models.TargetTypeStandalone, Nodes: []models.BackupNode{{Name: "node2", Address: "http://127.0.0.1:1"}}},
+		},
+		Settings: models.BackupSettings{OutputBasePath: filepath.Join(file, "backups")},
+	}
+
+	c := BackupController{}
+	report := c.Run(context.Background(), s)
+
+	if report.Status != models.ReportStatusFailed {
+		t.Errorf("run status is %s, want %s", report.Status, models.ReportStatusFailed)
+	}
+	if len(report.Targets) != 2 {
+		t.Fatalf("report has %d targets, want 2", len(report.Targets))
+	}
+	for i, r := range report.Targets {
+		if r.Target != s.Targets[i].Name {
+			t.Errorf("target %d is %s, want %s", i, r.Target, s.Targets[i].Name)
+		}
+		if r.Status != models.ReportStatusFailed || r.Stage != string(StageWrite) {
+			t.Errorf("target %s is %s at stage %q, want %s at stage %s", r.Target, r.Status, r.Stage, models.ReportStatusFailed, StageWrite)
+		}
+	}
+}
+
+func TestSettingsWarnings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings models.BackupSettings
+		warnings int
+	}{
+		{name: "no encryption", settings: models.BackupSettings{Deduplicate: true, History: models.HistorySettings{Path: "/var/lib/history"}}},
+		{name: "encryption", settings: models.BackupSettings{Encryption: models.EncryptionSettings{Type: encryption.TypeAge}}},
+		{name: "encrypted history", settings: models.BackupSettings{Encryption: models.EncryptionSettings{Type: encryption.TypeAge}, History: models.HistorySettings{Path: "/var/lib/history"}}, warnings: 1},
+		{name: "encrypted deduplication and history", settings: models.BackupSettings{Deduplicate: true, Encryption: models.EncryptionSettings{Type: encryption.TypeAge}, History: models.HistorySettings{Path: "/var/lib/history"}}, warnings: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if warnings := getSettingsWarnings(tt.settings); len(warnings) != tt.warnings {
+				t.Errorf("settings have warnings %v, want %d", warnings, tt.warnings)
+			}
+		})
+	}
+}
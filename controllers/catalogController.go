@@ -0,0 +1,479 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/catalog"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// catalogMutex serializes the targets which open the catalog at the same time, as the catalog can only be opened once
+var catalogMutex sync.Mutex
+
+// relativeTime matches an age such as 7d or 2w, which are not supported by time.ParseDuration
+var relativeTime = regexp.MustCompile(`^(\d+)([dw])$`)
+
+// getCatalogPath returns the path of the catalog, which is kept in OutputBasePath unless CatalogPath is set.
+// It returns an empty string when neither is set.
+func getCatalogPath(s models.BackupSettings) string {
+	if s.CatalogPath != "" {
+		return s.CatalogPath
+	}
+	if s.OutputBasePath == "" {
+		return ""
+	}
+	return filepath.Join(s.OutputBasePath, catalog.Filename)
+}
+
+// ParseTimeFilter parses the time of a filter relative to now, as an age such as 12h, 7d or 2w,
+// as a date such as 2022-01-31, or as a timestamp of a backup or the start of one such as 20220131.
+func ParseTimeFilter(value string, now time.Time) (time.Time, error) {
+	if m := relativeTime.FindStringSubmatch(value); m != nil {
+		count, _ := strconv.Atoi(m[1])
+		if m[2] == "w" {
+			count *= 7
+		}
+		return now.AddDate(0, 0, -count), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05", timestampLayout, "20060102_1504", "20060102"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, use an age such as 7d, a date such as 2022-01-31 or a timestamp such as 20220131_020000", value)
+}
+
+type CatalogController struct{}
+
+type CatalogControllerCaller interface {
+	Record(t models.BackupTarget, s models.BackupSettings, timestamp string, n models.NodeReport)
+	Forget(t models.BackupTarget, s models.BackupSettings, locations []string)
+	Rebuild(ctx context.Context, s models.BackupConfiguration) (int, error)
+	List(ctx context.Context, s models.BackupConfiguration, f catalog.Filter) ([]catalog.Entry, error)
+	Show(s models.BackupConfiguration, id uint64) (catalog.Entry, error)
+	Latest(t models.BackupTarget, s models.BackupSettings) (map[string]catalog.Entry, error)
+	WriteList(entries []catalog.Entry, format string, w io.Writer) error
+	WriteEntry(e catalog.Entry, format string, w io.Writer) error
+
+	open(s models.BackupSettings, create bool) (*catalog.Catalog, error)
+	scanTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings) ([]catalog.Entry, error)
+	readManifest(ctx context.Context, d destination, name string) (models.Manifest, bool)
+	marshal(value interface{}, format string, w io.Writer) error
+}
+
+// Record adds the archive of a node to the catalog after it was stored.
+// The catalog is an index of the stored archives, so errors do not fail the backup.
+func (c *CatalogController) Record(t models.BackupTarget, s models.BackupSettings, timestamp string, n models.NodeReport) {
+	if n.Filename == "" || getCatalogPath(s) == "" {
+		return
+	}
+
+	e := catalog.Entry{
+		Target:      t.Name,
+		Node:        n.Node,
+		Level:       strings.ToLower(t.Level),
+		Filename:    n.Filename,
+		Size:        n.Size,
+		Sha256:      n.Sha256,
+		Locations:   n.Locations,
+		Tags:        t.Tags,
+		Hostname:    n.Hostname,
+		Firmware:    n.Firmware,
+		HaState:     n.HaState,
+		ConfigState: n.ConfigState,
+		Recorded:    time.Now(),
+	}
+	if e.Level == "" {
+		e.Level = archive.LevelBasic
+	}
+	if encryption.IsEncrypted(n.Filename) {
+		e.Encryption = strings.ToLower(s.Encryption.Type)
+	}
+	e.Timestamp, _ = time.ParseInLocation(timestampLayout, timestamp, time.Local)
+	for _, config := range n.Configs {
+		e.Configs = append(e.Configs, config.Filename)
+	}
+
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	cat, err := c.open(s, true)
+	if err == nil {
+		err = cat.Put(&e)
+		if closeErr := cat.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Println("Could not add", n.Filename, "to the catalog:", err)
+	}
+}
+
+// Forget removes the locations of deleted archives of a target from the catalog.
+// An archive is removed from the catalog when none of its locations are left.
+func (c *CatalogController) Forget(t models.BackupTarget, s models.BackupSettings, locations []string) {
+	if len(locations) == 0 {
+		return
+	}
+	deleted := make(map[string]bool)
+	for _, l := range locations {
+		deleted[l] = true
+	}
+
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	cat, err := c.open(s, false)
+	if err != nil || cat == nil {
+		return
+	}
+	defer cat.Close()
+
+	entries, err := cat.List(catalog.Filter{Target: t.Name})
+	for _, e := range entries {
+		var remaining []string
+		for _, l := range e.Locations {
+			if !deleted[l] {
+				remaining = append(remaining, l)
+			}
+		}
+		switch {
+		case len(remaining) == len(e.Locations):
+		case len(remaining) == 0:
+			err = cat.Delete(e.Id)
+		default:
+			e.Locations = remaining
+			err = cat.Put(&e)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Println("Could not remove deleted archives of", t.Name, "from the catalog:", err)
+	}
+}
+
+// Rebuild replaces the catalog with the archives which are found on the destinations of every target.
+// Archives which are still found keep their id. It returns the number of archives in the catalog.
+func (c *CatalogController) Rebuild(ctx context.Context, s models.BackupConfiguration) (int, error) {
+	var entries []catalog.Entry
+	for _, t := range s.Targets {
+		fmt.Println("Scanning archives of", t.Name)
+		scanned, err := c.scanTarget(ctx, t, s.Settings)
+		if err != nil {
+			return 0, fmt.Errorf("could not scan archives of %s: %v", t.Name, err)
+		}
+		entries = append(entries, scanned...)
+	}
+
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	cat, err := c.open(s.Settings, true)
+	if err != nil {
+		return 0, err
+	}
+	defer cat.Close()
+
+	existing, err := cat.List(catalog.Filter{})
+	if err != nil {
+		return 0, err
+	}
+	found := make(map[uint64]bool)
+	for i := range entries {
+		if e, err := cat.Find(entries[i].Target, entries[i].Filename); err == nil {
+			entries[i].Recorded = e.Recorded
+		}
+		err = cat.Put(&entries[i])
+		if err != nil {
+			return 0, err
+		}
+		found[entries[i].Id] = true
+	}
+	for _, e := range existing {
+		if !found[e.Id] {
+			err = cat.Delete(e.Id)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(entries), nil
+}
+
+// scanTarget lists the archives of a target on all of its destinations, described by their manifest when it is found.
+// Archives without a manifest have an unknown level and hash.
+func (c *CatalogController) scanTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings) ([]catalog.Entry, error) {
+	var output []catalog.Entry
+
+	destinations, err := getDestinations(t, s)
+	if err != nil {
+		return output, err
+	}
+
+	r := RetentionController{}
+	index := make(map[string]int)
+	for _, d := range destinations {
+		archives, err := r.listArchives(ctx, t, s, d.Storage)
+		if err != nil {
+			return output, fmt.Errorf("destination %s: %v", d.Name, err)
+		}
+
+		for _, a := range archives {
+			name, ok := getSystemBackupArchiveName(a)
+			if !ok {
+				continue
+			}
+			filename := path.Base(name)
+
+			i, found := index[filename]
+			if !found {
+				e := catalog.Entry{
+					Target:    t.Name,
+					Node:      a.Node,
+					Level:     archive.LevelUnknown,
+					Timestamp: a.Timestamp,
+					Filename:  filename,
+					Tags:      t.Tags,
+					Recorded:  time.Now(),
+				}
+				if encryption.IsEncrypted(filename) {
+					e.Encryption = strings.ToLower(s.Encryption.Type)
+				}
+				for j, n := range a.Names {
+					_, isConfig := isConfigFilename(encryption.TrimExtension(n))
+					switch {
+					case n == name:
+						e.Size = a.Sizes[j]
+					case isConfig:
+						e.Configs = append(e.Configs, path.Base(n))
+					}
+				}
+				if m, ok := c.readManifest(ctx, d, name+models.ManifestExtension); ok {
+					e.Level = m.Level
+					e.Sha256 = m.Sha256
+					e.Hostname = m.Hostname
+					e.Firmware = m.Firmware
+					e.HaState = m.HaState
+					e.ConfigState = m.ConfigState
+					if m.Encryption != "" {
+						e.Encryption = m.Encryption
+					}
+				}
+
+				i = len(output)
+				index[filename] = i
+				output = append(output, e)
+			}
+			output[i].Locations = append(output[i].Locations, d.Storage.Location(name))
+		}
+	}
+	return output, nil
+}
+
+// readManifest reads the manifest of an archive from a destination, and reports whether it exists and is valid
+func (c *CatalogController) readManifest(ctx context.Context, d destination, name string) (models.Manifest, bool) {
+	r, err := d.Storage.Get(ctx, name)
+	if err != nil {
+		return models.Manifest{}, false
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return models.Manifest{}, false
+	}
+	m, err := parseManifest(content)
+	return m, err == nil
+}
+
+// List returns the archives in the catalog which match a filter. The catalog is built first when it does not exist.
+func (c *CatalogController) List(ctx context.Context, s models.BackupConfiguration, f catalog.Filter) ([]catalog.Entry, error) {
+	cat, err := c.open(s.Settings, false)
+	if err != nil {
+		return nil, err
+	}
+	if cat == nil {
+		fmt.Println("Building catalog", getCatalogPath(s.Settings))
+		_, err = c.Rebuild(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		cat, err = c.open(s.Settings, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer cat.Close()
+
+	return cat.List(f)
+}
+
+// Latest returns the most recent archive of every node of a target in the catalog, by the name of the node.
+// It returns an empty map when there is no catalog yet.
+func (c *CatalogController) Latest(t models.BackupTarget, s models.BackupSettings) (map[string]catalog.Entry, error) {
+	output := make(map[string]catalog.Entry)
+
+	catalogMutex.Lock()
+	defer catalogMutex.Unlock()
+
+	cat, err := c.open(s, false)
+	if err != nil || cat == nil {
+		return output, err
+	}
+	defer cat.Close()
+
+	entries, err := cat.List(catalog.Filter{Target: t.Name})
+	if err != nil {
+		return output, err
+	}
+	// The entries are sorted oldest first
+	for _, e := range entries {
+		output[e.Node] = e
+	}
+	return output, nil
+}
+
+// Show returns the archive with an id from the catalog
+func (c *CatalogController) Show(s models.BackupConfiguration, id uint64) (catalog.Entry, error) {
+	cat, err := c.open(s.Settings, false)
+	if err != nil {
+		return catalog.Entry{}, err
+	}
+	if cat == nil {
+		return catalog.Entry{}, fmt.Errorf("catalog %s does not exist, run catalog rebuild to create it", getCatalogPath(s.Settings))
+	}
+	defer cat.Close()
+
+	e, err := cat.Get(id)
+	if err == catalog.ErrNotFound {
+		return e, fmt.Errorf("archive %d is not in the catalog", id)
+	}
+	return e, err
+}
+
+// open opens the catalog. Unless create is set, it returns nil when the catalog does not exist.
+func (c *CatalogController) open(s models.BackupSettings, create bool) (*catalog.Catalog, error) {
+	filename := getCatalogPath(s)
+	if filename == "" {
+		return nil, fmt.Errorf("set OutputBasePath or CatalogPath to keep a catalog")
+	}
+	if _, err := os.Stat(filename); !create && os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	return catalog.Open(filename)
+}
+
+// WriteList writes archives from the catalog as a table, json or yaml
+func (c *CatalogController) WriteList(entries []catalog.Entry, format string, w io.Writer) error {
+	if entries == nil {
+		entries = []catalog.Entry{}
+	}
+	if format != "table" {
+		return c.marshal(entries, format, w)
+	}
+
+	r := ReportController{}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIMESTAMP\tTARGET\tNODE\tLEVEL\tSIZE\tSHA256\tTAGS\tLOCATIONS")
+	for _, e := range entries {
+		hash := e.Sha256
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%d\n",
+			e.Id,
+			e.Timestamp.Format("2006-01-02 15:04:05"),
+			e.Target,
+			e.Node,
+			e.Level,
+			e.Size,
+			r.summaryValue(hash),
+			r.summaryValue(strings.Join(e.Tags, ",")),
+			len(e.Locations))
+	}
+	fmt.Fprintf(tw, "\n%d archives\n", len(entries))
+	return tw.Flush()
+}
+
+// WriteEntry writes an archive from the catalog as a list of properties, json or yaml
+func (c *CatalogController) WriteEntry(e catalog.Entry, format string, w io.Writer) error {
+	if format != "table" {
+		return c.marshal(e, format, w)
+	}
+
+	r := ReportController{}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Id:\t%d\n", e.Id)
+	fmt.Fprintf(tw, "Target:\t%s\n", e.Target)
+	fmt.Fprintf(tw, "Node:\t%s\n", e.Node)
+	fmt.Fprintf(tw, "Timestamp:\t%s\n", e.Timestamp.Format("2006-01-02 15:04:05 MST"))
+	fmt.Fprintf(tw, "Level:\t%s\n", e.Level)
+	fmt.Fprintf(tw, "Filename:\t%s\n", e.Filename)
+	fmt.Fprintf(tw, "Size:\t%d bytes\n", e.Size)
+	fmt.Fprintf(tw, "Sha256:\t%s\n", r.summaryValue(e.Sha256))
+	fmt.Fprintf(tw, "Encryption:\t%s\n", r.summaryValue(e.Encryption))
+	fmt.Fprintf(tw, "Hostname:\t%s\n", r.summaryValue(e.Hostname))
+	fmt.Fprintf(tw, "Firmware:\t%s\n", r.summaryValue(e.Firmware))
+	fmt.Fprintf(tw, "HA state:\t%s\n", r.summaryValue(e.HaState))
+	fmt.Fprintf(tw, "Config state:\t%s\n", r.summaryValue(e.ConfigState))
+	fmt.Fprintf(tw, "Tags:\t%s\n", r.summaryValue(strings.Join(e.Tags, ", ")))
+	fmt.Fprintf(tw, "Recorded:\t%s\n", e.Recorded.Format("2006-01-02 15:04:05 MST"))
+	for i, l := range e.Locations {
+		label := ""
+		if i == 0 {
+			label = "Locations:"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", label, l)
+	}
+	for i, config := range e.Configs {
+		label := ""
+		if i == 0 {
+			label = "Configs:"
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", label, config)
+	}
+	return tw.Flush()
+}
+
+func (c *CatalogController) marshal(value interface{}, format string, w io.Writer) error {
+	var output []byte
+	var err error
+	switch format {
+	case "json":
+		output, err = json.MarshalIndent(value, "", "  ")
+		output = append(output, '\n')
+	case "yaml":
+		output, err = yaml.Marshal(value)
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"strings"
+	"time"
+)
+
+// defaultChangeDetectionMaxAge forces a backup of an unchanged target once a week when MaxAge is not set
+const defaultChangeDetectionMaxAge = 7 * 24 * time.Hour
+
+// getChangeDetection returns the change detection settings for a target, where the settings of the target replace the ones in the settings
+func getChangeDetection(t models.BackupTarget, s models.BackupSettings) (models.ChangeDetectionSettings, error) {
+	output := s.ChangeDetection
+	if t.ChangeDetection != nil {
+		output = *t.ChangeDetection
+	}
+
+	output.Method = strings.ToLower(strings.TrimSpace(output.Method))
+	switch output.Method {
+	case "":
+		output.Method = models.ChangeDetectionConfigHash
+	case models.ChangeDetectionConfigHash, models.ChangeDetectionSavedTime:
+	default:
+		return output, fmt.Errorf("unknown change detection method %q for target %s, use %s or %s", output.Method, t.Name, models.ChangeDetectionConfigHash, models.ChangeDetectionSavedTime)
+	}
+	if output.MaxAge <= 0 {
+		output.MaxAge = defaultChangeDetectionMaxAge
+	}
+	return output, nil
+}
+
+// getConfigState returns a token which identifies the configuration of a node, and changes when the configuration changes.
+// The confighash method hashes the normalized running configuration, the savedtime method uses the times at which
+// the configuration was last changed and saved, as reported by nsconfig.
+func (c *BackupController) getConfigState(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, method string) (string, error) {
+	if method == models.ChangeDetectionSavedTime {
+		changed, err := c.getConfigResource(ctx, t, n, s, "nsconfig", "lastconfigchangedtime")
+		if err != nil {
+			return "", err
+		}
+		saved, err := c.getConfigResource(ctx, t, n, s, "nsconfig", "lastconfigsavetime")
+		if err != nil {
+			return "", err
+		}
+		return method + ":" + changed + "/" + saved, nil
+	}
+
+	text, err := c.fetchConfig(ctx, t, n, s, models.ConfigRunning)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(archive.NormalizeConfig(text)))
+	return method + ":" + hex.EncodeToString(hash[:]), nil
+}
+
+// detectChanges gets the configuration state of every node of a target, and compares it with the last backup of the node in the catalog.
+// It returns the states by node, and the reason to skip the target when no node changed and all their backups are younger than MaxAge.
+// The reason is empty when the target must be backed up, which is the case as well when the state of a node or the catalog cannot be read.
+func (c *BackupController) detectChanges(ctx context.Context, t models.BackupTarget, s models.BackupSettings, detection models.ChangeDetectionSettings) (map[string]string, string) {
+	states := make(map[string]string)
+	for _, n := range t.Nodes {
+		var state string
+		err := runWithTimeout(ctx, getTimeouts(t, s).Download, func(ctx context.Context) error {
+			var err error
+			state, err = c.getConfigState(ctx, t, n, s, detection.Method)
+			return err
+		})
+		if err != nil {
+			fmt.Printf("Could not detect changes of %s for %s, creating a backup: %v\n", n.Name, t.Name, err)
+			return nil, ""
+		}
+		states[n.Name] = state
+	}
+
+	if getCatalogPath(s) == "" {
+		fmt.Println("Change detection of", t.Name, "requires a catalog, set OutputBasePath or CatalogPath")
+		return states, ""
+	}
+	cat := CatalogController{}
+	latest, err := cat.Latest(t, s)
+	if err != nil {
+		fmt.Printf("Could not read the last backups of %s from the catalog, creating a backup: %v\n", t.Name, err)
+		return states, ""
+	}
+
+	level := strings.ToLower(t.Level)
+	if level == "" {
+		level = archive.LevelBasic
+	}
+	var oldest time.Time
+	for _, n := range t.Nodes {
+		e, ok := latest[n.Name]
+		switch {
+		case !ok:
+			return states, ""
+		case e.ConfigState != states[n.Name], e.Level != level:
+			return states, ""
+		case time.Since(e.Timestamp) >= detection.MaxAge:
+			fmt.Printf("Last backup of %s for %s is older than %s, creating a backup\n", n.Name, t.Name, detection.MaxAge)
+			return states, ""
+		}
+		if oldest.IsZero() || e.Timestamp.Before(oldest) {
+			oldest = e.Timestamp
+		}
+	}
+	return states, fmt.Sprintf("configuration did not change since the backup of %s", oldest.Format(timestampLayout))
+}
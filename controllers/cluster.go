@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/citrix/adc-nitro-go/service"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	clusterNodeName     = "clip"
+	clusterStateUp      = "up"
+	clusterStateUnknown = "unknown"
+)
+
+// getClusterNode returns a node for the cluster IP address of a target, which is owned by the configuration coordinator
+func getClusterNode(t models.BackupTarget) models.BackupNode {
+	return models.BackupNode{Name: clusterNodeName, Address: t.ClusterAddress}
+}
+
+// isCluster reports whether a target is a cluster
+func isCluster(t models.BackupTarget) bool {
+	return strings.EqualFold(t.Type, models.TargetTypeCluster)
+}
+
+// discoverClusterMembers queries a cluster through its cluster IP address, and returns the target with the members of the cluster as nodes.
+// The configuration coordinator is always the first node, members which are not UP are left out.
+// Members which are configured in the target keep their name and address, other members are named after their node id and reached on their NSIP.
+func discoverClusterMembers(ctx context.Context, t models.BackupTarget, s models.BackupSettings, timeout time.Duration) (models.BackupTarget, *models.ClusterReport, error) {
+	if t.ClusterAddress == "" {
+		return t, nil, newStageError(StageConfiguration, "", fmt.Errorf("target %s has no ClusterAddress", t.Name))
+	}
+
+	clusterTarget := t
+	clusterTarget.Nodes = []models.BackupNode{getClusterNode(t)}
+	nitroClients, err := createNitroClientsForNodes(clusterTarget, s)
+	if err != nil {
+		return t, nil, err
+	}
+	nitroClient := nitroClients[clusterNodeName]
+
+	fmt.Println("Discovering cluster members for", t.Name, "through", t.ClusterAddress)
+	var instances, nodes []map[string]interface{}
+	err = runWithTimeout(ctx, timeout, func(ctx context.Context) error {
+		return runWithContext(ctx, func() error {
+			var err error
+			instances, err = nitroClient.FindAllResources(service.Clusterinstance.Type())
+			if err != nil {
+				return err
+			}
+			nodes, err = nitroClient.FindAllResources(service.Clusternode.Type())
+			return err
+		})
+	})
+	if err != nil {
+		return t, nil, newStageError(StagePrimary, clusterNodeName, err)
+	}
+	if len(nodes) == 0 {
+		return t, nil, newStageError(StagePrimary, clusterNodeName, fmt.Errorf("no cluster members found through %s", t.ClusterAddress))
+	}
+
+	report := &models.ClusterReport{Status: clusterStateUnknown}
+	for _, i := range instances {
+		if state := getResourceValue(i, "operationalstate"); state != "" {
+			report.Status = state
+		}
+	}
+	if !strings.EqualFold(report.Status, clusterStateUp) {
+		report.Problems = append(report.Problems, fmt.Sprintf("cluster is %s", report.Status))
+	}
+
+	var coordinator, members []models.BackupNode
+	for _, e := range nodes {
+		member := models.ClusterMember{
+			NodeId:      getResourceValue(e, "nodeid"),
+			State:       getResourceValue(e, "state"),
+			Health:      getResourceValue(e, "health"),
+			MasterState: getResourceValue(e, "masterstate"),
+			Coordinator: strings.EqualFold(getResourceValue(e, "isconfigurationcoordinator"), "true"),
+		}
+		n := getClusterMemberNode(t, member.NodeId, getResourceValue(e, "ipaddress"))
+		member.Node = n.Name
+		member.Address = n.Address
+
+		report.Members = append(report.Members, member)
+
+		switch {
+		case member.Coordinator && len(coordinator) == 0:
+			report.Coordinator = member.Node
+			coordinator = append(coordinator, n)
+		case !strings.EqualFold(member.Health, clusterStateUp):
+			report.Problems = append(report.Problems, fmt.Sprintf("node %s is %s and is not backed up", member.Node, getHaStatusDescription(member.Health)))
+		default:
+			members = append(members, n)
+		}
+	}
+	printClusterReport(t, report)
+
+	if len(coordinator) == 0 {
+		return t, report, newStageError(StagePrimary, clusterNodeName, fmt.Errorf("no configuration coordinator found for cluster %s", t.Name))
+	}
+
+	t.Nodes = append(coordinator, members...)
+	return t, report, nil
+}
+
+// getClusterMemberNode returns the configured node with the NSIP of a cluster member, or a new node for it
+func getClusterMemberNode(t models.BackupTarget, nodeId string, ipAddress string) models.BackupNode {
+	for _, n := range t.Nodes {
+		if u, err := url.Parse(n.Address); err == nil && strings.EqualFold(u.Hostname(), ipAddress) {
+			return n
+		}
+	}
+
+	// The NSIP is reached with the same scheme and port as the cluster IP address
+	scheme := "https"
+	host := ipAddress
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if u, err := url.Parse(t.ClusterAddress); err == nil {
+		if u.Scheme != "" {
+			scheme = u.Scheme
+		}
+		if u.Port() != "" {
+			host = net.JoinHostPort(ipAddress, u.Port())
+		}
+	}
+	return models.BackupNode{Name: "node" + nodeId, Address: scheme + "://" + host}
+}
+
+func printClusterReport(t models.BackupTarget, report *models.ClusterReport) {
+	var members []string
+	for _, m := range report.Members {
+		member := fmt.Sprintf("%s %s (%s, %s)", m.Node, m.State, m.Health, m.MasterState)
+		if m.Coordinator {
+			member += " CCO"
+		}
+		members = append(members, member)
+	}
+	fmt.Println("Cluster", t.Name, "is", report.Status+":", strings.Join(members, ", "))
+	for _, p := range report.Problems {
+		fmt.Println("Cluster", t.Name, "-", p)
+	}
+}
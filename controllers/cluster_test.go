@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// clusterNitroServer answers the NITRO requests of a cluster backup on the cluster IP address and the NSIP of every member.
+// Each member is reached on an address of its own in 127.0.0.0/8, which is the NSIP the cluster reports for it.
+type clusterNitroServer struct {
+	sync.Mutex
+	servers  map[string]*httptest.Server
+	requests []string
+	archive  string
+}
+
+func newClusterNitroServer(t *testing.T, hosts ...string) *clusterNitroServer {
+	c := &clusterNitroServer{servers: make(map[string]*httptest.Server)}
+
+	var content bytes.Buffer
+	gz := gzip.NewWriter(&content)
+	tw := tar.NewWriter(gz)
+	config := []byte("#NS13.1 Build 37.38\nset ns config -IPAddress 10.0.0.10\n")
+	tw.WriteHeader(&tar.Header{Name: "nsconfig/ns.conf", Mode: 0644, Size: int64(len(config))})
+	tw.Write(config)
+	tw.Close()
+	gz.Close()
+	c.archive = base64.StdEncoding.EncodeToString(content.Bytes())
+
+	for _, host := range hosts {
+		listener, err := net.Listen("tcp", host+":0")
+		if err != nil {
+			t.Skipf("cannot listen on %s: %v", host, err)
+		}
+		server := httptest.NewUnstartedServer(c.handler(host))
+		server.Listener.Close()
+		server.Listener = listener
+		server.Start()
+		t.Cleanup(server.Close)
+		c.servers[host] = server
+	}
+	return c
+}
+
+func (c *clusterNitroServer) handler(host string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Lock()
+		c.requests = append(c.requests, fmt.Sprintf("%s %s %s", host, r.Method, r.URL.Path))
+		c.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/nitro/v1/config/clusterinstance":
+			fmt.Fprint(w, `{"errorcode": 0, "message": "Done", "clusterinstance": [{"clid": "1", "operationalstate": "UP"}]}`)
+		case r.URL.Path == "/nitro/v1/config/clusternode":
+			fmt.Fprint(w, `{"errorcode": 0, "message": "Done", "clusternode": [
+				{"nodeid": "1", "ipaddress": "127.0.0.2", "state": "ACTIVE", "health": "UP", "masterstate": "ACTIVE", "isconfigurationcoordinator": "true"},
+				{"nodeid": "2", "ipaddress": "127.0.0.3", "state": "ACTIVE", "health": "UP", "masterstate": "ACTIVE", "isconfigurationcoordinator": "false"}
+			]}`)
+		case strings.HasPrefix(r.URL.Path, "/nitro/v1/config/systemfile/") && r.Method == http.MethodGet:
+			fmt.Fprintf(w, `{"errorcode": 0, "message": "Done", "systemfile": [{"filename": "%s", "filecontent": "%s"}]}`, strings.TrimPrefix(r.URL.Path, "/nitro/v1/config/systemfile/"), c.archive)
+		default:
+			fmt.Fprint(w, `{"errorcode": 0, "message": "Done", "severity": "NONE"}`)
+		}
+	})
+}
+
+// find returns the number of requests with a method for a resource on a host
+func (c *clusterNitroServer) find(host string, method string, resource string) int {
+	c.Lock()
+	defer c.Unlock()
+
+	var output int
+	for _, r := range c.requests {
+		if strings.HasPrefix(r, host+" "+method+" /nitro/v1/config/"+resource) {
+			output++
+		}
+	}
+	return output
+}
+
+// target returns a cluster target with the cluster IP address on 127.0.0.1, and members on 127.0.0.2 and 127.0.0.3
+func (c *clusterNitroServer) target() models.BackupTarget {
+	return models.BackupTarget{
+		Name:           "cluster",
+		Type:           models.TargetTypeCluster,
+		Username:       "nsbackup",
+		Password:       "s3cret",
+		ClusterAddress: c.servers["127.0.0.1"].URL,
+		Nodes: []models.BackupNode{
+			{Name: "member1", Address: c.servers["127.0.0.2"].URL},
+			{Name: "member2", Address: c.servers["127.0.0.3"].URL},
+		},
+	}
+}
+
+func TestClusterBackupIsCreatedAndDeletedThroughClusterAddress(t *testing.T) {
+	server := newClusterNitroServer(t, "127.0.0.1", "127.0.0.2", "127.0.0.3")
+	target := server.target()
+	s := models.BackupSettings{OutputBasePath: t.TempDir()}
+
+	c := BackupController{}
+	report := c.RunTarget(context.Background(), target, s)
+	if report.Status != models.ReportStatusSuccess {
+		t.Fatalf("cluster backup is %s: %s", report.Status, report.Error)
+	}
+
+	if n := server.find("127.0.0.1", http.MethodPost, "systembackup"); n != 1 {
+		t.Errorf("created %d backups through the cluster IP address, want 1", n)
+	}
+	if n := server.find("127.0.0.1", http.MethodDelete, "systembackup"); n != 1 {
+		t.Errorf("deleted %d backups through the cluster IP address, want 1", n)
+	}
+	for _, host := range []string{"127.0.0.2", "127.0.0.3"} {
+		if n := server.find(host, http.MethodPost, "systembackup") + server.find(host, http.MethodDelete, "systembackup"); n != 0 {
+			t.Errorf("%d backups were created or deleted on the NSIP %s", n, host)
+		}
+		if n := server.find(host, http.MethodGet, "systemfile"); n != 1 {
+			t.Errorf("downloaded %d archives from the NSIP %s, want 1", n, host)
+		}
+	}
+}
+
+func TestClusterManifestHoldsClusterState(t *testing.T) {
+	server := newClusterNitroServer(t, "127.0.0.1", "127.0.0.2", "127.0.0.3")
+	s := models.BackupSettings{OutputBasePath: t.TempDir()}
+
+	c := BackupController{}
+	report := c.RunTarget(context.Background(), server.target(), s)
+	if report.Status != models.ReportStatusSuccess {
+		t.Fatalf("cluster backup is %s: %s", report.Status, report.Error)
+	}
+
+	for _, n := range report.Nodes {
+		content, err := ioutil.ReadFile(n.Locations[0] + models.ManifestExtension)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := parseManifest(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Cluster == nil {
+			t.Fatalf("manifest of %s has no cluster state", n.Node)
+		}
+		if m.Cluster.Status != "UP" || m.Cluster.Coordinator != "member1" {
+			t.Errorf("manifest of %s has cluster %s with coordinator %s, want UP with coordinator member1", n.Node, m.Cluster.Status, m.Cluster.Coordinator)
+		}
+		if len(m.Cluster.Members) != 2 {
+			t.Errorf("manifest of %s has %d cluster members, want 2", n.Node, len(m.Cluster.Members))
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// configExtension is the extension of exported configurations
+const configExtension = ".ns.conf"
+
+// getConfigExports returns the configurations to export for a target.
+// Targets which only export their configuration export the running configuration when nothing else is configured.
+func getConfigExports(t models.BackupTarget) ([]string, error) {
+	var output []string
+	for _, config := range t.ExportConfig {
+		config = strings.ToLower(strings.TrimSpace(config))
+		switch config {
+		case models.ConfigRunning, models.ConfigSaved:
+			output = append(output, config)
+		default:
+			return nil, fmt.Errorf("unknown configuration %q in ExportConfig of target %s, use %s or %s", config, t.Name, models.ConfigRunning, models.ConfigSaved)
+		}
+	}
+
+	if len(output) == 0 && t.ConfigOnly {
+		output = append(output, models.ConfigRunning)
+	}
+	return output, nil
+}
+
+// generateConfigFilename returns the filename of an exported configuration, which is stored next to the archive of the node.
+// The running configuration is stored as <timestamp>_<target>_<node>.ns.conf, the saved configuration as <timestamp>_<target>_<node>.saved.ns.conf.
+func (c *BackupController) generateConfigFilename(timestamp string, target string, node string, config string) string {
+	filename := strings.TrimSuffix(c.generateFilename(timestamp, target, node), ".tgz")
+	if config == models.ConfigSaved {
+		filename += "." + models.ConfigSaved
+	}
+	return filename + configExtension
+}
+
+// exportConfig fetches a configuration from a node as text, and stores it next to the archive of the node.
+// The configuration is normalized first, so identical configurations are stored as identical files.
+// The normalized configuration is added to history, unless it is nil.
+// It returns the report of the configuration with the number of retries.
+func (c *BackupController) exportConfig(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, timestamp string, config string, encrypter encryption.Encrypter, history *nodeHistory) (models.ConfigReport, int, error) {
+	output := models.ConfigReport{
+		Config:   config,
+		Filename: c.generateConfigFilename(timestamp, t.Name, n.Name, config),
+	}
+
+	var text string
+	retries, err := retry(ctx, getRetryPolicy(t, s, OperationDownload), getTimeouts(t, s).Download, OperationDownload, t.Name, n.Name, func(ctx context.Context) error {
+		var err error
+		text, err = c.fetchConfig(ctx, t, n, s, config)
+		return err
+	})
+	if err != nil {
+		return output, retries, newStageError(StageExport, n.Name, err)
+	}
+
+	if encrypter != nil {
+		output.Filename += encrypter.Extension()
+	}
+
+	text = archive.NormalizeConfig(text)
+	spool, size, hash, err := c.spoolConfig(t, s, output.Filename, text, encrypter)
+	if err != nil {
+		return output, retries, newStageError(StageWrite, n.Name, err)
+	}
+	defer os.Remove(spool)
+	output.Size = size
+	output.Sha256 = hash
+
+	output.Locations, err = c.storeArchive(ctx, output.Filename, t, spool, hash, s)
+	if err != nil {
+		return output, retries, newStageError(StageWrite, n.Name, err)
+	}
+	if history != nil {
+		history.addConfig(config, text)
+	}
+	return output, retries, nil
+}
+
+// fetchConfig returns the running or saved configuration of a node as text.
+// The saved configuration is read from /nsconfig/ns.conf when the ADC does not support nssavedconfig.
+func (c *BackupController) fetchConfig(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, config string) (string, error) {
+	if config == models.ConfigRunning {
+		return c.getConfigResource(ctx, t, n, s, "nsrunningconfig", "response")
+	}
+
+	text, err := c.getConfigResource(ctx, t, n, s, "nssavedconfig", "textblob")
+	if err == nil || ctx.Err() != nil || isNetworkError(err) || isAuthenticationError(err) {
+		return text, err
+	}
+
+	fmt.Printf("Could not get nssavedconfig from %s for %s, reading ns.conf instead: %v\n", n.Name, t.Name, err)
+	request, err := newNitroRequest(ctx, t, n, s, "/nitro/v1/config/systemfile/ns.conf?args=fileLocation:"+url.PathEscape("/nsconfig"))
+	if err != nil {
+		return "", err
+	}
+
+	response, err := newNitroHttpClient(t, s).Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return "", fmt.Errorf("could not get ns.conf: %s %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	content, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, newSystemFileContentReader(response.Body)))
+	if err != nil {
+		return "", fmt.Errorf("could not get ns.conf: %v", err)
+	}
+	return string(content), nil
+}
+
+// getConfigResource returns a text field of a NITRO resource which holds a configuration.
+// NITRO returns the resource either as an object or as an array with a single object.
+func (c *BackupController) getConfigResource(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, resourceType string, field string) (string, error) {
+	request, err := newNitroRequest(ctx, t, n, s, "/nitro/v1/config/"+resourceType)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := newNitroHttpClient(t, s).Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not get %s: %v", resourceType, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		if len(body) > 4096 {
+			body = body[:4096]
+		}
+		return "", fmt.Errorf("could not get %s: %s %s", resourceType, response.Status, strings.TrimSpace(string(body)))
+	}
+
+	var resources map[string]json.RawMessage
+	if err = json.Unmarshal(body, &resources); err != nil {
+		return "", fmt.Errorf("could not get %s: %v", resourceType, err)
+	}
+
+	var resource map[string]interface{}
+	if err = json.Unmarshal(resources[resourceType], &resource); err != nil {
+		var list []map[string]interface{}
+		if json.Unmarshal(resources[resourceType], &list) == nil && len(list) > 0 {
+			resource = list[0]
+		}
+	}
+
+	text, ok := resource[field].(string)
+	if !ok {
+		return "", fmt.Errorf("could not get %s: response has no %s", resourceType, field)
+	}
+	return text, nil
+}
+
+// spoolConfig writes a configuration to a spool file, optionally encrypting it.
+// It returns the path of the spool file, with the size and sha256 hash of its content.
+func (c *BackupController) spoolConfig(t models.BackupTarget, s models.BackupSettings, name string, text string, encrypter encryption.Encrypter) (string, int64, string, error) {
+	directory, err := c.getSpoolDirectory(t, s)
+	if err != nil {
+		return "", 0, "", err
+	}
+	spool, err := ioutil.TempFile(directory, "."+name+".*")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	var writer io.Writer = io.MultiWriter(spool, hash)
+	var encryptedWriter io.WriteCloser
+	if encrypter != nil {
+		encryptedWriter, err = encrypter.Encrypt(writer)
+		if err == nil {
+			writer = encryptedWriter
+		}
+	}
+	if err == nil {
+		_, err = io.WriteString(writer, text)
+	}
+	if err == nil && encryptedWriter != nil {
+		err = encryptedWriter.Close()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = spool.Stat()
+	}
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(spool.Name())
+		return "", 0, "", err
+	}
+	return spool.Name(), info.Size(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isConfigFilename reports whether a filename without its encryption extension is an exported configuration.
+// It returns the filename without the extension of the configuration.
+func isConfigFilename(filename string) (string, bool) {
+	if !strings.HasSuffix(filename, configExtension) {
+		return filename, false
+	}
+	filename = strings.TrimSuffix(filename, configExtension)
+	return strings.TrimSuffix(filename, "."+models.ConfigSaved), true
+}
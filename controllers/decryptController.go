@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type DecryptController struct{}
+
+type DecryptControllerCaller interface {
+	Run(filename string, output string, o encryption.DecryptOptions) (string, error)
+
+	verifyArchive(filename string) error
+}
+
+// Run decrypts an encrypted archive to output, or next to the archive without the encryption extension when output is empty.
+// The output is only put in place once the archive is decrypted completely and verified to be a valid gzipped tar.
+// Exported configurations are plain text, so they are decrypted without verification.
+func (c *DecryptController) Run(filename string, output string, o encryption.DecryptOptions) (string, error) {
+	if output == "" {
+		output = encryption.TrimExtension(filename)
+	}
+	if output == filename {
+		return output, fmt.Errorf("%s is not an encrypted archive", filename)
+	}
+	if _, err := os.Stat(output); err == nil {
+		return output, fmt.Errorf("%s already exists", output)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return output, err
+	}
+	defer f.Close()
+
+	reader, err := encryption.Decrypt(filename, f, o)
+	if err != nil {
+		return output, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".*")
+	if err != nil {
+		return output, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return output, err
+	}
+
+	if _, ok := isConfigFilename(output); !ok {
+		err = c.verifyArchive(tmp.Name())
+		if err != nil {
+			return output, fmt.Errorf("decrypted content of %s is not a valid archive: %v", filename, err)
+		}
+	}
+	return output, os.Rename(tmp.Name(), output)
+}
+
+func (c *DecryptController) verifyArchive(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewReader(gz)
+	for {
+		_, err = archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(ioutil.Discard, archive); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	DiffLatest   = "latest"
+	DiffPrevious = "previous"
+)
+
+// DiffOptions select the archives of a target which are compared, and how the comparison is written
+type DiffOptions struct {
+	Destination string
+	Node        string
+	ToNode      string
+	// From and To are a timestamp or a prefix of one, latest, or previous for the archive before To
+	From    string
+	To      string
+	Ha      bool
+	Context int
+	Decrypt encryption.DecryptOptions
+}
+
+// diffArchive is an archive which is compared, read from a destination or from a local file when Storage is nil
+type diffArchive struct {
+	Storage storage.Storage
+	Name    string
+	Label   string
+}
+
+type DiffController struct{}
+
+type DiffControllerCaller interface {
+	RunFiles(ctx context.Context, from string, to string, o DiffOptions, w io.Writer) error
+	RunTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings, o DiffOptions, w io.Writer) error
+
+	getNodes(t models.BackupTarget, o DiffOptions) (string, string, error)
+	findArchive(archives []backupArchive, node string, timestamp string, before string) (backupArchive, string, error)
+	readArchive(ctx context.Context, a diffArchive, o encryption.DecryptOptions) (archive.Archive, error)
+	compare(ctx context.Context, from diffArchive, to diffArchive, o DiffOptions, w io.Writer) error
+	writeDiff(w io.Writer, from diffArchive, to diffArchive, fromArchive archive.Archive, toArchive archive.Archive, context int) error
+}
+
+// RunFiles compares two local archives
+func (c *DiffController) RunFiles(ctx context.Context, from string, to string, o DiffOptions, w io.Writer) error {
+	return c.compare(ctx, diffArchive{Name: from, Label: from}, diffArchive{Name: to, Label: to}, o, w)
+}
+
+// RunTarget compares two archives of a target, which are looked up on a destination of the target by node and timestamp.
+// Without a destination, the archives are read from the first destination of the target, which is OutputBasePath by default.
+func (c *DiffController) RunTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings, o DiffOptions, w io.Writer) error {
+	var d destination
+	var err error
+	if o.Destination != "" {
+		d, err = getDestination(t, s, o.Destination)
+	} else {
+		var destinations []destination
+		destinations, err = getDestinations(t, s)
+		if err == nil {
+			d = destinations[0]
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fromNode, toNode, err := c.getNodes(t, o)
+	if err != nil {
+		return err
+	}
+
+	r := RetentionController{}
+	archives, err := r.listArchives(ctx, t, s, d.Storage)
+	if err != nil {
+		return err
+	}
+
+	to := o.To
+	if to == "" {
+		to = DiffLatest
+	}
+	toArchive, toName, err := c.findArchive(archives, toNode, to, "")
+	if err != nil {
+		return err
+	}
+
+	// Different nodes are compared from the same run, a node is compared to its previous archive
+	from := o.From
+	if from == "" && fromNode != toNode {
+		from = toArchive.Timestamp.Format(timestampLayout)
+	} else if from == "" {
+		from = DiffPrevious
+	}
+	_, fromName, err := c.findArchive(archives, fromNode, from, toArchive.Timestamp.Format(timestampLayout))
+	if err != nil {
+		return err
+	}
+
+	return c.compare(ctx,
+		diffArchive{Storage: d.Storage, Name: fromName, Label: path.Base(fromName)},
+		diffArchive{Storage: d.Storage, Name: toName, Label: path.Base(toName)},
+		o, w)
+}
+
+// getNodes returns the nodes of which the archives are compared.
+// For HA pairs, the first two nodes are compared, otherwise the node must be given unless the target has a single node.
+func (c *DiffController) getNodes(t models.BackupTarget, o DiffOptions) (string, string, error) {
+	if o.Ha {
+		if len(t.Nodes) < 2 {
+			return "", "", fmt.Errorf("target %s has less than two nodes", t.Name)
+		}
+		return t.Nodes[0].Name, t.Nodes[1].Name, nil
+	}
+
+	fromNode := o.Node
+	if fromNode == "" {
+		if len(t.Nodes) != 1 {
+			return "", "", fmt.Errorf("target %s has %d nodes, select one with --node", t.Name, len(t.Nodes))
+		}
+		fromNode = t.Nodes[0].Name
+	}
+
+	toNode := o.ToNode
+	if toNode == "" {
+		toNode = fromNode
+	}
+
+	for _, name := range []string{fromNode, toNode} {
+		found := false
+		for _, n := range t.Nodes {
+			found = found || n.Name == name
+		}
+		if !found {
+			return "", "", fmt.Errorf("node %s is not defined for target %s", name, t.Name)
+		}
+	}
+	return fromNode, toNode, nil
+}
+
+// findArchive returns the archive of a node for a timestamp, with the name of its system backup.
+// The timestamp is latest, previous for the last archive before the timestamp before, or the start of a timestamp, which selects the last archive that matches.
+func (c *DiffController) findArchive(archives []backupArchive, node string, timestamp string, before string) (backupArchive, string, error) {
+	var candidates []backupArchive
+	for _, a := range archives {
+		if a.Node == node {
+			candidates = append(candidates, a)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Timestamp.After(candidates[j].Timestamp)
+	})
+
+	for _, a := range candidates {
+		name, ok := getSystemBackupArchiveName(a)
+		if !ok {
+			continue
+		}
+
+		current := a.Timestamp.Format(timestampLayout)
+		switch timestamp {
+		case DiffLatest:
+			return a, name, nil
+		case DiffPrevious:
+			if before == "" || current < before {
+				return a, name, nil
+			}
+		default:
+			if strings.HasPrefix(current, timestamp) {
+				return a, name, nil
+			}
+		}
+	}
+
+	if timestamp == DiffPrevious {
+		return backupArchive{}, "", fmt.Errorf("node %s has no archive before %s", node, before)
+	}
+	return backupArchive{}, "", fmt.Errorf("node %s has no archive for %s", node, timestamp)
+}
+
+// getSystemBackupArchiveName returns the name of the system backup among the files of a backup, which also holds its manifest and the exported configurations
+func getSystemBackupArchiveName(a backupArchive) (string, bool) {
+	for _, name := range a.Names {
+		if _, ok := isManifestFilename(name); ok {
+			continue
+		}
+		if _, ok := isConfigFilename(encryption.TrimExtension(name)); !ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// readArchive reads the entries of an archive into memory, with the content of ns.conf. Encrypted archives are decrypted first.
+func (c *DiffController) readArchive(ctx context.Context, a diffArchive, o encryption.DecryptOptions) (archive.Archive, error) {
+	var r io.ReadCloser
+	var err error
+	if a.Storage != nil {
+		r, err = a.Storage.Get(ctx, a.Name)
+	} else {
+		r, err = os.Open(a.Name)
+	}
+	if err != nil {
+		return archive.Archive{}, err
+	}
+	defer r.Close()
+
+	var reader io.Reader = r
+	if encryption.IsEncrypted(a.Name) {
+		reader, err = encryption.Decrypt(a.Name, r, o)
+		if err != nil {
+			return archive.Archive{}, err
+		}
+	}
+
+	output, err := archive.Read(reader, func(name string) bool {
+		return name == archive.ConfigName
+	})
+	if err == nil {
+		// Encrypted archives are only authenticated once they are read completely
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	if err != nil {
+		return output, fmt.Errorf("could not read %s: %v", a.Label, err)
+	}
+	return output, nil
+}
+
+func (c *DiffController) compare(ctx context.Context, from diffArchive, to diffArchive, o DiffOptions, w io.Writer) error {
+	fromArchive, err := c.readArchive(ctx, from, o.Decrypt)
+	if err != nil {
+		return err
+	}
+	toArchive, err := c.readArchive(ctx, to, o.Decrypt)
+	if err != nil {
+		return err
+	}
+
+	context := o.Context
+	if context < 0 {
+		context = 0
+	}
+	return c.writeDiff(w, from, to, fromArchive, toArchive, context)
+}
+
+// writeDiff writes the files which changed between two archives, the number of changed commands per type and a unified diff of ns.conf
+func (c *DiffController) writeDiff(w io.Writer, from diffArchive, to diffArchive, fromArchive archive.Archive, toArchive archive.Archive, context int) error {
+	changes := archive.Compare(fromArchive, toArchive)
+
+	var fromConfig, toConfig string
+	if f, ok := archive.Find(fromArchive.Files, archive.ConfigName); ok {
+		fromConfig = archive.NormalizeConfig(string(f.Content))
+	}
+	if f, ok := archive.Find(toArchive.Files, archive.ConfigName); ok {
+		toConfig = archive.NormalizeConfig(string(f.Content))
+	}
+	lines := archive.DiffLines(fromConfig, toConfig)
+	commands := archive.CountCommands(lines)
+
+	fmt.Fprintln(w, "From:", from.Label)
+	fmt.Fprintln(w, "To:  ", to.Label)
+	fmt.Fprintln(w)
+
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No differences")
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Status]++
+	}
+	fmt.Fprintf(w, "Files: %d added, %d removed, %d changed\n", counts[archive.ChangeAdded], counts[archive.ChangeRemoved], counts[archive.ChangeChanged])
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, change := range changes {
+		size := fmt.Sprintf("%d bytes", change.ToSize)
+		switch change.Status {
+		case archive.ChangeRemoved:
+			size = fmt.Sprintf("%d bytes", change.FromSize)
+		case archive.ChangeChanged:
+			size = fmt.Sprintf("%d -> %d bytes", change.FromSize, change.ToSize)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", change.Status, change.Name, size)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(commands) > 0 {
+		var added, removed int
+		for _, command := range commands {
+			added += command.Added
+			removed += command.Removed
+		}
+		fmt.Fprintf(w, "\nCommands in ns.conf: %d added, %d removed\n", added, removed)
+
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  COMMAND\tADDED\tREMOVED")
+		for _, command := range commands {
+			fmt.Fprintf(tw, "  %s\t%d\t%d\n", command.Command, command.Added, command.Removed)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	diff := archive.UnifiedDiff(from.Label+":"+archive.ConfigName, to.Label+":"+archive.ConfigName, lines, context)
+	if diff == "" {
+		return nil
+	}
+	fmt.Fprintln(w)
+	_, err := io.WriteString(w, diff)
+	return err
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Stage is the step of a run in which a target failed
+type Stage string
+
+const (
+	StageConfiguration  Stage = "configuration"
+	StageClient         Stage = "client"
+	StageAuthentication Stage = "authentication"
+	StagePrimary        Stage = "primary detection"
+	StageCreate         Stage = "create"
+	StageDownload       Stage = "download"
+	StageExport         Stage = "config export"
+	StageWrite          Stage = "write"
+	StageCleanup        Stage = "cleanup"
+	StageSetup          Stage = "setup"
+)
+
+// nitroErrorCodeAuthentication is returned by NITRO for an invalid username or password
+const nitroErrorCodeAuthentication = 354
+
+// StageError is an error which occurred in a stage of a run, for a target or for one of its nodes
+type StageError struct {
+	Stage Stage
+	Node  string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	if e.Node != "" {
+		return fmt.Sprintf("%s failed on node %s: %v", e.Stage, e.Node, e.Err)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// newStageError wraps err in a StageError. Errors caused by invalid credentials are always reported as authentication errors.
+func newStageError(stage Stage, node string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return err
+	}
+	if isAuthenticationError(err) {
+		stage = StageAuthentication
+	}
+	return &StageError{Stage: stage, Node: node, Err: err}
+}
+
+// getErrorStage returns the stage of an error, or an empty string when it is not a StageError
+func getErrorStage(err error) Stage {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage
+	}
+	return ""
+}
+
+func isAuthenticationError(err error) bool {
+	return getNitroErrorCode(err) == nitroErrorCodeAuthentication || strings.Contains(err.Error(), "401 Unauthorized")
+}
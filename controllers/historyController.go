@@ -0,0 +1,359 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyRemoteName  = "origin"
+	historyAuthorName  = "citrixadc-backup"
+	historyAuthorEmail = "citrixadc-backup@localhost"
+)
+
+// historyMutex serializes the targets which commit to the history repository at the same time
+var historyMutex sync.Mutex
+
+// nodeHistory holds the files of a node which are kept in the history repository.
+// Names are relative to the directory of the node.
+type nodeHistory struct {
+	Node     string
+	Firmware string
+	Files    []archive.File
+}
+
+// add adds a file to the history of a node, replacing a file with the same name
+func (h *nodeHistory) add(name string, content []byte) {
+	for i, f := range h.Files {
+		if f.Name == name {
+			h.Files[i].Content = content
+			h.Files[i].Size = int64(len(content))
+			return
+		}
+	}
+	h.Files = append(h.Files, archive.File{Name: name, Size: int64(len(content)), Content: content})
+}
+
+// addArchiveFiles adds the key text files of a system backup, with ns.conf normalized like an exported configuration
+func (h *nodeHistory) addArchiveFiles(files []archive.File) {
+	for _, f := range files {
+		if !archive.IsText(f.Content) {
+			continue
+		}
+		content := f.Content
+		if f.Name == archive.ConfigName {
+			content = []byte(archive.NormalizeConfig(string(content)))
+			h.Firmware = archive.GetFirmwareVersion(content)
+		}
+		h.add(strings.TrimPrefix(f.Name, "nsconfig/"), content)
+	}
+}
+
+// addConfig adds an exported configuration as running.ns.conf or saved.ns.conf
+func (h *nodeHistory) addConfig(config string, text string) {
+	if h.Firmware == "" {
+		h.Firmware = archive.GetFirmwareVersion([]byte(text))
+	}
+	h.add(config+configExtension, []byte(text))
+}
+
+type HistoryController struct{}
+
+type HistoryControllerCaller interface {
+	Commit(ctx context.Context, t models.BackupTarget, s models.BackupSettings, timestamp string, nodes []nodeHistory) *models.HistoryReport
+
+	commit(ctx context.Context, t models.BackupTarget, s models.BackupSettings, timestamp string, nodes []nodeHistory, report *models.HistoryReport) error
+	openRepository(h models.HistorySettings) (*git.Repository, error)
+	writeNode(root string, t models.BackupTarget, n nodeHistory) error
+	stageTarget(w *git.Worktree, t models.BackupTarget) ([]string, error)
+	getCommitMessage(t models.BackupTarget, timestamp string, nodes []nodeHistory, changed []string) string
+	push(ctx context.Context, repository *git.Repository, s models.BackupSettings) error
+	getAuth(s models.BackupSettings) (transport.AuthMethod, error)
+}
+
+// Commit writes the files of the nodes of a target to the history repository, with one directory per target and node.
+// A commit is only created when something changed, and it is pushed when a remote is configured.
+// Errors do not fail the backup, as the archives are already stored, so they are returned in the report.
+func (c *HistoryController) Commit(ctx context.Context, t models.BackupTarget, s models.BackupSettings, timestamp string, nodes []nodeHistory) *models.HistoryReport {
+	report := &models.HistoryReport{}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	err := c.commit(ctx, t, s, timestamp, nodes, report)
+	if err != nil {
+		report.Error = err.Error()
+		fmt.Println("Error writing history of", t.Name, ":", err)
+	}
+	return report
+}
+
+func (c *HistoryController) commit(ctx context.Context, t models.BackupTarget, s models.BackupSettings, timestamp string, nodes []nodeHistory, report *models.HistoryReport) error {
+	repository, err := c.openRepository(s.History)
+	if err != nil {
+		return err
+	}
+	w, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		err = c.writeNode(s.History.Path, t, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	changed, err := c.stageTarget(w, t)
+	if err != nil {
+		return err
+	}
+
+	if len(changed) > 0 {
+		author := &object.Signature{
+			Name:  s.History.AuthorName,
+			Email: s.History.AuthorEmail,
+			When:  time.Now(),
+		}
+		if author.Name == "" {
+			author.Name = historyAuthorName
+		}
+		if author.Email == "" {
+			author.Email = historyAuthorEmail
+		}
+
+		hash, err := w.Commit(c.getCommitMessage(t, timestamp, nodes, changed), &git.CommitOptions{Author: author})
+		if err != nil {
+			return err
+		}
+		report.Changed = true
+		report.Commit = hash.String()
+		fmt.Println("Committed history of", t.Name, "as", hash.String()[:7])
+	} else {
+		fmt.Println("History of", t.Name, "is unchanged")
+	}
+
+	if s.History.Remote == "" {
+		return nil
+	}
+	err = c.push(ctx, repository, s)
+	if err != nil {
+		return fmt.Errorf("could not push to %s: %v", s.History.Remote, err)
+	}
+	report.Pushed = true
+	return nil
+}
+
+// openRepository opens the history repository, or creates it on the configured branch when it does not exist
+func (c *HistoryController) openRepository(h models.HistorySettings) (*git.Repository, error) {
+	repository, err := git.PlainOpen(h.Path)
+	if err == nil || !errors.Is(err, git.ErrRepositoryNotExists) {
+		return repository, err
+	}
+
+	fmt.Println("Creating history repository in", h.Path)
+	repository, err = git.PlainInit(h.Path, false)
+	if err != nil {
+		return nil, err
+	}
+	if h.Branch != "" {
+		err = repository.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(h.Branch)))
+	}
+	return repository, err
+}
+
+// writeNode replaces the directory of a node in the history repository with the files of the node
+func (c *HistoryController) writeNode(root string, t models.BackupTarget, n nodeHistory) error {
+	directory := filepath.Join(root, t.Name, n.Node)
+	err := os.RemoveAll(directory)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range n.Files {
+		filename := filepath.Join(directory, filepath.FromSlash(f.Name))
+		err = os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filename, f.Content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageTarget stages the changes in the directory of a target, including deleted files.
+// It returns the nodes of the target which changed.
+func (c *HistoryController) stageTarget(w *git.Worktree, t models.BackupTarget) ([]string, error) {
+	status, err := w.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := t.Name + "/"
+	nodes := make(map[string]bool)
+	for name, s := range status {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		switch {
+		case s.Worktree == git.Deleted:
+			_, err = w.Remove(name)
+		case s.Worktree != git.Unmodified:
+			_, err = w.Add(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		nodes[strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)[0]] = true
+	}
+
+	var output []string
+	for n := range nodes {
+		output = append(output, n)
+	}
+	sort.Strings(output)
+	return output, nil
+}
+
+func (c *HistoryController) getCommitMessage(t models.BackupTarget, timestamp string, nodes []nodeHistory, changed []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: backup %s\n\n", t.Name, timestamp)
+	fmt.Fprintf(&b, "Target:    %s\n", t.Name)
+	fmt.Fprintf(&b, "Timestamp: %s\n", timestamp)
+	for _, name := range changed {
+		firmware := "unknown firmware"
+		for _, n := range nodes {
+			if n.Node == name && n.Firmware != "" {
+				firmware = n.Firmware
+			}
+		}
+		fmt.Fprintf(&b, "Node:      %s (%s)\n", name, firmware)
+	}
+	return b.String()
+}
+
+// push pushes the current branch of the history repository to the configured remote
+func (c *HistoryController) push(ctx context.Context, repository *git.Repository, s models.BackupSettings) error {
+	cfg, err := repository.Config()
+	if err != nil {
+		return err
+	}
+	if r, ok := cfg.Remotes[historyRemoteName]; !ok || len(r.URLs) != 1 || r.URLs[0] != s.History.Remote {
+		cfg.Remotes[historyRemoteName] = &config.RemoteConfig{Name: historyRemoteName, URLs: []string{s.History.Remote}}
+		err = repository.SetConfig(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	head, err := repository.Head()
+	if err != nil {
+		return err
+	}
+	auth, err := c.getAuth(s)
+	if err != nil {
+		return err
+	}
+
+	branch := head.Name().String()
+	err = repository.PushContext(ctx, &git.PushOptions{
+		RemoteName: historyRemoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(branch + ":" + branch)},
+		Auth:       auth,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
+
+// getAuth returns the authentication for the remote of the history repository.
+// HTTP remotes use Username and Password, SSH remotes use PrivateKeyFile or Password, and check the host key against KnownHostsFile.
+func (c *HistoryController) getAuth(s models.BackupSettings) (transport.AuthMethod, error) {
+	h := s.History
+
+	username, err := secrets.Resolve(h.Username, s.KeystorePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve username: %v", err)
+	}
+	password, err := secrets.Resolve(h.Password, s.KeystorePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve password: %v", err)
+	}
+
+	endpoint, err := transport.NewEndpoint(h.Remote)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpoint.Protocol {
+	case "http", "https":
+		if username == "" && password == "" {
+			return nil, nil
+		}
+		return &githttp.BasicAuth{Username: username, Password: password}, nil
+	case "ssh":
+	default:
+		return nil, nil
+	}
+
+	if username == "" {
+		username = endpoint.User
+	}
+	if username == "" {
+		username = "git"
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !h.InsecureIgnoreHostKey {
+		knownHostsFile := h.KnownHostsFile
+		if knownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read known hosts: %v", err)
+		}
+	}
+
+	if h.PrivateKeyFile != "" {
+		auth, err := gitssh.NewPublicKeysFromFile(username, h.PrivateKeyFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key %s: %v", h.PrivateKeyFile, err)
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		return auth, nil
+	}
+	auth := &gitssh.Password{User: username, Password: password}
+	auth.HostKeyCallback = hostKeyCallback
+	return auth, nil
+}
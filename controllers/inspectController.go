@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type InspectController struct{}
+
+type InspectControllerCaller interface {
+	Run(filename string, o encryption.DecryptOptions) (archive.Info, error)
+	Write(info archive.Info, format string, w io.Writer) error
+
+	writeTable(info archive.Info, w io.Writer) error
+	writeTree(entries []archive.Entry, w io.Writer) error
+}
+
+// Run reads a local archive and summarizes its content. Encrypted archives are decrypted first.
+// Only errors which prevent reading the archive at all are returned, a truncated or corrupt archive is reported in the problems of the summary.
+func (c *InspectController) Run(filename string, o encryption.DecryptOptions) (archive.Info, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return archive.Info{}, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if encryption.IsEncrypted(filename) {
+		r, err = encryption.Decrypt(filename, f, o)
+		if err != nil {
+			return archive.Info{}, err
+		}
+	}
+
+	a, err := archive.Read(r, func(name string) bool {
+		return name == archive.ConfigName
+	})
+	if err == nil {
+		// Encrypted archives are only authenticated once they are read completely
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+
+	info := archive.Inspect(a, err)
+	info.Name = path.Base(filename)
+	return info, nil
+}
+
+// Write writes the summary of an archive as a table, json or yaml
+func (c *InspectController) Write(info archive.Info, format string, w io.Writer) error {
+	switch format {
+	case "table":
+		return c.writeTable(info, w)
+	case "json":
+		output, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(output, '\n'))
+		return err
+	case "yaml":
+		output, err := yaml.Marshal(info)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(output)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+func (c *InspectController) writeTable(info archive.Info, w io.Writer) error {
+	r := ReportController{}
+
+	var vservers []string
+	for group, count := range info.Vservers {
+		vservers = append(vservers, fmt.Sprintf("%s %d", group, count))
+	}
+	sort.Strings(vservers)
+	vserverCount := fmt.Sprintf("%d", info.VserverCount())
+	if len(vservers) > 0 {
+		vserverCount += " (" + strings.Join(vservers, ", ") + ")"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Archive:\t%s\n", info.Name)
+	fmt.Fprintf(tw, "Level:\t%s\n", info.Level)
+	fmt.Fprintf(tw, "Firmware:\t%s\n", r.summaryValue(info.Release))
+	fmt.Fprintf(tw, "Build:\t%s\n", r.summaryValue(info.Build))
+	fmt.Fprintf(tw, "Hostname:\t%s\n", r.summaryValue(info.Hostname))
+	fmt.Fprintf(tw, "NSIP:\t%s\n", r.summaryValue(info.Nsip))
+	fmt.Fprintf(tw, "HA peer:\t%s\n", r.summaryValue(strings.Join(info.HaPeers, ", ")))
+	fmt.Fprintf(tw, "Vservers:\t%s\n", vserverCount)
+	fmt.Fprintf(tw, "Certkeys:\t%d\n", info.CertKeys)
+	fmt.Fprintf(tw, "Policies:\t%d\n", info.Policies)
+	fmt.Fprintf(tw, "Files:\t%d, %d bytes\n", info.FileCount, info.Size)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(info.Problems) > 0 {
+		fmt.Fprintln(w, "\nProblems:")
+		for _, p := range info.Problems {
+			fmt.Fprintln(w, "  "+p)
+		}
+	}
+
+	if len(info.Files) > 0 {
+		fmt.Fprintln(w)
+		return c.writeTree(info.Files, w)
+	}
+	return nil
+}
+
+// writeTree writes the entries of an archive as a tree of directories, with the size of every file.
+// Entries must be sorted by name.
+func (c *InspectController) writeTree(entries []archive.Entry, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE")
+
+	var previous []string
+	for _, e := range entries {
+		parts := strings.Split(e.Name, "/")
+		directories := parts[:len(parts)-1]
+
+		common := 0
+		for common < len(previous) && common < len(directories) && previous[common] == directories[common] {
+			common++
+		}
+		for i := common; i < len(directories); i++ {
+			fmt.Fprintf(tw, "%s%s/\t\n", strings.Repeat("  ", i), directories[i])
+		}
+		fmt.Fprintf(tw, "%s%s\t%d\n", strings.Repeat("  ", len(directories)), parts[len(parts)-1], e.Size)
+		previous = directories
+	}
+	return tw.Flush()
+}
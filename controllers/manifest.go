@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"os"
+	"strings"
+	"time"
+)
+
+// getNodeHaState returns the role of a node in its target at the time of the backup
+func getNodeHaState(t models.BackupTarget, report *models.TargetReport, n models.BackupNode) string {
+	switch strings.ToLower(t.Type) {
+	case models.TargetTypeStandalone:
+		return haStateStandalone
+	case models.TargetTypeCluster:
+		if n.Name == report.PrimaryNode {
+			return "cluster coordinator"
+		}
+		return "cluster member"
+	}
+
+	if report.Topology != nil {
+		for _, node := range report.Topology.Nodes {
+			if node.Node == n.Name && node.State != "" {
+				return strings.ToLower(node.State)
+			}
+		}
+	}
+	return ""
+}
+
+// newManifest describes a stored system backup, with the archive which was read while it was downloaded.
+// The backups of cluster members hold the state of the cluster and its members at the time of the backup.
+func (c *BackupController) newManifest(t models.BackupTarget, n models.BackupNode, s models.BackupSettings, timestamp string, report *models.NodeReport, cluster *models.ClusterReport, encrypter encryption.Encrypter, a archive.Archive) models.Manifest {
+	info := archive.Inspect(a, nil)
+
+	output := models.Manifest{
+		Format:           models.ManifestFormat,
+		Filename:         report.Filename,
+		Target:           t.Name,
+		Node:             n.Name,
+		Timestamp:        timestamp,
+		Created:          time.Now(),
+		ToolVersion:      models.ToolVersion,
+		Size:             report.Size,
+		Sha256:           report.Sha256,
+		GzipValid:        true,
+		TarValid:         true,
+		FileCount:        info.FileCount,
+		UncompressedSize: info.Size,
+		Hostname:         info.Hostname,
+		Firmware:         info.Firmware,
+		HaState:          report.HaState,
+		Level:            strings.ToLower(t.Level),
+		ConfigState:      report.ConfigState,
+		Cluster:          cluster,
+	}
+	if encrypter != nil {
+		output.Encryption = strings.ToLower(s.Encryption.Type)
+	}
+	if output.Level == "" {
+		output.Level = archive.LevelBasic
+	}
+
+	for _, name := range archive.ExpectedMembers {
+		member := models.ManifestMember{Name: name}
+		if e, ok := a.Entry(name); ok {
+			member.Present = true
+			member.Sha256 = e.Sha256
+		}
+		output.Members = append(output.Members, member)
+	}
+	return output
+}
+
+// storeManifest writes the manifest of an archive next to it on every destination of the target
+func (c *BackupController) storeManifest(ctx context.Context, t models.BackupTarget, s models.BackupSettings, m models.Manifest) ([]string, error) {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	filename := m.Filename + models.ManifestExtension
+	spool, _, _, err := c.spoolConfig(t, s, filename, string(content)+"\n", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool)
+
+	// Manifests are unique to their archive, so they are not deduplicated
+	return c.storeArchive(ctx, filename, t, spool, "", s)
+}
+
+// parseManifest reads a manifest, and checks that it describes an archive
+func parseManifest(content []byte) (models.Manifest, error) {
+	var output models.Manifest
+	err := json.Unmarshal(content, &output)
+	if err != nil {
+		return output, err
+	}
+	if output.Format < 1 || output.Format > models.ManifestFormat {
+		return output, fmt.Errorf("unsupported manifest format %d", output.Format)
+	}
+	if output.Sha256 == "" {
+		return output, fmt.Errorf("manifest has no sha256")
+	}
+	return output, nil
+}
+
+// isManifestFilename reports whether a filename is the manifest of an archive, and returns the filename of the archive
+func isManifestFilename(filename string) (string, bool) {
+	if !strings.HasSuffix(filename, models.ManifestExtension) {
+		return filename, false
+	}
+	return strings.TrimSuffix(filename, models.ManifestExtension), true
+}
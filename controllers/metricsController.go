@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	metricLastSuccess         = "citrixadc_backup_last_success_timestamp_seconds"
+	metricLastSkip            = "citrixadc_backup_last_skip_timestamp_seconds"
+	metricLastAttempt         = "citrixadc_backup_last_attempt_timestamp_seconds"
+	metricLastDuration        = "citrixadc_backup_last_duration_seconds"
+	metricLastArchiveSize     = "citrixadc_backup_last_archive_size_bytes"
+	metricConsecutiveFailures = "citrixadc_backup_consecutive_failures"
+)
+
+type MetricsController struct {
+	mux                 sync.Mutex
+	registry            *prometheus.Registry
+	gauges              map[string]*prometheus.GaugeVec
+	consecutiveFailures map[[2]string]float64
+	server              *http.Server
+}
+
+type MetricsControllerCaller interface {
+	Update(t models.BackupTarget, r models.TargetReport)
+	getNodes(t models.BackupTarget, r models.TargetReport) []models.BackupNode
+	Serve(address string)
+	LoadTextfile(filename string) error
+	WriteTextfile(filename string) error
+}
+
+// NewMetricsController returns a MetricsController with the backup metrics registered per target and node
+func NewMetricsController() *MetricsController {
+	c := &MetricsController{
+		registry:            prometheus.NewRegistry(),
+		gauges:              make(map[string]*prometheus.GaugeVec),
+		consecutiveFailures: make(map[[2]string]float64),
+	}
+
+	help := map[string]string{
+		metricLastSuccess:         "Unix timestamp of the last successful backup.",
+		metricLastSkip:            "Unix timestamp of the last backup which was skipped because the configuration did not change.",
+		metricLastAttempt:         "Unix timestamp of the last backup attempt.",
+		metricLastDuration:        "Duration of the last backup attempt in seconds.",
+		metricLastArchiveSize:     "Size of the last successfully stored archive in bytes.",
+		metricConsecutiveFailures: "Number of backup attempts which failed since the last successful or skipped backup.",
+	}
+	for name, h := range help {
+		c.gauges[name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: h}, []string{"target", "node"})
+		c.registry.MustRegister(c.gauges[name])
+	}
+	return c
+}
+
+// Update records the outcome of a backup run for every node of the target
+func (c *MetricsController) Update(t models.BackupTarget, r models.TargetReport) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	now := float64(time.Now().Unix())
+	for _, n := range c.getNodes(t, r) {
+		key := [2]string{t.Name, n.Name}
+		duration := r.DurationSeconds
+		success := false
+		skipped := false
+
+		for _, nr := range r.Nodes {
+			if nr.Node == n.Name {
+				duration = nr.DurationSeconds
+				success = nr.Status == models.ReportStatusSuccess
+				skipped = nr.Status == models.ReportStatusSkipped
+				if success {
+					c.gauges[metricLastArchiveSize].WithLabelValues(t.Name, n.Name).Set(float64(nr.Size))
+				}
+			}
+		}
+
+		c.gauges[metricLastAttempt].WithLabelValues(t.Name, n.Name).Set(now)
+		c.gauges[metricLastDuration].WithLabelValues(t.Name, n.Name).Set(duration)
+		switch {
+		case success:
+			c.gauges[metricLastSuccess].WithLabelValues(t.Name, n.Name).Set(now)
+			c.consecutiveFailures[key] = 0
+		case skipped:
+			c.gauges[metricLastSkip].WithLabelValues(t.Name, n.Name).Set(now)
+			c.consecutiveFailures[key] = 0
+		default:
+			c.consecutiveFailures[key]++
+		}
+		c.gauges[metricConsecutiveFailures].WithLabelValues(t.Name, n.Name).Set(c.consecutiveFailures[key])
+	}
+}
+
+// getNodes returns the nodes of the target, with the nodes which were only discovered during the run, like cluster members
+func (c *MetricsController) getNodes(t models.BackupTarget, r models.TargetReport) []models.BackupNode {
+	nodes := append([]models.BackupNode{}, t.Nodes...)
+	for _, nr := range r.Nodes {
+		found := false
+		for _, n := range nodes {
+			if n.Name == nr.Node {
+				found = true
+				break
+			}
+		}
+		if !found {
+			nodes = append(nodes, models.BackupNode{Name: nr.Node})
+		}
+	}
+	return nodes
+}
+
+// Serve exposes the metrics on /metrics in the background, and stops serving them on the address they were served on before.
+// An empty address only stops serving the metrics.
+func (c *MetricsController) Serve(address string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.server != nil {
+		log.Println("Stopped serving metrics on", c.server.Addr+"/metrics")
+		c.server.Close()
+		c.server = nil
+	}
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: address, Handler: mux}
+	c.server = server
+
+	go func() {
+		log.Println("Serving metrics on", address+"/metrics")
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("Could not serve metrics:", err)
+		}
+	}()
+}
+
+// LoadTextfile restores the metrics written by a previous run, so one-shot runs can keep track of the last success and consecutive failures
+func (c *MetricsController) LoadTextfile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(f)
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for name, family := range families {
+		gauge, ok := c.gauges[name]
+		if !ok {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			value := m.GetGauge().GetValue()
+			gauge.WithLabelValues(labels["target"], labels["node"]).Set(value)
+			if name == metricConsecutiveFailures {
+				c.consecutiveFailures[[2]string{labels["target"], labels["node"]}] = value
+			}
+		}
+	}
+	return nil
+}
+
+// WriteTextfile atomically writes the metrics for the node_exporter textfile collector
+func (c *MetricsController) WriteTextfile(filename string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return prometheus.WriteToTextfile(filename, c.registry)
+}
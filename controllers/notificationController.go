@@ -0,0 +1,265 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/notification"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notificationStateFilename is the name of the notification state in OutputBasePath
+const notificationStateFilename = "notifications.json"
+
+// notificationTimeout limits how long a notification may take to send
+const notificationTimeout = 30 * time.Second
+
+// notificationMutex serializes the runs which update the notification state at the same time
+var notificationMutex sync.Mutex
+
+// notificationState is the last status of every target, by the name of the target
+type notificationState map[string]notificationTargetState
+
+type notificationTargetState struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// getNotificationStatePath returns the path of the notification state, which is kept in OutputBasePath unless StatePath is set.
+// It returns an empty string when neither is set, recoveries are not detected then.
+func getNotificationStatePath(s models.BackupSettings) string {
+	if s.Notifications.StatePath != "" {
+		return s.Notifications.StatePath
+	}
+	if s.OutputBasePath == "" {
+		return ""
+	}
+	return filepath.Join(s.OutputBasePath, notificationStateFilename)
+}
+
+type NotificationController struct{}
+
+type NotificationControllerCaller interface {
+	Notify(targets []models.BackupTarget, s models.BackupSettings, report models.RunReport)
+	Test(s models.BackupConfiguration, channel string) error
+
+	newMessage(targets []models.BackupTarget, report models.RunReport, state notificationState) notification.Message
+	route(c models.NotificationChannel, m notification.Message) (notification.Message, bool)
+	send(c models.NotificationChannel, s models.BackupSettings, m notification.Message) error
+	readState(s models.BackupSettings) (notificationState, error)
+	writeState(s models.BackupSettings, state notificationState) error
+}
+
+// Notify sends the outcome of a run to the channels which are notified of its targets, and records the status of the targets to detect recoveries.
+// Notifications are sent after the run is done, so errors are printed and do not fail the run.
+func (c *NotificationController) Notify(targets []models.BackupTarget, s models.BackupSettings, report models.RunReport) {
+	if len(s.Notifications.Channels) == 0 {
+		return
+	}
+
+	notificationMutex.Lock()
+	defer notificationMutex.Unlock()
+
+	state, err := c.readState(s)
+	if err != nil {
+		fmt.Println("Could not read the notification state, recoveries are not detected:", err)
+	}
+
+	m := c.newMessage(targets, report, state)
+	for _, channel := range s.Notifications.Channels {
+		routed, ok := c.route(channel, m)
+		if !ok || !notification.ShouldSend(channel, routed) {
+			continue
+		}
+
+		err = c.send(channel, s, routed)
+		if err != nil {
+			fmt.Println("Could not send notification to", channel.Name, ":", err)
+			continue
+		}
+		fmt.Println("Sent", routed.Event, "notification to", channel.Name)
+	}
+
+	// A skipped target keeps the status of its last backup, so it recovers once it is backed up again
+	for _, t := range report.Targets {
+		if t.Status == models.ReportStatusSkipped {
+			continue
+		}
+		state[t.Target] = notificationTargetState{Status: t.Status, Time: report.End}
+	}
+	err = c.writeState(s, state)
+	if err != nil {
+		fmt.Println("Could not write the notification state:", err)
+	}
+}
+
+// Test sends a test message with every target to a channel, or to all channels when channel is empty, regardless of their events and tags
+func (c *NotificationController) Test(s models.BackupConfiguration, channel string) error {
+	now := time.Now()
+	report := models.RunReport{Start: now, End: now}
+	for _, t := range s.Targets {
+		report.Targets = append(report.Targets, models.TargetReport{Target: t.Name, Type: t.Type, Status: models.ReportStatusSuccess})
+	}
+	m := c.newMessage(s.Targets, report, nil)
+	m.Event = notification.EventTest
+
+	found := false
+	var failed []string
+	for _, ch := range s.Settings.Notifications.Channels {
+		if channel != "" && ch.Name != channel {
+			continue
+		}
+		found = true
+
+		err := c.send(ch, s.Settings, m)
+		if err != nil {
+			fmt.Println("Could not send test notification to", ch.Name, ":", err)
+			failed = append(failed, ch.Name)
+			continue
+		}
+		fmt.Println("Sent test notification to", ch.Name)
+	}
+
+	switch {
+	case !found && channel != "":
+		return fmt.Errorf("notification channel %s is not defined", channel)
+	case !found:
+		return fmt.Errorf("no notification channels are defined")
+	case len(failed) > 0:
+		return fmt.Errorf("could not send test notification to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// newMessage describes the outcome of every target of a run, with their tags and the status of their previous run
+func (c *NotificationController) newMessage(targets []models.BackupTarget, report models.RunReport, state notificationState) notification.Message {
+	output := notification.Message{
+		Start: report.Start,
+		End:   report.End,
+	}
+	output.Host, _ = os.Hostname()
+
+	tags := make(map[string][]string)
+	for _, t := range targets {
+		tags[t.Name] = t.Tags
+	}
+
+	for _, r := range report.Targets {
+		t := notification.Target{
+			TargetReport:   r,
+			Tags:           tags[r.Target],
+			PreviousStatus: state[r.Target].Status,
+		}
+		// A skipped target was not backed up, so it has not recovered yet
+		t.Recovered = r.Status == models.ReportStatusSuccess && (t.PreviousStatus == models.ReportStatusFailed || t.PreviousStatus == models.ReportStatusPartial)
+		output.Targets = append(output.Targets, t)
+	}
+	output.SetEvent()
+	return output
+}
+
+// route returns the message with the targets which are routed to a channel, and reports whether any target is routed to it.
+// Targets are routed to a channel when they have any of its tags, or when the channel has no tags.
+func (c *NotificationController) route(channel models.NotificationChannel, m notification.Message) (notification.Message, bool) {
+	if len(channel.Tags) == 0 {
+		return m, len(m.Targets) > 0
+	}
+
+	output := m
+	output.Targets = nil
+	for _, t := range m.Targets {
+		for _, tag := range channel.Tags {
+			if hasTag(t.Tags, tag) {
+				output.Targets = append(output.Targets, t)
+				break
+			}
+		}
+	}
+	if m.Event != notification.EventTest {
+		output.SetEvent()
+	}
+	return output, len(output.Targets) > 0
+}
+
+// send sends a message to a channel within notificationTimeout
+func (c *NotificationController) send(channel models.NotificationChannel, s models.BackupSettings, m notification.Message) error {
+	n, err := notification.New(channel, notification.Options{KeystorePath: s.KeystorePath})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+	return n.Send(ctx, m)
+}
+
+// readState returns the last status of every target. The state is empty when it does not exist yet.
+func (c *NotificationController) readState(s models.BackupSettings) (notificationState, error) {
+	output := make(notificationState)
+
+	filename := getNotificationStatePath(s)
+	if filename == "" {
+		return output, nil
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return output, nil
+	}
+	if err != nil {
+		return output, err
+	}
+
+	err = json.Unmarshal(content, &output)
+	if err != nil {
+		return make(notificationState), fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+	return output, nil
+}
+
+// writeState atomically replaces the notification state
+func (c *NotificationController) writeState(s models.BackupSettings, state notificationState) error {
+	filename := getNotificationStatePath(s)
+	if filename == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(content, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// hasTag reports whether tags holds a tag, ignoring case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
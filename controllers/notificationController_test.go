@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"encoding/json"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/notification"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotificationRoutesByTag(t *testing.T) {
+	c := NotificationController{}
+	targets := []models.BackupTarget{
+		{Name: "prod1", Tags: []string{"prod", "dc1"}},
+		{Name: "lab1", Tags: []string{"lab"}},
+		{Name: "untagged"},
+	}
+	report := models.RunReport{Targets: []models.TargetReport{
+		{Target: "prod1", Status: models.ReportStatusSuccess},
+		{Target: "lab1", Status: models.ReportStatusFailed},
+		{Target: "untagged", Status: models.ReportStatusSuccess},
+	}}
+	m := c.newMessage(targets, report, nil)
+
+	tests := []struct {
+		name    string
+		tags    []string
+		targets []string
+		event   string
+	}{
+		{"no tags", nil, []string{"prod1", "lab1", "untagged"}, notification.EventFailure},
+		{"tag ignores case", []string{"PROD"}, []string{"prod1"}, notification.EventSuccess},
+		{"any tag", []string{"dc1", "lab"}, []string{"prod1", "lab1"}, notification.EventFailure},
+		{"no matching targets", []string{"dmz"}, nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			routed, ok := c.route(models.NotificationChannel{Name: "channel", Tags: tt.tags}, m)
+			if ok != (len(tt.targets) > 0) {
+				t.Fatalf("route reports %v, want %v", ok, len(tt.targets) > 0)
+			}
+			if !ok {
+				return
+			}
+			var names []string
+			for _, target := range routed.Targets {
+				names = append(names, target.Target)
+			}
+			if len(names) != len(tt.targets) {
+				t.Fatalf("routed %v, want %v", names, tt.targets)
+			}
+			for i := range names {
+				if names[i] != tt.targets[i] {
+					t.Errorf("routed %v, want %v", names, tt.targets)
+				}
+			}
+			// The event is that of the routed targets, a failure of a lab target is not a failure for prod
+			if routed.Event != tt.event {
+				t.Errorf("event is %s, want %s", routed.Event, tt.event)
+			}
+		})
+	}
+}
+
+func TestNotificationRecovery(t *testing.T) {
+	tests := []struct {
+		previous  string
+		status    string
+		recovered bool
+	}{
+		{models.ReportStatusFailed, models.ReportStatusSuccess, true},
+		{models.ReportStatusPartial, models.ReportStatusSuccess, true},
+		{models.ReportStatusFailed, models.ReportStatusSkipped, false},
+		{models.ReportStatusFailed, models.ReportStatusFailed, false},
+		{models.ReportStatusSuccess, models.ReportStatusSuccess, false},
+		{"", models.ReportStatusSuccess, false},
+	}
+
+	c := NotificationController{}
+	for _, tt := range tests {
+		t.Run(tt.previous+" to "+tt.status, func(t *testing.T) {
+			state := notificationState{"adc1": {Status: tt.previous}}
+			report := models.RunReport{Targets: []models.TargetReport{{Target: "adc1", Status: tt.status}}}
+			m := c.newMessage(nil, report, state)
+			if m.Targets[0].Recovered != tt.recovered {
+				t.Errorf("recovered is %v, want %v", m.Targets[0].Recovered, tt.recovered)
+			}
+		})
+	}
+}
+
+func TestNotifySendsFailureAndRecovery(t *testing.T) {
+	var mux sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var m notification.Message
+		json.Unmarshal(body, &m)
+		mux.Lock()
+		events = append(events, m.Event)
+		mux.Unlock()
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	targets := []models.BackupTarget{{Name: "adc1"}}
+	s := models.BackupSettings{
+		OutputBasePath: dir,
+		Notifications: models.NotificationSettings{
+			Channels: []models.NotificationChannel{{Name: "hook", Type: notification.TypeWebhook, Url: server.URL}},
+		},
+	}
+
+	c := NotificationController{}
+	for _, status := range []string{
+		models.ReportStatusSuccess,
+		models.ReportStatusFailed,
+		// A skipped target keeps its failed state, so the next backup is the recovery
+		models.ReportStatusSkipped,
+		models.ReportStatusSuccess,
+		models.ReportStatusSuccess,
+	} {
+		report := models.RunReport{Start: time.Now(), End: time.Now(), Targets: []models.TargetReport{{Target: "adc1", Status: status}}}
+		c.Notify(targets, s, report)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(events) != 2 || events[0] != notification.EventFailure || events[1] != notification.EventRecovery {
+		t.Errorf("sent %v, want [failure recovery]", events)
+	}
+
+	state, err := c.readState(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["adc1"].Status != models.ReportStatusSuccess {
+		t.Errorf("state of adc1 is %q, want success", state["adc1"].Status)
+	}
+	if _, err = ioutil.ReadFile(filepath.Join(dir, notificationStateFilename)); err != nil {
+		t.Errorf("state is not kept in OutputBasePath: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type ReportController struct{}
+
+type ReportControllerCaller interface {
+	Write(r models.RunReport, filename string, format string) error
+	Encode(r models.RunReport, format string, w io.Writer) error
+	WriteSummary(r models.RunReport, w io.Writer) error
+	marshal(r models.RunReport, format string) ([]byte, error)
+	summaryValue(value string) string
+}
+
+// Write writes the run report to filename, or to stdout when filename is "-"
+func (c *ReportController) Write(r models.RunReport, filename string, format string) error {
+	if filename == "-" {
+		return c.Encode(r, format, os.Stdout)
+	}
+
+	output, err := c.marshal(r, format)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, output, 0644)
+}
+
+// Encode writes the report to w as json or yaml
+func (c *ReportController) Encode(r models.RunReport, format string, w io.Writer) error {
+	output, err := c.marshal(r, format)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
+
+func (c *ReportController) marshal(r models.RunReport, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		output, err := json.MarshalIndent(r, "", "  ")
+		return append(output, '\n'), err
+	case "yaml":
+		return yaml.Marshal(r)
+	default:
+		return nil, fmt.Errorf("unknown report format %s", format)
+	}
+}
+
+// WriteSummary writes a table with the outcome of every target of the run to w
+func (c *ReportController) WriteSummary(r models.RunReport, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTATUS\tSTAGE\tPRIMARY\tNODES\tRETRIES\tDURATION\tDETAIL")
+	for _, t := range r.Targets {
+		nodes := "-"
+		if len(t.Nodes) > 0 {
+			succeeded := 0
+			for _, n := range t.Nodes {
+				if n.Status == models.ReportStatusSuccess || n.Status == models.ReportStatusSkipped {
+					succeeded++
+				}
+			}
+			nodes = fmt.Sprintf("%d/%d", succeeded, len(t.Nodes))
+		}
+
+		detail := t.Error
+		if t.Status == models.ReportStatusSkipped {
+			detail = t.SkipReason
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			t.Target,
+			t.Status,
+			c.summaryValue(t.Stage),
+			c.summaryValue(t.PrimaryNode),
+			nodes,
+			t.Retries,
+			time.Duration(t.DurationSeconds*float64(time.Second)).Round(time.Millisecond),
+			c.summaryValue(detail))
+	}
+	fmt.Fprintf(tw, "\n%d of %d targets failed", r.FailedTargets(), len(r.Targets))
+	if skipped := r.SkippedTargets(); skipped > 0 {
+		fmt.Fprintf(tw, ", %d skipped as unchanged", skipped)
+	}
+	fmt.Fprintln(tw)
+	return tw.Flush()
+}
+
+func (c *ReportController) summaryValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/citrix/adc-nitro-go/service"
+	"github.com/jantytgat/citrixadc-backup/data"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// systemBackupLocation is the directory on the ADC from which system backups are restored
+const systemBackupLocation = "/var/ns_sys_backup"
+
+type RestoreController struct{}
+
+type RestoreControllerCaller interface {
+	Run(ctx context.Context, t models.BackupTarget, s models.BackupSettings, nodeName string, destinationName string, filename string, stageOnly bool) error
+
+	getNode(t models.BackupTarget, nodeName string) (models.BackupNode, error)
+	readArchive(ctx context.Context, t models.BackupTarget, s models.BackupSettings, destinationName string, filename string) (io.ReadCloser, int64, error)
+	getSystemBackupName(filename string) string
+	uploadSystemBackup(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, name string, r io.Reader, size int64) error
+	restoreSystemBackup(ctx context.Context, nitroClient *service.NitroClient, name string) error
+}
+
+// Run uploads an archive to systemBackupLocation on a node, and restores it unless stageOnly is set.
+// The archive is read from a destination of the target when destinationName is set, otherwise filename is a local path.
+func (c *RestoreController) Run(ctx context.Context, t models.BackupTarget, s models.BackupSettings, nodeName string, destinationName string, filename string, stageOnly bool) error {
+	if encryption.IsEncrypted(filename) {
+		return fmt.Errorf("%s is encrypted, decrypt it first with the decrypt command", filename)
+	}
+
+	n, err := c.getNode(t, nodeName)
+	if err != nil {
+		return err
+	}
+
+	r, size, err := c.readArchive(ctx, t, s, destinationName, filename)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	nitroClient, err := createNitroClientsForNodes(t, s)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, getTimeouts(t, s).Target)
+	defer cancel()
+
+	name := c.getSystemBackupName(filename)
+	fmt.Println("Uploading", filename, "to", n.Name, "as", name)
+	err = c.uploadSystemBackup(ctx, t, n, s, name, r, size)
+	if err != nil {
+		return err
+	}
+
+	if stageOnly {
+		fmt.Println("Backup", name, "is staged on", n.Name, "in", systemBackupLocation)
+		return nil
+	}
+
+	fmt.Println("Restoring", name, "on", n.Name)
+	err = c.restoreSystemBackup(ctx, nitroClient[n.Name], name)
+	if err == nil {
+		fmt.Println("Restore of", name, "started on", n.Name, "- a reboot is needed to complete the restore")
+	}
+	return err
+}
+
+func (c *RestoreController) getNode(t models.BackupTarget, nodeName string) (models.BackupNode, error) {
+	for _, n := range t.Nodes {
+		if n.Name == nodeName {
+			return n, nil
+		}
+	}
+	return models.BackupNode{}, fmt.Errorf("node %s is not defined for target %s", nodeName, t.Name)
+}
+
+// readArchive opens an archive, with its size when it is known or -1 otherwise
+func (c *RestoreController) readArchive(ctx context.Context, t models.BackupTarget, s models.BackupSettings, destinationName string, filename string) (io.ReadCloser, int64, error) {
+	if destinationName == "" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+
+	d, err := getDestination(t, s, destinationName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	name := storage.Join(getTargetDirectory(t.Name, s), filename)
+	fmt.Println("Reading", d.Storage.Location(name))
+	r, err := d.Storage.Get(ctx, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, -1, nil
+}
+
+// getSystemBackupName returns the name of the archive on the ADC.
+// The command policy only allows timestamped names, so the timestamp of the local archive is reused when it has one.
+func (c *RestoreController) getSystemBackupName(filename string) string {
+	base := filepath.Base(filename)
+	if len(base) >= len(timestampLayout) {
+		if _, err := time.Parse(timestampLayout, base[:len(timestampLayout)]); err == nil {
+			return base[:len(timestampLayout)] + ".tgz"
+		}
+	}
+
+	b := BackupController{}
+	return b.getTimestamp() + ".tgz"
+}
+
+// uploadSystemBackup streams an archive to systemBackupLocation on a node.
+// NITRO expects the archive base64 encoded in a JSON request, which is encoded as it is sent, so memory use does not depend on the size of the archive.
+// The length of the request is sent when the size of the archive is known, otherwise the request is chunked.
+func (c *RestoreController) uploadSystemBackup(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, name string, r io.Reader, size int64) error {
+	prefix, suffix, err := c.getSystemFileCreateEnvelope(name)
+	if err != nil {
+		return err
+	}
+
+	request, err := newNitroRequest(ctx, t, n, s, "/nitro/v1/config/systemfile")
+	if err != nil {
+		return err
+	}
+
+	// The request is written by a goroutine, which is done before the archive is closed
+	body, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		encoder := base64.NewEncoder(base64.StdEncoding, writer)
+		_, err := io.WriteString(writer, prefix)
+		if err == nil {
+			_, err = io.Copy(encoder, r)
+		}
+		if err == nil {
+			err = encoder.Close()
+		}
+		if err == nil {
+			_, err = io.WriteString(writer, suffix)
+		}
+		writer.CloseWithError(err)
+	}()
+	defer func() {
+		body.Close()
+		<-done
+	}()
+
+	request.Method = http.MethodPost
+	request.Body = body
+	request.Header.Set("Content-Type", "application/json")
+	if size >= 0 {
+		request.ContentLength = int64(len(prefix)) + int64(base64.StdEncoding.EncodedLen(int(size))) + int64(len(suffix))
+	}
+
+	response, err := newNitroHttpClient(t, s).Do(request)
+	if err != nil {
+		return fmt.Errorf("could not upload system backup %s: %v", name, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK {
+		content, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return fmt.Errorf("could not upload system backup %s: %s %s", name, response.Status, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// getSystemFileCreateEnvelope returns the JSON of a systemfile create request which precedes and follows its filecontent
+func (c *RestoreController) getSystemFileCreateEnvelope(name string) (string, string, error) {
+	request := data.GetSystemFileCreateData(name, systemBackupLocation, "")
+	content, err := json.Marshal(map[string]interface{}{"systemfile": request})
+	if err != nil {
+		return "", "", err
+	}
+
+	// filecontent is omitted while it is empty, so it is added as the last field of the systemfile
+	envelope := strings.TrimSuffix(string(content), "}}")
+	if envelope == string(content) {
+		return "", "", fmt.Errorf("unexpected systemfile request %s", content)
+	}
+	return envelope + `,"filecontent":"`, `"}}`, nil
+}
+
+func (c *RestoreController) restoreSystemBackup(ctx context.Context, nitroClient *service.NitroClient, name string) error {
+	request := data.GetSystemBackupRestoreData(name)
+	return runWithContext(ctx, func() error {
+		return nitroClient.ActOnResource(service.Systembackup.Type(), request, "restore")
+	})
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadSystemBackupStreamsArchive(t *testing.T) {
+	type upload struct {
+		contentLength int64
+		systemfile    map[string]string
+	}
+	uploads := make(chan upload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/nitro/v1/config/systemfile" || r.Header.Get("X-NITRO-USER") != "backup" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			Systemfile map[string]string `json:"systemfile"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if request.Systemfile["filename"] == "missing.tgz" {
+			w.WriteHeader(599)
+			io.WriteString(w, `{"errorcode": 3441, "message": "No such file or directory", "severity": "ERROR"}`)
+			return
+		}
+		uploads <- upload{contentLength: r.ContentLength, systemfile: request.Systemfile}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	target := models.BackupTarget{Name: "adc1", Username: "backup", Password: "s3cret", Nodes: []models.BackupNode{{Name: "node1", Address: server.URL}}}
+	archive := bytes.Repeat([]byte("archive\x00\xff"), 100000)
+
+	tests := []struct {
+		name    string
+		size    int64
+		reader  io.Reader
+		chunked bool
+	}{
+		{name: "known size", size: int64(len(archive)), reader: bytes.NewReader(archive)},
+		{name: "unknown size", size: -1, reader: struct{ io.Reader }{bytes.NewReader(archive)}, chunked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := RestoreController{}
+			err := c.uploadSystemBackup(context.Background(), target, target.Nodes[0], models.BackupSettings{}, "20260101_010000.tgz", tt.reader, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u := <-uploads
+			if tt.chunked != (u.contentLength == -1) {
+				t.Errorf("request has content length %d", u.contentLength)
+			}
+			if u.systemfile["filename"] != "20260101_010000.tgz" || u.systemfile["filelocation"] != systemBackupLocation || u.systemfile["fileencoding"] != "BASE64" {
+				t.Errorf("unexpected systemfile %s %s %s", u.systemfile["filename"], u.systemfile["filelocation"], u.systemfile["fileencoding"])
+			}
+			content, err := base64.StdEncoding.DecodeString(u.systemfile["filecontent"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, archive) {
+				t.Errorf("uploaded %d bytes which differ from the archive", len(content))
+			}
+		})
+	}
+
+	c := RestoreController{}
+	err := c.uploadSystemBackup(context.Background(), target, target.Nodes[0], models.BackupSettings{}, "missing.tgz", bytes.NewReader(archive), int64(len(archive)))
+	if err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+		t.Errorf("upload returned %v, want the NITRO error", err)
+	}
+}
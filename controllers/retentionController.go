@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+type RetentionController struct{}
+
+type RetentionControllerCaller interface {
+	Run(ctx context.Context, s models.BackupConfiguration, dryRun bool)
+	PruneTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings, dryRun bool) ([]string, error)
+
+	getRetentionSettings(t models.BackupTarget, s models.BackupSettings) models.RetentionSettings
+	listArchives(ctx context.Context, t models.BackupTarget, s models.BackupSettings, st storage.Storage) ([]backupArchive, error)
+	pruneDestination(ctx context.Context, t models.BackupTarget, s models.BackupSettings, d destination, r models.RetentionSettings, now time.Time, dryRun bool) ([]string, error)
+	collectStore(ctx context.Context, d destination) error
+	selectArchivesToPrune(archives []backupArchive, r models.RetentionSettings, now time.Time) []backupArchive
+}
+
+// backupArchive is a stored backup of a node, identified by the filename scheme of BackupController.generateFilename.
+// Names holds the archive, its manifest and the configurations exported with it, relative to the root of the destination.
+// Sizes holds the size of each of the Names.
+type backupArchive struct {
+	Names     []string
+	Sizes     []int64
+	Node      string
+	Timestamp time.Time
+}
+
+func (c *RetentionController) Run(ctx context.Context, s models.BackupConfiguration, dryRun bool) {
+	for _, t := range s.Targets {
+		_, err := c.PruneTarget(ctx, t, s.Settings, dryRun)
+		if err != nil {
+			fmt.Println("Error pruning target", t.Name, ":", err)
+		}
+	}
+}
+
+// PruneTarget deletes the archives of a target which are no longer covered by its retention settings.
+// The archives of each node are evaluated separately on every destination of the target.
+// It returns the locations which were (or, when dryRun is set, would be) deleted.
+func (c *RetentionController) PruneTarget(ctx context.Context, t models.BackupTarget, s models.BackupSettings, dryRun bool) ([]string, error) {
+	var output []string
+
+	r := c.getRetentionSettings(t, s)
+	if !r.IsEnabled() {
+		return output, nil
+	}
+
+	destinations, err := getDestinations(t, s)
+	if err != nil {
+		return output, err
+	}
+
+	var failed []string
+	now := time.Now()
+	for _, d := range destinations {
+		deleted, err := c.pruneDestination(ctx, t, s, d, r, now, dryRun)
+		output = append(output, deleted...)
+		if err == nil && !dryRun && len(deleted) > 0 {
+			err = c.collectStore(ctx, d)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("destination %s: %v", d.Name, err))
+		}
+	}
+
+	if !dryRun {
+		cat := CatalogController{}
+		cat.Forget(t, s, output)
+	}
+
+	if len(failed) > 0 {
+		err = errors.New(strings.Join(failed, "; "))
+	}
+	return output, err
+}
+
+func (c *RetentionController) pruneDestination(ctx context.Context, t models.BackupTarget, s models.BackupSettings, d destination, r models.RetentionSettings, now time.Time, dryRun bool) ([]string, error) {
+	var output []string
+
+	archives, err := c.listArchives(ctx, t, s, d.Storage)
+	if err != nil {
+		return output, err
+	}
+
+	// The nodes are taken from the archives, as the members of a cluster are not always configured
+	var nodes []string
+	archivesPerNode := make(map[string][]backupArchive)
+	for _, a := range archives {
+		if _, found := archivesPerNode[a.Node]; !found {
+			nodes = append(nodes, a.Node)
+		}
+		archivesPerNode[a.Node] = append(archivesPerNode[a.Node], a)
+	}
+	sort.Strings(nodes)
+
+	for _, node := range nodes {
+		for _, a := range c.selectArchivesToPrune(archivesPerNode[node], r, now) {
+			for _, name := range a.Names {
+				location := d.Storage.Location(name)
+				if dryRun {
+					fmt.Println("Would delete", location)
+				} else {
+					fmt.Println("Deleting", location)
+					err = d.Storage.Delete(ctx, name)
+					if err != nil {
+						return output, err
+					}
+				}
+				output = append(output, location)
+			}
+		}
+	}
+	return output, nil
+}
+
+// collectStore deletes the files in the store of a destination which are no longer linked by any archive.
+// A file in the store is only deleted with the last archive which links to it.
+func (c *RetentionController) collectStore(ctx context.Context, d destination) error {
+	st, ok := d.Storage.(storage.Deduplicator)
+	if !ok {
+		return nil
+	}
+
+	count, size, err := st.Collect(ctx)
+	if err != nil {
+		return fmt.Errorf("could not clean up the store: %v", err)
+	}
+	if count > 0 {
+		fmt.Printf("Deleted %d files of %d bytes from the store of destination %s\n", count, size, d.Name)
+	}
+	return nil
+}
+
+func (c *RetentionController) getRetentionSettings(t models.BackupTarget, s models.BackupSettings) models.RetentionSettings {
+	if t.Retention != nil {
+		return *t.Retention
+	}
+	return s.Retention
+}
+
+func (c *RetentionController) listArchives(ctx context.Context, t models.BackupTarget, s models.BackupSettings, st storage.Storage) ([]backupArchive, error) {
+	var output []backupArchive
+
+	directory := getTargetDirectory(t.Name, s)
+	objects, err := st.List(ctx, directory)
+	if err != nil {
+		return output, err
+	}
+
+	// The archive of a node, its manifest and its exported configurations share their timestamp, and are kept or pruned together
+	index := make(map[string]int)
+	for _, o := range objects {
+		node, timestamp, ok := parseArchiveFilename(o.Name, t)
+		if !ok {
+			continue
+		}
+
+		key := node + "_" + timestamp.Format(timestampLayout)
+		i, found := index[key]
+		if !found {
+			i = len(output)
+			index[key] = i
+			output = append(output, backupArchive{
+				Node:      node,
+				Timestamp: timestamp,
+			})
+		}
+		output[i].Names = append(output[i].Names, storage.Join(directory, o.Name))
+		output[i].Sizes = append(output[i].Sizes, o.Size)
+	}
+	return output, nil
+}
+
+// selectArchivesToPrune applies the retention settings to the archives of a single node.
+// An archive is kept when it matches at least one of the keep rules, unless it is older than MaxAgeDays.
+// When only MaxAgeDays is configured, every archive younger than MaxAgeDays is kept.
+// The newest archive is always kept, so a node which is no longer backed up, because it is unchanged or unreachable, keeps its last backup.
+func (c *RetentionController) selectArchivesToPrune(archives []backupArchive, r models.RetentionSettings, now time.Time) []backupArchive {
+	var output []backupArchive
+
+	sorted := make([]backupArchive, len(archives))
+	copy(sorted, archives)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.After(sorted[j].Timestamp)
+	})
+
+	keep := make(map[int]bool)
+	for i := 0; i < len(sorted) && i < r.KeepLast; i++ {
+		keep[i] = true
+	}
+	keepPerPeriod(sorted, r.KeepDaily, keep, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPerPeriod(sorted, r.KeepWeekly, keep, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	keepPerPeriod(sorted, r.KeepMonthly, keep, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	keepPerPeriod(sorted, r.KeepYearly, keep, func(t time.Time) string {
+		return t.Format("2006")
+	})
+
+	for i, a := range sorted {
+		if i == 0 {
+			continue
+		}
+		expired := r.MaxAgeDays > 0 && a.Timestamp.Before(now.AddDate(0, 0, -r.MaxAgeDays))
+		if expired || (r.HasKeepRules() && !keep[i]) {
+			output = append(output, a)
+		}
+	}
+	return output
+}
+
+// keepPerPeriod marks the newest archive of each of the last count periods.
+// Archives must be sorted newest first.
+func keepPerPeriod(archives []backupArchive, count int, keep map[int]bool, period func(t time.Time) string) {
+	var lastPeriod string
+	for i, a := range archives {
+		if count <= 0 {
+			return
+		}
+		p := period(a.Timestamp)
+		if p != lastPeriod {
+			keep[i] = true
+			lastPeriod = p
+			count--
+		}
+	}
+}
+
+// parseArchiveFilename parses a filename generated by BackupController.generateFilename or BackupController.generateConfigFilename for target t.
+// Both target and node names may contain underscores, so only nodes which are configured for the target are matched.
+// Clusters also store the archives of members which are discovered as node<id>, so any node without underscores is matched for a cluster.
+// Encrypted archives and the manifests of archives are matched as well.
+func parseArchiveFilename(filename string, t models.BackupTarget) (string, time.Time, bool) {
+	var timestamp time.Time
+
+	filename, _ = isManifestFilename(filename)
+	filename = encryption.TrimExtension(filename)
+	if name, ok := isConfigFilename(filename); ok {
+		filename = name + ".tgz"
+	}
+	if !strings.HasSuffix(filename, ".tgz") || len(filename) <= len(timestampLayout)+1 {
+		return "", timestamp, false
+	}
+
+	timestamp, err := time.ParseInLocation(timestampLayout, filename[:len(timestampLayout)], time.Local)
+	if err != nil {
+		return "", timestamp, false
+	}
+
+	remainder := filename[len(timestampLayout):]
+	prefix := "_" + t.Name + "_"
+	if !strings.HasPrefix(remainder, prefix) {
+		return "", timestamp, false
+	}
+
+	node := strings.TrimSuffix(strings.TrimPrefix(remainder, prefix), ".tgz")
+	for _, n := range t.Nodes {
+		if n.Name == node {
+			return node, timestamp, true
+		}
+	}
+	if isCluster(t) && node != "" && !strings.Contains(node, "_") {
+		return node, timestamp, true
+	}
+	return "", timestamp, false
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArchiveFilename(t *testing.T) {
+	standalone := models.BackupTarget{Name: "prod", Type: models.TargetTypeStandalone, Nodes: []models.BackupNode{{Name: "adc_1"}}}
+	cluster := models.BackupTarget{Name: "prod", Type: models.TargetTypeCluster, ClusterAddress: "https://10.0.0.10"}
+
+	tests := []struct {
+		name     string
+		filename string
+		target   models.BackupTarget
+		node     string
+		ok       bool
+	}{
+		{"configured node", "20260101_010000_prod_adc_1.tgz", standalone, "adc_1", true},
+		{"manifest of configured node", "20260101_010000_prod_adc_1.tgz.manifest.json", standalone, "adc_1", true},
+		{"unknown node", "20260101_010000_prod_adc_2.tgz", standalone, "", false},
+		{"discovered cluster member", "20260101_010000_prod_node1.tgz", cluster, "node1", true},
+		{"manifest of discovered cluster member", "20260101_010000_prod_node2.tgz.manifest.json", cluster, "node2", true},
+		{"other target with the same prefix", "20260101_010000_prod_eu_node1.tgz", cluster, "", false},
+		{"no node", "20260101_010000_prod_.tgz", cluster, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, _, ok := parseArchiveFilename(tt.filename, tt.target)
+			if ok != tt.ok || node != tt.node {
+				t.Errorf("parseArchiveFilename(%s) is %q, %v, want %q, %v", tt.filename, node, ok, tt.node, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPruneClusterWithoutNodes(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"20260101_010000_prod_node1.tgz",
+		"20260101_010000_prod_node1.tgz.manifest.json",
+		"20260102_010000_prod_node1.tgz",
+		"20260102_010000_prod_node1.tgz.manifest.json",
+		// node2 was not UP during the last backup
+		"20260101_010000_prod_node2.tgz",
+		"20260102_010000_prod_node2.tgz",
+		"20260101_010000_prod_eu_node1.tgz",
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := models.BackupTarget{Name: "prod", Type: models.TargetTypeCluster, ClusterAddress: "https://10.0.0.10"}
+	d := destination{Name: "local", Storage: storage.NewLocal(dir, storage.Options{})}
+	c := RetentionController{}
+
+	archives, err := c.listArchives(context.Background(), target, models.BackupSettings{}, d.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 4 {
+		t.Fatalf("listed %d archives, want 4", len(archives))
+	}
+
+	now := time.Date(2026, 1, 3, 0, 0, 0, 0, time.Local)
+	deleted, err := c.pruneDestination(context.Background(), target, models.BackupSettings{}, d, models.RetentionSettings{KeepLast: 1}, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, location := range deleted {
+		names = append(names, filepath.Base(location))
+	}
+	sort.Strings(names)
+	want := []string{
+		"20260101_010000_prod_node1.tgz",
+		"20260101_010000_prod_node1.tgz.manifest.json",
+		"20260101_010000_prod_node2.tgz",
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("deleted %v, want %v", names, want)
+	}
+}
+
+func TestSelectArchivesToPruneKeepsNewestArchive(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.Local)
+	var archives []backupArchive
+	for day := 1; day <= 5; day++ {
+		archives = append(archives, backupArchive{
+			Names:     []string{"archive"},
+			Node:      "node1",
+			Timestamp: time.Date(2026, 1, day, 1, 0, 0, 0, time.Local),
+		})
+	}
+
+	tests := []struct {
+		name      string
+		retention models.RetentionSettings
+	}{
+		{"max age", models.RetentionSettings{MaxAgeDays: 30}},
+		{"max age with keep last", models.RetentionSettings{MaxAgeDays: 30, KeepLast: 3}},
+		{"max age with keep daily", models.RetentionSettings{MaxAgeDays: 30, KeepDaily: 7}},
+	}
+
+	c := RetentionController{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pruned := c.selectArchivesToPrune(archives, tt.retention, now)
+			if len(pruned) != len(archives)-1 {
+				t.Fatalf("pruned %d archives, want %d", len(pruned), len(archives)-1)
+			}
+			for _, a := range pruned {
+				if a.Timestamp.Equal(archives[len(archives)-1].Timestamp) {
+					t.Errorf("pruned the newest archive of %s", a.Timestamp)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Operation is an operation on the ADC which can be retried
+type Operation string
+
+const (
+	OperationCreate   Operation = "create"
+	OperationDownload Operation = "download"
+	OperationDelete   Operation = "delete"
+)
+
+// defaultRetryPolicy applies when no retry settings are configured
+var defaultRetryPolicy = models.RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    30 * time.Second,
+	RetryOn:     []string{models.RetryOnNetwork, models.RetryOnServer, models.RetryOnBusy},
+}
+
+var httpStatusRegex = regexp.MustCompile(`\b(5\d\d) [A-Z]`)
+
+// nitroErrorCodeConnectionLimit is returned by NITRO when all of its management connections are in use
+const nitroErrorCodeConnectionLimit = 446
+
+// defaultBusyErrorCodes are the NITRO error codes which report that the ADC is busy, in addition to the ErrorCodes of the policy
+var defaultBusyErrorCodes = []int{nitroErrorCodeConnectionLimit}
+
+// busyMessages are the messages with which NITRO reports that the ADC is busy with another operation
+var busyMessages = []string{
+	"resource busy",
+	"operation in progress",
+	"is in progress",
+	"try again",
+	"temporarily unavailable",
+}
+
+// timeoutMessages are used to detect timeouts which the NITRO client returns as plain strings
+var timeoutMessages = []string{
+	"timeout",
+	"timed out",
+}
+
+// networkMessages are used to detect network errors which the NITRO client returns as plain strings
+var networkMessages = []string{
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"i/o timeout",
+	"unexpected eof",
+	"tls handshake timeout",
+	"no route to host",
+	"network is unreachable",
+	": eof",
+}
+
+var retryRandom = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// getRetryPolicy returns the retry policy for an operation on a target.
+// Policies are merged from the least to the most specific: defaults, settings, settings for the operation, target, target for the operation.
+func getRetryPolicy(t models.BackupTarget, s models.BackupSettings, operation Operation) models.RetryPolicy {
+	policy := defaultRetryPolicy.Merge(s.Retry.RetryPolicy).Merge(getOperationRetryPolicy(s.Retry, operation))
+	if t.Retry != nil {
+		policy = policy.Merge(t.Retry.RetryPolicy).Merge(getOperationRetryPolicy(*t.Retry, operation))
+	}
+	return policy
+}
+
+func getOperationRetryPolicy(r models.RetrySettings, operation Operation) models.RetryPolicy {
+	switch operation {
+	case OperationCreate:
+		return r.Create
+	case OperationDownload:
+		return r.Download
+	case OperationDelete:
+		return r.Delete
+	default:
+		return models.RetryPolicy{}
+	}
+}
+
+// retry runs fn until it succeeds, the error is not retryable or the maximum number of attempts is reached.
+// Each attempt is limited to timeout, and no attempts are made once ctx is done.
+// A create which timed out is never retried: NITRO cannot cancel it, so it may still complete and collide with a second create of the same backup.
+// It returns the number of retries, with the error of the last attempt.
+func retry(ctx context.Context, policy models.RetryPolicy, timeout time.Duration, operation Operation, target string, node string, fn func(ctx context.Context) error) (int, error) {
+	attempt := 1
+	for {
+		err := runWithTimeout(ctx, timeout, fn)
+		if err == nil || ctx.Err() != nil || attempt >= policy.MaxAttempts || !isRetryableError(err, policy) {
+			return attempt - 1, err
+		}
+		if operation == OperationCreate && isTimeoutError(err) {
+			fmt.Printf("Not retrying %s of %s on %s after attempt %d timed out, as it may still complete on the node: %v\n", operation, target, node, attempt, err)
+			return attempt - 1, err
+		}
+
+		delay := getRetryDelay(policy, attempt)
+		fmt.Printf("Retrying %s of %s on %s in %s after attempt %d of %d failed: %v\n", operation, target, node, delay, attempt, policy.MaxAttempts, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt - 1, err
+		}
+		attempt++
+	}
+}
+
+// getRetryDelay returns the delay before the next attempt, which doubles with each attempt up to MaxDelay.
+// Jitter spreads the delay randomly by the given fraction, so targets which failed together do not retry together.
+func getRetryDelay(policy models.RetryPolicy, attempt int) time.Duration {
+	delay := float64(policy.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if policy.MaxDelay > 0 && delay > float64(policy.MaxDelay) {
+		delay = float64(policy.MaxDelay)
+	}
+
+	if policy.Jitter > 0 {
+		retryRandom.Lock()
+		delay += delay * policy.Jitter * (2*retryRandom.Float64() - 1)
+		retryRandom.Unlock()
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay).Round(time.Millisecond)
+}
+
+// isRetryableError reports whether an error belongs to one of the classes the policy retries on.
+// Authentication errors are never retried, as retrying them could lock out the user.
+func isRetryableError(err error, policy models.RetryPolicy) bool {
+	if err == nil || isAuthenticationError(err) {
+		return false
+	}
+
+	for _, class := range policy.RetryOn {
+		switch strings.ToLower(class) {
+		case models.RetryOnNetwork:
+			if isNetworkError(err) {
+				return true
+			}
+		case models.RetryOnServer:
+			if isServerError(err) {
+				return true
+			}
+		case models.RetryOnBusy:
+			if isBusyError(err, policy.ErrorCodes) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTimeoutError reports whether an operation failed because it did not complete in time
+func isTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, m := range timeoutMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, m := range networkMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// isServerError reports whether the ADC answered with a 5xx status.
+// 599 is the status NITRO uses for all of its own errors, so it is classified by its error code instead.
+func isServerError(err error) bool {
+	match := httpStatusRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return false
+	}
+	status, _ := strconv.Atoi(match[1])
+	return status != 599
+}
+
+func isBusyError(err error, errorCodes []int) bool {
+	code := getNitroErrorCode(err)
+	for _, c := range append(defaultBusyErrorCodes, errorCodes...) {
+		if code != 0 && code == c {
+			return true
+		}
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, m := range busyMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"testing"
+	"time"
+)
+
+func TestRetryDoesNotRetryTimedOutCreate(t *testing.T) {
+	policy := models.RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		RetryOn:     []string{models.RetryOnNetwork, models.RetryOnServer, models.RetryOnBusy},
+	}
+
+	tests := []struct {
+		name      string
+		operation Operation
+		err       error
+		attempts  int
+	}{
+		{"create timed out", OperationCreate, fmt.Errorf("timed out after 10m0s: %w", context.DeadlineExceeded), 1},
+		{"create client timeout", OperationCreate, errors.New(`Post "https://adc/nitro/v1/config/systembackup": net/http: request canceled (Client.Timeout exceeded while awaiting headers)`), 1},
+		{"create connection refused", OperationCreate, errors.New("dial tcp 10.0.0.1:443: connect: connection refused"), 3},
+		{"download timed out", OperationDownload, fmt.Errorf("timed out after 1h0m0s: %w", context.DeadlineExceeded), 3},
+		{"delete timed out", OperationDelete, fmt.Errorf("timed out after 1m0s: %w", context.DeadlineExceeded), 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			retries, err := retry(context.Background(), policy, 0, tt.operation, "target", "node", func(ctx context.Context) error {
+				attempts++
+				return tt.err
+			})
+			if err == nil {
+				t.Fatal("retry succeeded, want the error of the last attempt")
+			}
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			if retries != tt.attempts-1 {
+				t.Errorf("%d retries, want %d", retries, tt.attempts-1)
+			}
+		})
+	}
+}
+
+func TestIsBusyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		errorCodes []int
+		busy       bool
+	}{
+		{"connection limit", errors.New(`[ERROR] nitro-go: Failed to apply action, err=599 Netscaler specific error {"errorcode": 446, "message": "Connection limit to CFE exceeded", "severity": "ERROR"}`), nil, true},
+		{"configured code", errors.New(`{"errorcode": 1234, "message": "Something", "severity": "ERROR"}`), []int{1234}, true},
+		{"busy message", errors.New("Operation in progress, try again later"), nil, true},
+		{"invalid argument", errors.New(`{"errorcode": 278, "message": "Invalid argument", "severity": "ERROR"}`), nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if busy := isBusyError(tt.err, tt.errorCodes); busy != tt.busy {
+				t.Errorf("isBusyError is %v, want %v", busy, tt.busy)
+			}
+		})
+	}
+}
@@ -1,55 +1,707 @@
 package controllers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"github.com/robfig/cron/v3"
 	"github.com/spf13/viper"
+	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
-type ScheduleController struct{}
+// ConfigurationLoader returns the configuration with its defaults and the overrides of the command line applied
+type ConfigurationLoader func() (models.BackupConfiguration, error)
+
+type ScheduleController struct {
+	mux             sync.Mutex
+	cron            *cron.Cron
+	entries         []cron.EntryID
+	running         map[string]bool
+	metrics         *MetricsController
+	metricsSettings models.MetricsSettings
+	targets         *targetScheduler
+	ctx             context.Context
+	load            ConfigurationLoader
+}
 
 type ScheduleControllerCaller interface {
-	Run()
+	RunDaemon(ctx context.Context, s models.BackupConfiguration, load ConfigurationLoader)
+	Install(s models.BackupConfiguration, configFile string, scheduleType string) error
+	Remove(configFile string, scheduleType string) error
+	Status(configFile string) error
+
+	scheduleTargets(s models.BackupConfiguration)
+	reloadConfiguration()
+	applyMetricsSettings(m models.MetricsSettings)
+	getScheduleForTarget(t models.BackupTarget, s models.BackupSettings) string
+	newBackupJob(t models.BackupTarget, s models.BackupSettings) func()
+	startRun(targetName string) bool
+	finishRun(targetName string)
 
-	addSchedule()
-	removeSchedule()
+	getScheduleJobs(s models.BackupConfiguration) []scheduleJob
+	getExecutable() (string, error)
 
-	addScheduleForWindows()
-	addScheduleForCron()
+	addSchedule(jobs []scheduleJob, configFile string, scheduleType string) error
+	removeSchedule(configFile string, scheduleType string) error
 
-	removeScheduleForWindows()
-	removeScheduleForCron()
+	addScheduleForWindows() error
+	addScheduleForCron(jobs []scheduleJob, configFile string) error
+	addScheduleForSystemd(jobs []scheduleJob, configFile string) error
+
+	removeScheduleForWindows() error
+	removeScheduleForCron(configFile string) error
+	removeScheduleForSystemd(configFile string) error
 }
 
-func (c *ScheduleController) Run(s models.BackupConfiguration, configFile string) {
-	fmt.Println("schedule called")
+// RunDaemon runs the scheduled backups in-process until ctx is done.
+// Running backups share ctx, so they are cancelled and cleaned up when it is done, and RunDaemon returns once they have stopped.
+// The configuration file is watched, and the schedules are rebuilt from the configuration returned by load when it changes.
+func (c *ScheduleController) RunDaemon(ctx context.Context, s models.BackupConfiguration, load ConfigurationLoader) {
+	c.ctx = ctx
+	c.load = load
+	c.cron = cron.New()
+	c.running = make(map[string]bool)
+	c.metrics = NewMetricsController()
+	c.targets = newTargetScheduler(s.Settings)
+	for _, w := range getSettingsWarnings(s.Settings) {
+		log.Println("Warning:", w)
+	}
+	c.scheduleTargets(s)
+
+	if s.Settings.Metrics.TextfilePath != "" {
+		err := c.metrics.LoadTextfile(s.Settings.Metrics.TextfilePath)
+		if err != nil {
+			log.Println("Could not load metrics from", s.Settings.Metrics.TextfilePath, ":", err)
+		}
+	}
+	if s.Settings.Metrics.ListenAddress != "" {
+		c.metrics.Serve(s.Settings.Metrics.ListenAddress)
+	}
+	c.metricsSettings = s.Settings.Metrics
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		log.Println("Configuration file", e.Name, "changed, reloading schedules")
+		c.reloadConfiguration()
+	})
+	viper.WatchConfig()
+
+	c.cron.Start()
+	log.Println("Scheduler started")
+
+	<-ctx.Done()
 
-	fmt.Println(os.Getwd())
-	fmt.Println(configFile)
-	fmt.Println(viper.AllKeys())
-	fmt.Println(s)
+	log.Println("Stopping scheduler, cancelling running backups")
+	<-c.cron.Stop().Done()
+	c.metrics.Serve("")
+	log.Println("Scheduler stopped")
 }
 
-func (c *ScheduleController) addSchedule() {
-	if runtime.GOOS == "windows" {
-		c.addScheduleForWindows()
+// scheduleTargets replaces all scheduled jobs with the schedules of the targets in s
+func (c *ScheduleController) scheduleTargets(s models.BackupConfiguration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for _, id := range c.entries {
+		c.cron.Remove(id)
+	}
+	c.entries = nil
+	c.targets.setLimits(s.Settings)
+
+	for _, t := range s.Targets {
+		spec := c.getScheduleForTarget(t, s.Settings)
+		if spec == "" {
+			log.Println("No schedule configured for target", t.Name)
+			continue
+		}
+
+		id, err := c.cron.AddFunc(spec, c.newBackupJob(t, s.Settings))
+		if err != nil {
+			log.Println("Invalid schedule", spec, "for target", t.Name, ":", err)
+			continue
+		}
+		c.entries = append(c.entries, id)
+		log.Println("Scheduled target", t.Name, "with schedule", spec)
+	}
+}
+
+// reloadConfiguration applies the configuration returned by load.
+// The opened keystores are forgotten, so secrets which changed in the keystore are read again by the next backups.
+func (c *ScheduleController) reloadConfiguration() {
+	s, err := c.load()
+	if err != nil {
+		log.Println("Could not reload configuration, keeping current schedules:", err)
+		return
+	}
+	for _, w := range getSettingsWarnings(s.Settings) {
+		log.Println("Warning:", w)
+	}
+	secrets.ClearKeystores()
+	c.applyMetricsSettings(s.Settings.Metrics)
+	c.scheduleTargets(s)
+}
+
+// applyMetricsSettings serves the metrics on a changed listen address, and writes them to a changed textfile right away.
+// The metrics are kept in memory, so a new textfile starts with the metrics of the backups which already ran.
+func (c *ScheduleController) applyMetricsSettings(m models.MetricsSettings) {
+	if m.ListenAddress != c.metricsSettings.ListenAddress {
+		c.metrics.Serve(m.ListenAddress)
+	}
+	if m.TextfilePath != "" && m.TextfilePath != c.metricsSettings.TextfilePath {
+		err := c.metrics.WriteTextfile(m.TextfilePath)
+		if err != nil {
+			log.Println("Could not write metrics to", m.TextfilePath, ":", err)
+		}
+	}
+	c.metricsSettings = m
+}
+
+// getScheduleForTarget returns the cron expression for a target.
+// A schedule on the target takes precedence over the global schedule, which takes precedence over the interval in hours.
+func (c *ScheduleController) getScheduleForTarget(t models.BackupTarget, s models.BackupSettings) string {
+	if t.Schedule != "" {
+		return t.Schedule
+	}
+	if s.Schedule != "" {
+		return s.Schedule
+	}
+	if s.Interval > 0 {
+		return fmt.Sprintf("@every %dh", s.Interval)
+	}
+	return ""
+}
+
+func (c *ScheduleController) newBackupJob(t models.BackupTarget, s models.BackupSettings) func() {
+	return func() {
+		if !c.startRun(t.Name) {
+			log.Println("Skipping scheduled backup of", t.Name, "as the previous run is still in progress")
+			return
+		}
+		defer c.finishRun(t.Name)
+
+		if !c.targets.acquire(c.ctx, t) {
+			log.Println("Skipping scheduled backup of", t.Name, "as the scheduler is stopping")
+			return
+		}
+		log.Println("Starting scheduled backup of", t.Name)
+		run := models.RunReport{Start: time.Now()}
+		b := BackupController{scheduler: c.targets}
+		report := b.RunTarget(c.ctx, t, s)
+		c.targets.release(t)
+		if report.Status == models.ReportStatusSuccess {
+			log.Println("Finished scheduled backup of", t.Name, "with", report.Retries, "retries")
+		} else if report.Status == models.ReportStatusSkipped {
+			log.Println("Skipped scheduled backup of", t.Name, "as its", report.SkipReason)
+		} else {
+			log.Println("Scheduled backup of", t.Name, "failed after", report.Retries, "retries:", report.Error)
+		}
+
+		c.metrics.Update(t, report)
+		if s.Metrics.TextfilePath != "" {
+			err := c.metrics.WriteTextfile(s.Metrics.TextfilePath)
+			if err != nil {
+				log.Println("Could not write metrics to", s.Metrics.TextfilePath, ":", err)
+			}
+		}
+
+		run.Targets = []models.TargetReport{report}
+		setRunStatus(&run)
+		n := NotificationController{}
+		n.Notify([]models.BackupTarget{t}, s, run)
+	}
+}
+
+// startRun marks a target as running, and reports false if it was already running
+func (c *ScheduleController) startRun(targetName string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.running[targetName] {
+		return false
+	}
+	c.running[targetName] = true
+	return true
+}
+
+func (c *ScheduleController) finishRun(targetName string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.running, targetName)
+}
+
+// Install adds system schedules which run the backups for configFile, replacing the schedules installed earlier for the same file
+func (c *ScheduleController) Install(s models.BackupConfiguration, configFile string, scheduleType string) error {
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+
+	jobs := c.getScheduleJobs(s)
+	if len(jobs) == 0 {
+		return errors.New("no schedules configured")
+	}
+	return c.addSchedule(jobs, configFile, scheduleType)
+}
+
+// Remove deletes the system schedules installed for configFile
+func (c *ScheduleController) Remove(configFile string, scheduleType string) error {
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+	return c.removeSchedule(configFile, scheduleType)
+}
+
+// Status prints the system schedules installed for configFile
+func (c *ScheduleController) Status(configFile string) error {
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Schedules for", configFile)
+
+	crontab, err := c.readCrontab()
+	if err != nil {
+		fmt.Println("crontab: unavailable:", err)
+	} else if block := c.getCrontabBlock(crontab, configFile); block != "" {
+		fmt.Println("crontab:")
+		fmt.Print(block)
 	} else {
-		c.addScheduleForCron()
+		fmt.Println("crontab: not installed")
+	}
+
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+
+	directory, systemctlArgs, err := c.getSystemdUnitDirectory()
+	if err != nil {
+		return err
+	}
+	units, err := filepath.Glob(filepath.Join(directory, c.getSystemdUnitName(configFile)+"*.timer"))
+	if err != nil {
+		return err
+	}
+	if len(units) == 0 {
+		fmt.Println("systemd: not installed")
+		return nil
+	}
+	fmt.Println("systemd:")
+	for _, u := range units {
+		name := filepath.Base(u)
+		content, err := ioutil.ReadFile(u)
+		if err != nil {
+			return err
+		}
+		state, _ := exec.Command("systemctl", append(systemctlArgs, "is-active", name)...).Output()
+		fmt.Printf("  %s (%s)\n", u, strings.TrimSpace(string(state)))
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "On") {
+				fmt.Println("   ", line)
+			}
+		}
 	}
+	return nil
 }
 
-func (c *ScheduleController) removeSchedule() {
+// scheduleJob is a system schedule which runs the backup for a set of targets, or all targets when Targets is empty
+type scheduleJob struct {
+	Schedule string
+	Targets  []string
+}
+
+// getScheduleJobs groups the targets per schedule
+func (c *ScheduleController) getScheduleJobs(s models.BackupConfiguration) []scheduleJob {
+	var output []scheduleJob
+	var scheduled int
+	index := make(map[string]int)
+
+	for _, t := range s.Targets {
+		spec := c.getScheduleForTarget(t, s.Settings)
+		if spec == "" {
+			fmt.Println("No schedule configured for target", t.Name)
+			continue
+		}
+		i, ok := index[spec]
+		if !ok {
+			i = len(output)
+			index[spec] = i
+			output = append(output, scheduleJob{Schedule: spec})
+		}
+		output[i].Targets = append(output[i].Targets, t.Name)
+		scheduled++
+	}
+
+	if len(output) == 1 && scheduled == len(s.Targets) {
+		output[0].Targets = nil
+	}
+	return output
+}
+
+func (c *ScheduleController) getExecutable() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(executable)
+}
+
+func (c *ScheduleController) addSchedule(jobs []scheduleJob, configFile string, scheduleType string) error {
 	if runtime.GOOS == "windows" {
-		c.addScheduleForWindows()
-	} else {
-		c.addScheduleForCron()
+		return c.addScheduleForWindows()
+	}
+
+	switch scheduleType {
+	case "cron":
+		return c.addScheduleForCron(jobs, configFile)
+	case "systemd":
+		return c.addScheduleForSystemd(jobs, configFile)
+	default:
+		return fmt.Errorf("unknown schedule type %s", scheduleType)
 	}
 }
 
-func (c *ScheduleController) addScheduleForWindows() {}
-func (c *ScheduleController) addScheduleForCron() {}
+func (c *ScheduleController) removeSchedule(configFile string, scheduleType string) error {
+	if runtime.GOOS == "windows" {
+		return c.removeScheduleForWindows()
+	}
+
+	switch scheduleType {
+	case "cron":
+		return c.removeScheduleForCron(configFile)
+	case "systemd":
+		return c.removeScheduleForSystemd(configFile)
+	default:
+		return fmt.Errorf("unknown schedule type %s", scheduleType)
+	}
+}
 
-func (c *ScheduleController) removeScheduleForWindows() {}
-func (c *ScheduleController) removeScheduleForCron() {}
\ No newline at end of file
+func (c *ScheduleController) addScheduleForWindows() error {
+	return errors.New("system schedules are not supported on windows, use schedule --daemon instead")
+}
+
+func (c *ScheduleController) removeScheduleForWindows() error {
+	return errors.New("system schedules are not supported on windows")
+}
+
+func (c *ScheduleController) addScheduleForCron(jobs []scheduleJob, configFile string) error {
+	executable, err := c.getExecutable()
+	if err != nil {
+		return err
+	}
+
+	crontab, err := c.readCrontab()
+	if err != nil {
+		return err
+	}
+
+	var block strings.Builder
+	block.WriteString(c.getCrontabMarker("BEGIN", configFile) + "\n")
+	for _, j := range jobs {
+		spec, err := getCrontabSpec(j.Schedule)
+		if err != nil {
+			return err
+		}
+		command := []string{cronQuote(executable), "backup", "--config", cronQuote(configFile)}
+		for _, t := range j.Targets {
+			command = append(command, "--target", cronQuote(t))
+		}
+		block.WriteString(spec + " " + strings.Join(command, " ") + "\n")
+	}
+	block.WriteString(c.getCrontabMarker("END", configFile) + "\n")
+
+	crontab = c.removeCrontabBlock(crontab, configFile) + block.String()
+	err = c.writeCrontab(crontab)
+	if err == nil {
+		fmt.Println("Installed crontab entries for", configFile)
+	}
+	return err
+}
+
+func (c *ScheduleController) removeScheduleForCron(configFile string) error {
+	crontab, err := c.readCrontab()
+	if err != nil {
+		return err
+	}
+	if c.getCrontabBlock(crontab, configFile) == "" {
+		fmt.Println("No crontab entries installed for", configFile)
+		return nil
+	}
+
+	err = c.writeCrontab(c.removeCrontabBlock(crontab, configFile))
+	if err == nil {
+		fmt.Println("Removed crontab entries for", configFile)
+	}
+	return err
+}
+
+func (c *ScheduleController) getCrontabMarker(marker string, configFile string) string {
+	return "# " + marker + " citrixadc-backup " + configFile
+}
+
+func (c *ScheduleController) readCrontab() (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("crontab", "-l")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// crontab exits with an error when the user has no crontab yet
+		if strings.Contains(strings.ToLower(stderr.String()), "no crontab") {
+			return "", nil
+		}
+		return "", fmt.Errorf("could not read crontab: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+func (c *ScheduleController) writeCrontab(crontab string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("crontab", "-")
+	cmd.Stdin = strings.NewReader(crontab)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("could not write crontab: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// getCrontabBlock returns the managed block for configFile, including its markers
+func (c *ScheduleController) getCrontabBlock(crontab string, configFile string) string {
+	var block strings.Builder
+	var inBlock bool
+	for _, line := range strings.SplitAfter(crontab, "\n") {
+		if strings.TrimSpace(line) == c.getCrontabMarker("BEGIN", configFile) {
+			inBlock = true
+		}
+		if inBlock {
+			block.WriteString(line)
+		}
+		if strings.TrimSpace(line) == c.getCrontabMarker("END", configFile) {
+			inBlock = false
+		}
+	}
+	return block.String()
+}
+
+// removeCrontabBlock returns the crontab without the managed block for configFile
+func (c *ScheduleController) removeCrontabBlock(crontab string, configFile string) string {
+	var output strings.Builder
+	var inBlock bool
+	for _, line := range strings.SplitAfter(crontab, "\n") {
+		if strings.TrimSpace(line) == c.getCrontabMarker("BEGIN", configFile) {
+			inBlock = true
+		}
+		if !inBlock && line != "" {
+			output.WriteString(line)
+			if !strings.HasSuffix(line, "\n") {
+				output.WriteString("\n")
+			}
+		}
+		if strings.TrimSpace(line) == c.getCrontabMarker("END", configFile) {
+			inBlock = false
+		}
+	}
+	return output.String()
+}
+
+// getSystemdUnitDirectory returns the directory for the unit files and the arguments for systemctl.
+// System units are used when running as root, user units otherwise.
+func (c *ScheduleController) getSystemdUnitDirectory() (string, []string, error) {
+	if runtime.GOOS != "linux" {
+		return "", nil, errors.New("systemd timers are only supported on linux")
+	}
+	if os.Geteuid() == 0 {
+		return "/etc/systemd/system", nil, nil
+	}
+
+	configDirectory, err := os.UserConfigDir()
+	if err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(configDirectory, "systemd", "user"), []string{"--user"}, nil
+}
+
+// getSystemdUnitName returns the unit name for configFile, so schedules for different configuration files do not collide
+func (c *ScheduleController) getSystemdUnitName(configFile string) string {
+	hash := sha256.Sum256([]byte(configFile))
+	return fmt.Sprintf("citrixadc-backup-%x", hash[:4])
+}
+
+func (c *ScheduleController) addScheduleForSystemd(jobs []scheduleJob, configFile string) error {
+	executable, err := c.getExecutable()
+	if err != nil {
+		return err
+	}
+
+	directory, systemctlArgs, err := c.getSystemdUnitDirectory()
+	if err != nil {
+		return err
+	}
+
+	// Validate all schedules before touching the installed units
+	timers := make([][]string, len(jobs))
+	for i, j := range jobs {
+		timers[i], err = getSystemdTimerSpec(j.Schedule)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.removeScheduleForSystemd(configFile)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	var timerNames []string
+	for i, j := range jobs {
+		name := c.getSystemdUnitName(configFile)
+		if len(jobs) > 1 {
+			name = fmt.Sprintf("%s-%d", name, i+1)
+		}
+
+		command := []string{systemdQuote(executable), "backup", "--config", systemdQuote(configFile)}
+		for _, t := range j.Targets {
+			command = append(command, "--target", systemdQuote(t))
+		}
+
+		service := strings.Join([]string{
+			"# Managed by citrixadc-backup for " + configFile,
+			"[Unit]",
+			"Description=Citrix ADC backup for " + systemdEscape(configFile),
+			"Wants=network-online.target",
+			"After=network-online.target",
+			"",
+			"[Service]",
+			"Type=oneshot",
+			"WorkingDirectory=" + systemdEscape(filepath.Dir(configFile)),
+			"ExecStart=" + strings.Join(command, " "),
+			"",
+		}, "\n")
+
+		timer := strings.Join([]string{
+			"# Managed by citrixadc-backup for " + configFile,
+			"[Unit]",
+			"Description=Citrix ADC backup schedule " + systemdEscape(j.Schedule) + " for " + systemdEscape(configFile),
+			"",
+			"[Timer]",
+			strings.Join(timers[i], "\n"),
+			"Unit=" + name + ".service",
+			"",
+			"[Install]",
+			"WantedBy=timers.target",
+			"",
+		}, "\n")
+
+		err = ioutil.WriteFile(filepath.Join(directory, name+".service"), []byte(service), 0644)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(directory, name+".timer"), []byte(timer), 0644)
+		if err != nil {
+			return err
+		}
+		timerNames = append(timerNames, name+".timer")
+	}
+
+	err = c.runSystemctl(systemctlArgs, "daemon-reload")
+	if err != nil {
+		return err
+	}
+	err = c.runSystemctl(systemctlArgs, append([]string{"enable", "--now"}, timerNames...)...)
+	if err == nil {
+		fmt.Println("Installed systemd timers", strings.Join(timerNames, ", "), "in", directory)
+	}
+	return err
+}
+
+func (c *ScheduleController) removeScheduleForSystemd(configFile string) error {
+	directory, systemctlArgs, err := c.getSystemdUnitDirectory()
+	if err != nil {
+		return err
+	}
+
+	name := c.getSystemdUnitName(configFile)
+	timers, err := filepath.Glob(filepath.Join(directory, name+"*.timer"))
+	if err != nil {
+		return err
+	}
+	services, err := filepath.Glob(filepath.Join(directory, name+"*.service"))
+	if err != nil {
+		return err
+	}
+	if len(timers) == 0 && len(services) == 0 {
+		return nil
+	}
+
+	var timerNames []string
+	for _, t := range timers {
+		timerNames = append(timerNames, filepath.Base(t))
+	}
+	if len(timerNames) > 0 {
+		err = c.runSystemctl(systemctlArgs, append([]string{"disable", "--now"}, timerNames...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range append(timers, services...) {
+		err = os.Remove(f)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.runSystemctl(systemctlArgs, "daemon-reload")
+	if err == nil {
+		fmt.Println("Removed systemd timers for", configFile)
+	}
+	return err
+}
+
+func (c *ScheduleController) runSystemctl(systemctlArgs []string, args ...string) error {
+	output, err := exec.Command("systemctl", append(systemctlArgs, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// shellQuote quotes a value for use in a shell command
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// cronQuote quotes a value for use in the command of a crontab line, where cron turns an unescaped % into a newline
+func cronQuote(value string) string {
+	return strings.Replace(shellQuote(value), "%", `\%`, -1)
+}
+
+// systemdEscape escapes the specifiers in a value for use in a unit file
+func systemdEscape(value string) string {
+	return strings.Replace(value, "%", "%%", -1)
+}
+
+// systemdQuote quotes a value for use in ExecStart
+func systemdQuote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + systemdEscape(value) + `"`
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/robfig/cron/v3"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadConfigurationUsesLoader(t *testing.T) {
+	initial := models.BackupConfiguration{
+		Targets: []models.BackupTarget{
+			{Name: "adc1", Schedule: "@every 1h"},
+		},
+	}
+	reloaded := models.BackupConfiguration{
+		Targets: []models.BackupTarget{
+			{Name: "adc1", Schedule: "@every 1h"},
+			{Name: "adc2", Schedule: "@every 2h"},
+		},
+		Settings: models.BackupSettings{KeystorePath: "/etc/citrixadc-backup/citrixadc-backup.keystore"},
+	}
+
+	var loads int
+	c := ScheduleController{
+		ctx:     context.Background(),
+		cron:    cron.New(),
+		running: make(map[string]bool),
+		metrics: NewMetricsController(),
+		targets: newTargetScheduler(initial.Settings),
+		load: func() (models.BackupConfiguration, error) {
+			loads++
+			return reloaded, nil
+		},
+	}
+	c.scheduleTargets(initial)
+
+	c.reloadConfiguration()
+	if loads != 1 {
+		t.Fatalf("loader called %d times, want 1", loads)
+	}
+	if len(c.entries) != 2 {
+		t.Fatalf("%d targets scheduled after reload, want 2", len(c.entries))
+	}
+
+	// A configuration which cannot be loaded keeps the current schedules
+	c.load = func() (models.BackupConfiguration, error) {
+		return models.BackupConfiguration{}, errors.New("invalid configuration")
+	}
+	c.reloadConfiguration()
+	if len(c.entries) != 2 {
+		t.Fatalf("%d targets scheduled after a failed reload, want 2", len(c.entries))
+	}
+}
+
+func TestCronQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "/etc/citrixadc-backup/config.yaml", want: `'/etc/citrixadc-backup/config.yaml'`},
+		{value: "/backups/50%/config.yaml", want: `'/backups/50\%/config.yaml'`},
+		{value: "it's %d", want: `'it'\''s \%d'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := cronQuote(tt.value); got != tt.want {
+				t.Errorf("cronQuote(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfigurationAppliesMetricsSettings(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	textfile := filepath.Join(t.TempDir(), "citrixadc_backup.prom")
+	reloaded := models.BackupConfiguration{
+		Settings: models.BackupSettings{
+			Metrics: models.MetricsSettings{ListenAddress: address, TextfilePath: textfile},
+		},
+	}
+	c := ScheduleController{
+		ctx:     context.Background(),
+		cron:    cron.New(),
+		running: make(map[string]bool),
+		metrics: NewMetricsController(),
+		targets: newTargetScheduler(models.BackupSettings{}),
+		load: func() (models.BackupConfiguration, error) {
+			return reloaded, nil
+		},
+	}
+	c.metrics.Update(models.BackupTarget{Name: "adc1", Nodes: []models.BackupNode{{Name: "node1"}}}, models.TargetReport{Status: models.ReportStatusFailed})
+
+	c.reloadConfiguration()
+	defer c.metrics.Serve("")
+
+	content, err := ioutil.ReadFile(textfile)
+	if err != nil {
+		t.Fatalf("metrics are not written to the new textfile: %v", err)
+	}
+	if !strings.Contains(string(content), metricConsecutiveFailures) {
+		t.Errorf("new textfile does not hold the metrics of earlier backups:\n%s", content)
+	}
+
+	// The server starts in the background
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		response, err = http.Get("http://" + address + "/metrics")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("metrics are not served on the new listen address: %v", err)
+	}
+	response.Body.Close()
+
+	reloaded.Settings.Metrics.ListenAddress = ""
+	c.reloadConfiguration()
+	if _, err = http.Get("http://" + address + "/metrics"); err == nil {
+		t.Error("metrics are still served after the listen address was removed")
+	}
+}
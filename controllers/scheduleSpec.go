@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField describes the allowed values of a field in a standard cron expression
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var systemdWeekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "yearly",
+	"@annually": "yearly",
+	"@monthly":  "monthly",
+	"@weekly":   "weekly",
+	"@daily":    "daily",
+	"@midnight": "daily",
+	"@hourly":   "hourly",
+}
+
+// getCrontabSpec converts a schedule to a spec which can be used in a crontab.
+// Intervals (@every) are only supported when they divide an hour or a day.
+func getCrontabSpec(schedule string) (string, error) {
+	schedule = strings.TrimSpace(schedule)
+	if _, ok := cronDescriptors[schedule]; ok {
+		return schedule, nil
+	}
+
+	if strings.HasPrefix(schedule, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(schedule, "@every ")))
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case d >= time.Minute && d < time.Hour && d%time.Minute == 0 && time.Hour%d == 0:
+			return fmt.Sprintf("*/%d * * * *", d/time.Minute), nil
+		case d >= time.Hour && d < 24*time.Hour && d%time.Hour == 0 && (24*time.Hour)%d == 0:
+			return fmt.Sprintf("0 */%d * * *", d/time.Hour), nil
+		case d == 24*time.Hour:
+			return "0 0 * * *", nil
+		default:
+			return "", fmt.Errorf("interval %s cannot be expressed as a crontab schedule", d)
+		}
+	}
+
+	fields := strings.Fields(schedule)
+	if len(fields) != len(cronFields) {
+		return "", fmt.Errorf("schedule %q is not a cron expression with 5 fields", schedule)
+	}
+	for i, f := range fields {
+		if _, _, err := parseCronField(f, cronFields[i]); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// getSystemdTimerSpec converts a schedule to the [Timer] settings of a systemd timer unit
+func getSystemdTimerSpec(schedule string) ([]string, error) {
+	schedule = strings.TrimSpace(schedule)
+	if calendar, ok := cronDescriptors[schedule]; ok {
+		return []string{"OnCalendar=" + calendar, "Persistent=true"}, nil
+	}
+
+	if strings.HasPrefix(schedule, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(schedule, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		return []string{"OnActiveSec=" + d.String(), "OnUnitActiveSec=" + d.String()}, nil
+	}
+
+	fields := strings.Fields(schedule)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q is not a cron expression with 5 fields", schedule)
+	}
+
+	calendar := make([]string, len(fields))
+	restricted := make([]bool, len(fields))
+	for i, f := range fields {
+		values, step, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		restricted[i] = f != "*"
+
+		switch {
+		case !restricted[i]:
+			calendar[i] = "*"
+		case i == 4:
+			var weekdays []string
+			seen := make(map[string]bool)
+			for _, v := range values {
+				if !seen[systemdWeekdays[v]] {
+					seen[systemdWeekdays[v]] = true
+					weekdays = append(weekdays, systemdWeekdays[v])
+				}
+			}
+			calendar[i] = strings.Join(weekdays, ",")
+		case step > 0 && strings.HasPrefix(f, "*/"):
+			calendar[i] = fmt.Sprintf("%02d/%d", cronFields[i].min, step)
+		default:
+			var s []string
+			for _, v := range values {
+				s = append(s, fmt.Sprintf("%02d", v))
+			}
+			calendar[i] = strings.Join(s, ",")
+		}
+	}
+
+	// cron runs a job when either the day of month or the day of week matches, systemd requires both to match
+	if restricted[2] && restricted[4] {
+		return nil, fmt.Errorf("schedule %q restricts both day of month and day of week, which systemd timers do not support", schedule)
+	}
+
+	onCalendar := fmt.Sprintf("*-%s-%s %s:%s:00", calendar[3], calendar[2], calendar[1], calendar[0])
+	if restricted[4] {
+		onCalendar = calendar[4] + " " + onCalendar
+	}
+	return []string{"OnCalendar=" + onCalendar, "Persistent=true"}, nil
+}
+
+// parseCronField expands a single cron field to the sorted values it matches.
+// When the field is a single step expression, the step is returned as well.
+func parseCronField(field string, f cronField) ([]int, int, error) {
+	var step int
+	matches := make(map[int]bool)
+
+	for _, item := range strings.Split(field, ",") {
+		low, high := f.min, f.max
+		step = 1
+
+		rangePart := item
+		if i := strings.Index(item, "/"); i >= 0 {
+			rangePart = item[:i]
+			s, err := strconv.Atoi(item[i+1:])
+			if err != nil || s <= 0 {
+				return nil, 0, fmt.Errorf("invalid step in %s field %q", f.name, field)
+			}
+			step = s
+		}
+
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			low, err = parseCronValue(bounds[0], f)
+			if err != nil {
+				return nil, 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = parseCronValue(bounds[1], f)
+				if err != nil {
+					return nil, 0, err
+				}
+			} else if step > 1 {
+				high = f.max
+			}
+			if high < low {
+				return nil, 0, fmt.Errorf("invalid range in %s field %q", f.name, field)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			matches[v] = true
+		}
+	}
+
+	var output []int
+	for v := range matches {
+		output = append(output, v)
+	}
+	sort.Ints(output)
+
+	if strings.Contains(field, ",") {
+		step = 0
+	}
+	return output, step, nil
+}
+
+func parseCronValue(value string, f cronField) (int, error) {
+	if v, ok := f.names[strings.ToLower(value)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field", value, f.name)
+	}
+	return v, nil
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/citrix/adc-nitro-go/service"
 	"github.com/jantytgat/citrixadc-backup/data"
@@ -10,50 +11,83 @@ import (
 	"log"
 	"os"
 	"strings"
-	"sync"
+	"time"
 )
 
 type SetupController struct{}
 
 type SetupControllerCaller interface {
-	RunInstall(s models.BackupConfiguration)
-	RunUninstall(s models.BackupConfiguration)
+	RunInstall(ctx context.Context, s models.BackupConfiguration, allowRestore bool) models.RunReport
+	RunUninstall(ctx context.Context, s models.BackupConfiguration) models.RunReport
 
-	getSetupTargets() []models.SetupTarget
+	getSetupTargets(s models.BackupConfiguration, allowRestore bool) []models.SetupTarget
 	getUsernameFromStdin() string
 	getPasswordFromStdin() string
 	getCmdPolicyNameFromStdin() string
 
-	createSetupNitroClientsForNodes(t models.SetupTarget) (map[string]service.NitroClient, error)
-	runInstallCommands(t models.SetupTarget, wg *sync.WaitGroup)
-	runUninstallCommands(t models.SetupTarget, wg *sync.WaitGroup)
-	createCmdPolicy(nitroClient service.NitroClient, name string) error
-	createUser(nitroClient service.NitroClient, username string, password string) error
-	bindCmdPolicy(nitroClient service.NitroClient, username string, policyName string) error
-	deleteUser(nitroClient service.NitroClient, username string) error
-	deleteCmdPolicy(nitroClient service.NitroClient, policyName string) error
-	saveConfig(nitroClient service.NitroClient) error
+	createSetupNitroClientsForNodes(t models.SetupTarget) (map[string]*service.NitroClient, error)
+	runSetupTargets(ctx context.Context, setupTargets []models.SetupTarget, s models.BackupSettings, fn func(ctx context.Context, t models.SetupTarget, s models.BackupSettings) error) models.RunReport
+	connectSetupTarget(ctx context.Context, t *models.SetupTarget, s models.BackupSettings) (map[string]*service.NitroClient, models.BackupNode, error)
+	runInstallCommands(ctx context.Context, t models.SetupTarget, s models.BackupSettings) error
+	runUninstallCommands(ctx context.Context, t models.SetupTarget, s models.BackupSettings) error
+	createCmdPolicy(ctx context.Context, nitroClient *service.NitroClient, name string, allowRestore bool) error
+	createUser(ctx context.Context, nitroClient *service.NitroClient, username string, password string) error
+	bindCmdPolicy(ctx context.Context, nitroClient *service.NitroClient, username string, policyName string) error
+	deleteUser(ctx context.Context, nitroClient *service.NitroClient, username string) error
+	deleteCmdPolicy(ctx context.Context, nitroClient *service.NitroClient, policyName string) error
+	saveConfig(ctx context.Context, nitroClient *service.NitroClient) error
 }
 
-func (c *SetupController) RunInstall(s models.BackupConfiguration) {
-	var wg sync.WaitGroup
-	for _, t := range c.getSetupTargets(s) {
-		wg.Add(1)
-		go c.runInstallCommands(t, &wg)
-	}
-	wg.Wait()
+func (c *SetupController) RunInstall(ctx context.Context, s models.BackupConfiguration, allowRestore bool) models.RunReport {
+	return c.runSetupTargets(ctx, c.getSetupTargets(s, allowRestore), s.Settings, c.runInstallCommands)
+}
+
+func (c *SetupController) RunUninstall(ctx context.Context, s models.BackupConfiguration) models.RunReport {
+	return c.runSetupTargets(ctx, c.getSetupTargets(s, false), s.Settings, c.runUninstallCommands)
 }
 
-func (c *SetupController) RunUninstall(s models.BackupConfiguration) {
-	var wg sync.WaitGroup
-	for _, t := range c.getSetupTargets(s) {
-		wg.Add(1)
-		go c.runUninstallCommands(t, &wg)
+// runSetupTargets runs fn for the setup targets within the concurrency limits of the backups, and reports the outcome for each target
+func (c *SetupController) runSetupTargets(ctx context.Context, setupTargets []models.SetupTarget, s models.BackupSettings, fn func(ctx context.Context, t models.SetupTarget, s models.BackupSettings) error) models.RunReport {
+	report := models.RunReport{
+		Start:   time.Now(),
+		Targets: make([]models.TargetReport, len(setupTargets)),
+	}
+
+	targets := make([]models.BackupTarget, len(setupTargets))
+	for i, t := range setupTargets {
+		targets[i] = t.Target
 	}
-	wg.Wait()
+
+	ctx, cancel := withTimeout(ctx, s.Timeouts.Run)
+	defer cancel()
+
+	scheduler := newTargetScheduler(s)
+	scheduler.run(ctx, targets, s, func(i int) {
+		start := time.Now()
+		r := &report.Targets[i]
+		r.Target = targets[i].Name
+		r.Type = targets[i].Type
+		r.Status = models.ReportStatusSuccess
+
+		err := ctx.Err()
+		if err != nil {
+			err = fmt.Errorf("target was not started: %v", err)
+		} else {
+			targetCtx, cancel := withTimeout(ctx, getTimeouts(targets[i], s).Target)
+			err = fn(targetCtx, setupTargets[i], s)
+			cancel()
+		}
+		if err != nil {
+			failTarget(r, err)
+		}
+		r.DurationSeconds = time.Since(start).Seconds()
+	})
+
+	setRunStatus(&report)
+	return report
 }
 
-func (c *SetupController) getSetupTargets(s models.BackupConfiguration) []models.SetupTarget {
+func (c *SetupController) getSetupTargets(s models.BackupConfiguration, allowRestore bool) []models.SetupTarget {
 	var setupTargets []models.SetupTarget
 
 	for _, t := range s.Targets {
@@ -63,6 +97,7 @@ func (c *SetupController) getSetupTargets(s models.BackupConfiguration) []models
 			Username:      c.getUsernameFromStdin(),
 			Password:      c.getPasswordFromStdin(),
 			CmdPolicyName: c.getCmdPolicyNameFromStdin(),
+			AllowRestore:  allowRestore,
 		}
 		setupTargets = append(setupTargets, setupTarget)
 	}
@@ -106,9 +141,8 @@ func (c *SetupController) getCmdPolicyNameFromStdin() string {
 	return policyName
 }
 
-func (c *SetupController) createSetupNitroClientsForNodes(t models.SetupTarget) (map[string]service.NitroClient, error) {
-	nitroClient := make(map[string]service.NitroClient, len(t.Target.Nodes))
-	var err error
+func (c *SetupController) createSetupNitroClientsForNodes(t models.SetupTarget) (map[string]*service.NitroClient, error) {
+	nitroClient := make(map[string]*service.NitroClient, len(t.Target.Nodes))
 	for _, n := range t.Target.Nodes {
 		client, err := service.NewNitroClientFromParams(
 			service.NitroParams{
@@ -118,133 +152,139 @@ func (c *SetupController) createSetupNitroClientsForNodes(t models.SetupTarget)
 				SslVerify: t.Target.ValidateCertificate,
 			})
 		if err != nil {
-			log.Fatal("Could not create client for target ", t.Target.Name, " node ", n.Name)
+			return nitroClient, newStageError(StageClient, n.Name, err)
 		}
 
-		nitroClient[n.Name] = *client
+		nitroClient[n.Name] = client
 	}
-	return nitroClient, err
+	return nitroClient, nil
 }
 
-func (c *SetupController) runInstallCommands(t models.SetupTarget, wg *sync.WaitGroup) {
-	var primaryNode models.BackupNode
+// connectSetupTarget resolves the credentials of the backup user, and returns the clients and primary node of the target
+func (c *SetupController) connectSetupTarget(ctx context.Context, t *models.SetupTarget, s models.BackupSettings) (map[string]*service.NitroClient, models.BackupNode, error) {
 	var err error
-	var clients = make(map[string]service.NitroClient, len(t.Target.Nodes))
+	t.Target.Username, t.Target.Password, err = resolveCredentials(t.Target, s)
+	if err != nil {
+		return nil, models.BackupNode{}, newStageError(StageClient, "", err)
+	}
 
-	clients, err = c.createSetupNitroClientsForNodes(t)
+	// Clusters are configured through the cluster IP address, which is owned by the configuration coordinator
+	if isCluster(t.Target) {
+		t.Target.Nodes = []models.BackupNode{getClusterNode(t.Target)}
+	}
+
+	clients, err := c.createSetupNitroClientsForNodes(*t)
 	if err != nil {
-		log.Fatal("Error creating nitro clients")
-		wg.Done()
-		return
+		return clients, models.BackupNode{}, err
 	}
 
-	primaryNode, err = getPrimaryNode(clients, t.Target)
+	primaryNode, _, err := getPrimaryNode(ctx, clients, t.Target, getTimeouts(t.Target, s).Connect)
 	if err != nil {
-		wg.Done()
-		return
+		return clients, primaryNode, err
 	}
 	fmt.Println("Executing commands for", t.Target.Name, "on", primaryNode.Name)
+	return clients, primaryNode, nil
+}
 
-	err = c.createCmdPolicy(clients[primaryNode.Name], t.CmdPolicyName)
+func (c *SetupController) runInstallCommands(ctx context.Context, t models.SetupTarget, s models.BackupSettings) error {
+	clients, primaryNode, err := c.connectSetupTarget(ctx, &t, s)
 	if err != nil {
-		fmt.Println(err)
-		wg.Done()
-		return
+		return err
 	}
 
-	err = c.createUser(clients[primaryNode.Name], t.Target.Username, t.Target.Password)
+	err = c.createCmdPolicy(ctx, clients[primaryNode.Name], t.CmdPolicyName, t.AllowRestore)
 	if err != nil {
-		wg.Done()
-		return
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not create command policy: %v", err))
 	}
 
-	err = c.bindCmdPolicy(clients[primaryNode.Name], t.Target.Username, t.CmdPolicyName)
+	err = c.createUser(ctx, clients[primaryNode.Name], t.Target.Username, t.Target.Password)
 	if err != nil {
-		wg.Done()
-		return
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not create user: %v", err))
 	}
 
-	err = c.saveConfig(clients[primaryNode.Name])
-	wg.Done()
-}
-
-func (c *SetupController) runUninstallCommands(t models.SetupTarget, wg *sync.WaitGroup) {
-	var primaryNode models.BackupNode
-	var err error
-	var nitroClient = make(map[string]service.NitroClient, len(t.Target.Nodes))
+	err = c.bindCmdPolicy(ctx, clients[primaryNode.Name], t.Target.Username, t.CmdPolicyName)
+	if err != nil {
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not bind command policy: %v", err))
+	}
 
-	nitroClient, err = c.createSetupNitroClientsForNodes(t)
+	err = c.saveConfig(ctx, clients[primaryNode.Name])
 	if err != nil {
-		log.Fatal("Error creating nitro clients")
-		wg.Done()
-		return
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not save configuration: %v", err))
 	}
+	return nil
+}
 
-	primaryNode, err = getPrimaryNode(nitroClient, t.Target)
+func (c *SetupController) runUninstallCommands(ctx context.Context, t models.SetupTarget, s models.BackupSettings) error {
+	clients, primaryNode, err := c.connectSetupTarget(ctx, &t, s)
 	if err != nil {
-		wg.Done()
-		return
+		return err
 	}
-	fmt.Println("Executing commands for", t.Target.Name, "on", primaryNode.Name)
 
-	err = c.deleteUser(nitroClient[primaryNode.Name], t.Target.Username)
+	err = c.deleteUser(ctx, clients[primaryNode.Name], t.Target.Username)
 	if err != nil {
-		wg.Done()
-		return
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not delete user: %v", err))
 	}
 
-	err = c.deleteCmdPolicy(nitroClient[primaryNode.Name], t.CmdPolicyName)
+	err = c.deleteCmdPolicy(ctx, clients[primaryNode.Name], t.CmdPolicyName)
 	if err != nil {
-		wg.Done()
-		return
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not delete command policy: %v", err))
 	}
 
-	err = c.saveConfig(nitroClient[primaryNode.Name])
-	wg.Done()
+	err = c.saveConfig(ctx, clients[primaryNode.Name])
+	if err != nil {
+		return newStageError(StageSetup, primaryNode.Name, fmt.Errorf("could not save configuration: %v", err))
+	}
+	return nil
 }
 
-func (c *SetupController) createCmdPolicy(nitroClient service.NitroClient, name string) error {
-	fmt.Println("Creating system command policy")
-	request := data.GetSystemCmdPolicyCreateData(name)
-	response, err := nitroClient.AddResource(service.Systemcmdpolicy.Type(), name, request)
+func (c *SetupController) createCmdPolicy(ctx context.Context, nitroClient *service.NitroClient, name string, allowRestore bool) error {
+	if allowRestore {
+		fmt.Println("Creating system command policy, including restore permissions")
+	} else {
+		fmt.Println("Creating system command policy")
+	}
+	request := data.GetSystemCmdPolicyCreateData(name, allowRestore)
+	response, err := addResource(ctx, nitroClient, service.Systemcmdpolicy.Type(), name, request)
 	if err == nil {
 		fmt.Println(response)
 	}
 	return err
 }
 
-func (c *SetupController) createUser(nitroClient service.NitroClient, username string, password string) error {
+func (c *SetupController) createUser(ctx context.Context, nitroClient *service.NitroClient, username string, password string) error {
 	fmt.Println("Creating system user")
 	request := data.GetSystemUserCreateData(username, password)
-	response, err := nitroClient.AddResource(service.Systemuser.Type(), username, request)
+	response, err := addResource(ctx, nitroClient, service.Systemuser.Type(), username, request)
 	if err == nil {
 		fmt.Println(response)
 	}
 	return err
 }
 
-func (c *SetupController) bindCmdPolicy(nitroClient service.NitroClient, username string, policyName string) error {
+func (c *SetupController) bindCmdPolicy(ctx context.Context, nitroClient *service.NitroClient, username string, policyName string) error {
 	fmt.Println("Binding command policy to user")
 	request := data.GetSystemCmdPolicyBindingCreateData(policyName, username)
-	response, err := nitroClient.AddResource(service.Systemuser_binding.Type(), username, request)
+	response, err := addResource(ctx, nitroClient, service.Systemuser_binding.Type(), username, request)
 	if err == nil {
 		fmt.Println(response)
 	}
 	return err
 }
 
-func (c *SetupController) deleteUser(nitroClient service.NitroClient, username string) error {
+func (c *SetupController) deleteUser(ctx context.Context, nitroClient *service.NitroClient, username string) error {
 	fmt.Println("Deleting system user")
-	err := nitroClient.DeleteResource(service.Systemuser.Type(), username)
-	return err
+	return runWithContext(ctx, func() error {
+		return nitroClient.DeleteResource(service.Systemuser.Type(), username)
+	})
 }
 
-func (c *SetupController) deleteCmdPolicy(nitroClient service.NitroClient, policyName string) error {
+func (c *SetupController) deleteCmdPolicy(ctx context.Context, nitroClient *service.NitroClient, policyName string) error {
 	fmt.Println("Deleting system command policy")
-	err := nitroClient.DeleteResource(service.Systemcmdpolicy.Type(), policyName)
-	return err
+	return runWithContext(ctx, func() error {
+		return nitroClient.DeleteResource(service.Systemcmdpolicy.Type(), policyName)
+	})
 }
 
-func (c *SetupController) saveConfig(nitroClient service.NitroClient) error {
-	return saveConfig(nitroClient)
+func (c *SetupController) saveConfig(ctx context.Context, nitroClient *service.NitroClient) error {
+	return saveConfig(ctx, nitroClient)
 }
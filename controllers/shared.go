@@ -1,61 +1,290 @@
 package controllers
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/citrix/adc-nitro-go/service"
 	"github.com/jantytgat/citrixadc-backup/models"
-	"log"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func createNitroClientsForNodes(t models.BackupTarget) (map[string]service.NitroClient, error) {
-	nitroClient := make(map[string]service.NitroClient, len(t.Nodes))
-	var err error
+var nitroErrorCodeRegex = regexp.MustCompile(`"errorcode"\s*:\s*(\d+)`)
+
+// timestampLayout is the time layout produced by BackupController.getTimestamp
+const timestampLayout = "20060102_150405"
+
+// destination is a named storage where archives are written to
+type destination struct {
+	Name    string
+	Storage storage.Storage
+}
+
+// getTargetDirectory returns the directory where the archives for a target are stored, relative to the root of a destination
+func getTargetDirectory(targetName string, s models.BackupSettings) string {
+	if s.FolderPerTarget {
+		return targetName
+	}
+	return ""
+}
+
+// getDeduplicationWarning returns why Deduplicate has no effect with the settings, or an empty string when it does
+func getDeduplicationWarning(s models.BackupSettings) string {
+	if !s.Deduplicate || s.Encryption.Type == "" {
+		return ""
+	}
+	return "Deduplicate has no effect while Encryption is configured, as encrypted archives are never identical"
+}
+
+// getHistoryWarning returns a warning when the history repository keeps configurations in plain text which are otherwise encrypted, or an empty string
+func getHistoryWarning(s models.BackupSettings) string {
+	if !s.History.IsEnabled() || s.Encryption.Type == "" {
+		return ""
+	}
+	return fmt.Sprintf("the history repository %s keeps ns.conf and the other configuration files in plain text, even though Encryption is configured", s.History.Path)
+}
+
+// getSettingsWarnings returns the warnings about settings which do not prevent a backup, but may not do what is expected
+func getSettingsWarnings(s models.BackupSettings) []string {
+	var output []string
+	for _, w := range []string{getDeduplicationWarning(s), getHistoryWarning(s)} {
+		if w != "" {
+			output = append(output, w)
+		}
+	}
+	return output
+}
+
+// getDestinations returns the destinations of a target. Targets without destinations are stored in OutputBasePath.
+func getDestinations(t models.BackupTarget, s models.BackupSettings) ([]destination, error) {
+	var output []destination
+
+	o := storage.Options{
+		KeystorePath: s.KeystorePath,
+		Private:      s.Encryption.Type != "",
+	}
+
+	if len(t.Destinations) == 0 {
+		output = append(output, destination{Name: storage.TypeLocal, Storage: storage.NewLocal(s.OutputBasePath, o)})
+		return output, nil
+	}
+
+	for _, name := range t.Destinations {
+		d, err := getDestinationSettings(name, s)
+		if err != nil {
+			return output, fmt.Errorf("target %s: %v", t.Name, err)
+		}
+		st, err := storage.New(d, o)
+		if err != nil {
+			return output, err
+		}
+		output = append(output, destination{Name: name, Storage: st})
+	}
+	return output, nil
+}
+
+// getDestination returns a single destination of a target by name
+func getDestination(t models.BackupTarget, s models.BackupSettings, name string) (destination, error) {
+	destinations, err := getDestinations(t, s)
+	if err != nil {
+		return destination{}, err
+	}
+	for _, d := range destinations {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return destination{}, fmt.Errorf("destination %s is not used by target %s", name, t.Name)
+}
+
+func getDestinationSettings(name string, s models.BackupSettings) (models.DestinationSettings, error) {
+	for _, d := range s.Destinations {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return models.DestinationSettings{}, fmt.Errorf("destination %s is not defined", name)
+}
+
+// usesOutputBasePath reports whether any of the targets is stored in OutputBasePath
+func usesOutputBasePath(targets []models.BackupTarget) bool {
+	for _, t := range targets {
+		if len(t.Destinations) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func createNitroClientsForNodes(t models.BackupTarget, s models.BackupSettings) (map[string]*service.NitroClient, error) {
+	nitroClient := make(map[string]*service.NitroClient, len(t.Nodes))
+
+	username, password, err := resolveCredentials(t, s)
+	if err != nil {
+		return nitroClient, newStageError(StageClient, "", err)
+	}
+
 	for _, n := range t.Nodes {
 		client, err := service.NewNitroClientFromParams(
 			service.NitroParams{
 				Url:       n.Address,
-				Username:  t.Username,
-				Password:  t.Password,
+				Username:  username,
+				Password:  password,
 				SslVerify: t.ValidateCertificate,
 			})
 		if err != nil {
-			log.Fatal("Could not create client for target", t.Name, "node", n.Name)
+			return nitroClient, newStageError(StageClient, n.Name, err)
 		}
-		nitroClient[n.Name] = *client
+		nitroClient[n.Name] = client
 	}
-	return nitroClient, err
+	return nitroClient, nil
 }
 
+// resolveCredentials resolves the secret references in the username and password of a target
+func resolveCredentials(t models.BackupTarget, s models.BackupSettings) (string, string, error) {
+	username, err := secrets.Resolve(t.Username, s.KeystorePath)
+	if err != nil {
+		return "", "", fmt.Errorf("target %s: could not resolve username: %v", t.Name, err)
+	}
+	password, err := secrets.Resolve(t.Password, s.KeystorePath)
+	if err != nil {
+		return "", "", fmt.Errorf("target %s: could not resolve password: %v", t.Name, err)
+	}
+	return username, password, nil
+}
 
-func checkNodeIsPrimary(nitroClient service.NitroClient) (bool, error) {
-	response, err := nitroClient.FindResource(service.Hanode.Type(), "0")
-	if err == nil {
-		if response["state"] == "Primary" {
-			return true, err
-		}
+// newNitroRequest returns a GET request for a NITRO path on a node, for responses which are read directly instead of through the NITRO client
+func newNitroRequest(ctx context.Context, t models.BackupTarget, n models.BackupNode, s models.BackupSettings, path string) (*http.Request, error) {
+	username, password, err := resolveCredentials(t, s)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(n.Address, " /")+path, nil)
+	if err != nil {
+		return nil, err
 	}
-	return false, err
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("X-NITRO-USER", username)
+	request.Header.Set("X-NITRO-PASS", password)
+	return request, nil
 }
 
-func getPrimaryNode(nitroClients map[string]service.NitroClient, t models.BackupTarget) (models.BackupNode, error) {
-	var output models.BackupNode
-	var err error
-	if t.Type != "standalone" {
-		fmt.Println("Detecting primary node for", t.Name)
-		for _, n := range t.Nodes {
-			// TODO - Check reverse err == nil
-			if _, err := checkNodeIsPrimary(nitroClients[n.Name]); err == nil {
-				output = n
-				break
-			}
+// newNitroHttpClient returns an HTTP client for requests created with newNitroRequest
+func newNitroHttpClient(t models.BackupTarget, s models.BackupSettings) *http.Client {
+	timeouts := getTimeouts(t, s)
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: timeouts.Connect}).DialContext,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: !t.ValidateCertificate},
+			TLSHandshakeTimeout: timeouts.Connect,
+		},
+	}
+}
+
+// getPrimaryNode returns the node on which the backup is created, with the HA topology for HA pairs.
+// Each node is queried within the connect timeout.
+func getPrimaryNode(ctx context.Context, nitroClients map[string]*service.NitroClient, t models.BackupTarget, timeout time.Duration) (models.BackupNode, *models.TopologyReport, error) {
+	if len(t.Nodes) == 0 {
+		return models.BackupNode{}, nil, newStageError(StageConfiguration, "", fmt.Errorf("target %s has no nodes", t.Name))
+	}
+
+	switch strings.ToLower(t.Type) {
+	case models.TargetTypeStandalone:
+		return t.Nodes[0], nil, nil
+	case models.TargetTypeCluster:
+		// The configuration coordinator is the first node of a discovered cluster, or the cluster IP address itself
+		return t.Nodes[0], nil, nil
+	case models.TargetTypeHaPair:
+		switch strings.ToLower(t.HaPolicy) {
+		case "", models.HaPolicyFail, models.HaPolicyFirstReachable:
+		default:
+			return models.BackupNode{}, nil, newStageError(StageConfiguration, "", fmt.Errorf("unknown HA policy %s for target %s", t.HaPolicy, t.Name))
 		}
-	} else {
-		output = t.Nodes[0]
+		fmt.Println("Detecting primary node for", t.Name)
+		return getHaTopology(ctx, nitroClients, t, timeout)
+	default:
+		return models.BackupNode{}, nil, newStageError(StageConfiguration, "", fmt.Errorf("unknown type %s for target %s", t.Type, t.Name))
 	}
-	return output, err
 }
 
-func saveConfig(nitroClient service.NitroClient) error {
-	err := nitroClient.SaveConfig()
-	return err
-}
\ No newline at end of file
+func saveConfig(ctx context.Context, nitroClient *service.NitroClient) error {
+	return runWithContext(ctx, nitroClient.SaveConfig)
+}
+
+// addResource adds a NITRO resource, and returns early when ctx is done
+func addResource(ctx context.Context, nitroClient *service.NitroClient, resourceType string, name string, resource interface{}) (string, error) {
+	var response string
+	err := runWithContext(ctx, func() error {
+		var err error
+		response, err = nitroClient.AddResource(resourceType, name, resource)
+		return err
+	})
+	return response, err
+}
+
+// setRunStatus sets the end, duration and status of a run once all targets are done
+func setRunStatus(report *models.RunReport) {
+	report.End = time.Now()
+	report.DurationSeconds = report.End.Sub(report.Start).Seconds()
+	switch report.FailedTargets() {
+	case 0:
+		report.Status = models.ReportStatusSuccess
+	case len(report.Targets):
+		report.Status = models.ReportStatusFailed
+	default:
+		report.Status = models.ReportStatusPartial
+	}
+}
+
+// getNitroErrorCode returns the NITRO errorcode contained in an error returned by the nitro client, or 0 when there is none
+func getNitroErrorCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	match := nitroErrorCodeRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(match[1])
+	return code
+}
+
+func failTarget(report *models.TargetReport, err error) {
+	fmt.Println("Target", report.Target, "failed:", err)
+	report.Status = models.ReportStatusFailed
+	report.Stage = string(getErrorStage(err))
+	report.Error = err.Error()
+	report.ErrorCode = getNitroErrorCode(err)
+}
+
+// skipTarget reports a target which was not backed up because its configuration did not change, with the state of its nodes
+func skipTarget(report *models.TargetReport, t models.BackupTarget, reason string, configStates map[string]string) {
+	fmt.Println("Target", report.Target, "skipped:", reason)
+	report.Status = models.ReportStatusSkipped
+	report.SkipReason = reason
+	for _, n := range t.Nodes {
+		report.Nodes = append(report.Nodes, models.NodeReport{
+			Node:        n.Name,
+			Primary:     n.Name == report.PrimaryNode,
+			HaState:     getNodeHaState(t, report, n),
+			ConfigState: configStates[n.Name],
+			Status:      models.ReportStatusSkipped,
+		})
+	}
+}
+
+func failNode(report *models.NodeReport, err error) {
+	report.Status = models.ReportStatusFailed
+	report.Stage = string(getErrorStage(err))
+	report.Error = err.Error()
+	report.ErrorCode = getNitroErrorCode(err)
+}
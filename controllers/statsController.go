@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/storage"
+	"gopkg.in/yaml.v2"
+	"io"
+	"text/tabwriter"
+)
+
+type StatsController struct{}
+
+type StatsControllerCaller interface {
+	Run(ctx context.Context, s models.BackupConfiguration) (models.StatsReport, error)
+	Write(r models.StatsReport, format string, w io.Writer) error
+
+	usage(ctx context.Context, st storage.Storage, names []string, logical int64) (int64, bool, error)
+	writeTable(r models.StatsReport, w io.Writer) error
+}
+
+// Run adds up the size of the stored archives of every target on each of its destinations, with their manifests and exported configurations.
+// Files which are links to the same file in the store of a destination are counted once in the physical size.
+func (c *StatsController) Run(ctx context.Context, s models.BackupConfiguration) (models.StatsReport, error) {
+	var output models.StatsReport
+
+	r := RetentionController{}
+	var order []string
+	totals := make(map[string]*models.StorageStats)
+	storages := make(map[string]storage.Storage)
+	names := make(map[string][]string)
+	for _, t := range s.Targets {
+		destinations, err := getDestinations(t, s.Settings)
+		if err != nil {
+			return output, err
+		}
+
+		for _, d := range destinations {
+			archives, err := r.listArchives(ctx, t, s.Settings, d.Storage)
+			if err != nil {
+				return output, fmt.Errorf("could not list archives of %s on destination %s: %v", t.Name, d.Name, err)
+			}
+
+			stats := models.StorageStats{Target: t.Name, Destination: d.Name, Archives: len(archives)}
+			var targetNames []string
+			for _, a := range archives {
+				targetNames = append(targetNames, a.Names...)
+				for _, size := range a.Sizes {
+					stats.LogicalBytes += size
+				}
+			}
+			stats.Files = len(targetNames)
+			stats.PhysicalBytes, stats.Deduplicated, err = c.usage(ctx, d.Storage, targetNames, stats.LogicalBytes)
+			if err != nil {
+				return output, fmt.Errorf("could not get the size of %s on destination %s: %v", t.Name, d.Name, err)
+			}
+			output.Targets = append(output.Targets, stats)
+
+			total, found := totals[d.Name]
+			if !found {
+				total = &models.StorageStats{Destination: d.Name}
+				totals[d.Name] = total
+				storages[d.Name] = d.Storage
+				order = append(order, d.Name)
+			}
+			total.Archives += stats.Archives
+			total.Files += stats.Files
+			total.LogicalBytes += stats.LogicalBytes
+			names[d.Name] = append(names[d.Name], targetNames...)
+		}
+	}
+
+	for _, name := range order {
+		total := totals[name]
+		var err error
+		total.PhysicalBytes, total.Deduplicated, err = c.usage(ctx, storages[name], names[name], total.LogicalBytes)
+		if err != nil {
+			return output, fmt.Errorf("could not get the size of destination %s: %v", name, err)
+		}
+		output.Destinations = append(output.Destinations, *total)
+	}
+
+	if w := getDeduplicationWarning(s.Settings); w != "" {
+		output.Warnings = append(output.Warnings, w)
+	}
+	return output, nil
+}
+
+// usage returns the physical size of names on a destination, and whether the destination deduplicates files.
+// The physical size of destinations which do not deduplicate is their logical size.
+func (c *StatsController) usage(ctx context.Context, st storage.Storage, names []string, logical int64) (int64, bool, error) {
+	d, ok := st.(storage.Deduplicator)
+	if !ok {
+		return logical, false, nil
+	}
+	physical, err := d.Usage(ctx, names)
+	return physical, true, err
+}
+
+// Write writes the stats as a table, json or yaml
+func (c *StatsController) Write(r models.StatsReport, format string, w io.Writer) error {
+	if r.Targets == nil {
+		r.Targets = []models.StorageStats{}
+	}
+	if r.Destinations == nil {
+		r.Destinations = []models.StorageStats{}
+	}
+
+	switch format {
+	case "table":
+		return c.writeTable(r, w)
+	case "json":
+		output, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(output, '\n'))
+		return err
+	case "yaml":
+		output, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(output)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+func (c *StatsController) writeTable(r models.StatsReport, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tDESTINATION\tARCHIVES\tFILES\tLOGICAL\tPHYSICAL\tSAVED")
+	write := func(target string, s models.StorageStats) {
+		saved := "-"
+		if s.Deduplicated {
+			saved = formatBytes(s.SavedBytes())
+			if s.LogicalBytes > 0 {
+				saved += fmt.Sprintf(" (%.0f%%)", float64(s.SavedBytes())*100/float64(s.LogicalBytes))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n", target, s.Destination, s.Archives, s.Files, formatBytes(s.LogicalBytes), formatBytes(s.PhysicalBytes), saved)
+	}
+
+	for _, s := range r.Targets {
+		write(s.Target, s)
+	}
+	// An empty row keeps the totals in the same columns as the targets
+	if len(r.Destinations) > 0 {
+		fmt.Fprintln(tw, "\t\t\t\t\t\t")
+	}
+	for _, s := range r.Destinations {
+		write("total", s)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range r.Warnings {
+		_, err = fmt.Fprintln(w, "\nWarning:", warning)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatBytes returns a size in bytes in binary units, such as 1.5 MiB
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size) / unit
+	for _, u := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, u)
+		}
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f PiB", value)
+}
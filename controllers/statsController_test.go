@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"strings"
+	"testing"
+)
+
+func TestStatsWarnsOfDeduplicationWithEncryption(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption string
+		warning    bool
+	}{
+		{name: "unencrypted", warning: false},
+		{name: "encrypted", encryption: encryption.TypeAge, warning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := models.BackupConfiguration{
+				Targets: []models.BackupTarget{{Name: "adc1", Type: models.TargetTypeStandalone}},
+				Settings: models.BackupSettings{
+					OutputBasePath: t.TempDir(),
+					Deduplicate:    true,
+					Encryption:     models.EncryptionSettings{Type: tt.encryption},
+				},
+			}
+
+			c := StatsController{}
+			report, err := c.Run(context.Background(), s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(report.Warnings) > 0) != tt.warning {
+				t.Errorf("report has warnings %v", report.Warnings)
+			}
+
+			var output bytes.Buffer
+			if err = c.Write(report, "table", &output); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(output.String(), "Warning: Deduplicate has no effect") != tt.warning {
+				t.Errorf("table is\n%s", output.String())
+			}
+		})
+	}
+}
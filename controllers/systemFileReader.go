@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// systemFileContentField is the field of a NITRO systemfile response which holds the base64 encoded file
+const systemFileContentField = `"filecontent"`
+
+// systemFileContentReader reads the value of the filecontent field from a NITRO systemfile response as it is received,
+// so the archive never has to be held in memory as a whole
+type systemFileContentReader struct {
+	r       *bufio.Reader
+	started bool
+	done    bool
+}
+
+func newSystemFileContentReader(r io.Reader) *systemFileContentReader {
+	return &systemFileContentReader{r: bufio.NewReader(r)}
+}
+
+func (s *systemFileContentReader) Read(p []byte) (int, error) {
+	if s.done {
+		return 0, io.EOF
+	}
+	if !s.started {
+		if err := s.seek(); err != nil {
+			return 0, err
+		}
+		s.started = true
+	}
+
+	var n int
+	for n < len(p) {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+
+		switch b {
+		case '"':
+			s.done = true
+			return n, nil
+		case '\\':
+			// base64 only needs escaping for the slash, line breaks are ignored by the decoder
+			e, err := s.r.ReadByte()
+			if err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+			switch e {
+			case '/':
+				p[n] = '/'
+				n++
+			case 'n', 'r':
+			default:
+				return n, fmt.Errorf("unexpected escape sequence \\%c in filecontent", e)
+			}
+		default:
+			p[n] = b
+			n++
+		}
+	}
+	return n, nil
+}
+
+// seek skips the response up to the opening quote of the filecontent value
+func (s *systemFileContentReader) seek() error {
+	matched := 0
+	for matched < len(systemFileContentField) {
+		b, err := s.r.ReadByte()
+		if err != nil {
+			return errors.New("response does not contain filecontent")
+		}
+		switch {
+		case b == systemFileContentField[matched]:
+			matched++
+		case b == systemFileContentField[0]:
+			matched = 1
+		default:
+			matched = 0
+		}
+	}
+
+	for _, expected := range []byte{':', '"'} {
+		for {
+			b, err := s.r.ReadByte()
+			if err != nil {
+				return errors.New("response does not contain filecontent")
+			}
+			if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+				continue
+			}
+			if b != expected {
+				return fmt.Errorf("unexpected character %q after filecontent", b)
+			}
+			break
+		}
+	}
+	return nil
+}
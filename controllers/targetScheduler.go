@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// defaultMaxConcurrentPerNode makes sure a node address is never used by two targets at the same time
+const defaultMaxConcurrentPerNode = 1
+
+// targetScheduler limits the number of targets which run at the same time, in total and per node address.
+// Held has the addresses of every running target by its name, as the nodes of a cluster are only known once it runs.
+type targetScheduler struct {
+	mux           sync.Mutex
+	cond          *sync.Cond
+	maxTargets    int
+	maxPerAddress int
+	running       int
+	addresses     map[string]int
+	held          map[string][]string
+}
+
+func newTargetScheduler(s models.BackupSettings) *targetScheduler {
+	p := &targetScheduler{addresses: make(map[string]int), held: make(map[string][]string)}
+	p.cond = sync.NewCond(&p.mux)
+	p.setLimits(s)
+	return p
+}
+
+// setLimits applies the limits in s. Targets which are already running keep their slot.
+func (p *targetScheduler) setLimits(s models.BackupSettings) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.maxTargets = s.MaxConcurrentTargets
+	p.maxPerAddress = s.MaxConcurrentPerNode
+	if p.maxPerAddress <= 0 {
+		p.maxPerAddress = defaultMaxConcurrentPerNode
+	}
+	p.cond.Broadcast()
+}
+
+// acquire blocks until the target can run within the limits, and reports false when ctx is done before that.
+// All node addresses of the target are acquired at once, so targets sharing addresses cannot deadlock.
+func (p *targetScheduler) acquire(ctx context.Context, t models.BackupTarget) bool {
+	addresses := getNodeAddresses(t)
+
+	stop := p.broadcastWhenDone(ctx)
+	defer close(stop)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	for ctx.Err() == nil && !p.available(addresses) {
+		p.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+
+	p.running++
+	p.takeAddresses(t, addresses)
+	return true
+}
+
+// addNodes adds the addresses of the nodes of a running target which were discovered after it was started, such as the members of a cluster.
+// It blocks until the new addresses are available, and reports false when ctx is done before that.
+// The target gives up its addresses while it waits, so targets which wait for each other's addresses cannot deadlock.
+func (p *targetScheduler) addNodes(ctx context.Context, t models.BackupTarget) bool {
+	stop := p.broadcastWhenDone(ctx)
+	defer close(stop)
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	held := p.held[t.Name]
+	addresses := append([]string{}, held...)
+	seen := make(map[string]bool)
+	for _, a := range held {
+		seen[a] = true
+	}
+	for _, a := range getNodeAddresses(t) {
+		if !seen[a] {
+			seen[a] = true
+			addresses = append(addresses, a)
+		}
+	}
+	if len(addresses) == len(held) {
+		return true
+	}
+
+	p.releaseAddresses(t)
+	for ctx.Err() == nil && !p.availableAddresses(addresses) {
+		p.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	p.takeAddresses(t, addresses)
+	return true
+}
+
+// takeAddresses counts the addresses as used by a target, the lock must be held
+func (p *targetScheduler) takeAddresses(t models.BackupTarget, addresses []string) {
+	for _, a := range addresses {
+		p.addresses[a]++
+	}
+	p.held[t.Name] = addresses
+}
+
+// releaseAddresses releases the addresses held by a target, the lock must be held
+func (p *targetScheduler) releaseAddresses(t models.BackupTarget) {
+	for _, a := range p.held[t.Name] {
+		p.addresses[a]--
+		if p.addresses[a] <= 0 {
+			delete(p.addresses, a)
+		}
+	}
+	delete(p.held, t.Name)
+	p.cond.Broadcast()
+}
+
+// broadcastWhenDone wakes up the waiting targets when ctx is done, until the returned channel is closed
+func (p *targetScheduler) broadcastWhenDone(ctx context.Context) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.mux.Lock()
+			p.cond.Broadcast()
+			p.mux.Unlock()
+		case <-stop:
+		}
+	}()
+	return stop
+}
+
+// release releases the slot of a target, with all of the addresses it holds
+func (p *targetScheduler) release(t models.BackupTarget) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	p.running--
+	p.releaseAddresses(t)
+}
+
+func (p *targetScheduler) available(addresses []string) bool {
+	if p.maxTargets > 0 && p.running >= p.maxTargets {
+		return false
+	}
+	return p.availableAddresses(addresses)
+}
+
+func (p *targetScheduler) availableAddresses(addresses []string) bool {
+	for _, a := range addresses {
+		if p.addresses[a] >= p.maxPerAddress {
+			return false
+		}
+	}
+	return true
+}
+
+// run calls fn for every target within the limits, and returns when all targets are done.
+// The targets of each sequence in s run one after another, in the order of the sequence.
+// Once ctx is done, fn is called for the remaining targets without waiting for a slot, so they can report that they did not run.
+func (p *targetScheduler) run(ctx context.Context, targets []models.BackupTarget, s models.BackupSettings, fn func(i int)) {
+	var wg sync.WaitGroup
+	for _, chain := range getTargetChains(targets, s.Sequences) {
+		wg.Add(1)
+		go func(chain []int) {
+			defer wg.Done()
+			for _, i := range chain {
+				if !p.acquire(ctx, targets[i]) {
+					fn(i)
+					continue
+				}
+				fn(i)
+				p.release(targets[i])
+			}
+		}(chain)
+	}
+	wg.Wait()
+}
+
+// getTargetChains groups the indexes of targets in chains which run one after another.
+// Targets which are not part of a sequence get a chain of their own, targets can only be part of the first sequence they are listed in.
+func getTargetChains(targets []models.BackupTarget, sequences [][]string) [][]int {
+	var output [][]int
+
+	indexes := make(map[string]int, len(targets))
+	for i, t := range targets {
+		indexes[t.Name] = i
+	}
+
+	chained := make(map[int]bool)
+	for _, sequence := range sequences {
+		var chain []int
+		for _, name := range sequence {
+			i, ok := indexes[name]
+			if !ok || chained[i] {
+				continue
+			}
+			chained[i] = true
+			chain = append(chain, i)
+		}
+		if len(chain) > 0 {
+			output = append(output, chain)
+		}
+	}
+
+	for i := range targets {
+		if !chained[i] {
+			output = append(output, []int{i})
+		}
+	}
+	return output
+}
+
+// getNodeAddresses returns the distinct hosts of the nodes of a target, so different URLs for the same NSIP are treated as one address
+func getNodeAddresses(t models.BackupTarget) []string {
+	var output []string
+
+	nodes := t.Nodes
+	if t.ClusterAddress != "" {
+		nodes = append([]models.BackupNode{getClusterNode(t)}, nodes...)
+	}
+
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		address := strings.ToLower(n.Address)
+		if u, err := url.Parse(n.Address); err == nil && u.Hostname() != "" {
+			address = strings.ToLower(u.Hostname())
+		}
+		if !seen[address] {
+			seen[address] = true
+			output = append(output, address)
+		}
+	}
+	return output
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"testing"
+	"time"
+)
+
+func TestSchedulerHoldsDiscoveredClusterMembers(t *testing.T) {
+	p := newTargetScheduler(models.BackupSettings{})
+
+	first := models.BackupTarget{Name: "first", Type: models.TargetTypeCluster, ClusterAddress: "https://10.0.0.1"}
+	second := models.BackupTarget{Name: "second", Type: models.TargetTypeCluster, ClusterAddress: "https://10.0.1.1"}
+	if !p.acquire(context.Background(), first) || !p.acquire(context.Background(), second) {
+		t.Fatal("targets with different cluster addresses should run at the same time")
+	}
+
+	// Both clusters report the same member NSIP once they are discovered
+	member := []models.BackupNode{{Name: "node1", Address: "https://10.0.0.5"}}
+	first.Nodes = member
+	second.Nodes = member
+	if !p.addNodes(context.Background(), first) {
+		t.Fatal("first target should get the address of its member")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if p.addNodes(ctx, second) {
+		t.Fatal("second target should wait for the member address held by the first target")
+	}
+
+	p.release(first)
+	if !p.addNodes(context.Background(), second) {
+		t.Fatal("second target should get the member address once the first target is released")
+	}
+	if got := p.addresses["10.0.0.5"]; got != 1 {
+		t.Errorf("member address is used %d times, want 1", got)
+	}
+
+	p.release(second)
+	if len(p.addresses) != 0 || len(p.held) != 0 || p.running != 0 {
+		t.Errorf("scheduler should be empty after all targets are released, got addresses %v, held %v, running %d", p.addresses, p.held, p.running)
+	}
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"time"
+)
+
+// defaultTimeouts apply to the operations for which no timeout is configured.
+// Targets and runs have no deadline by default.
+var defaultTimeouts = models.TimeoutSettings{
+	Connect:  30 * time.Second,
+	Create:   10 * time.Minute,
+	Download: time.Hour,
+	Delete:   time.Minute,
+}
+
+// getTimeouts returns the timeouts for a target, where the timeouts of the target override the ones in the settings
+func getTimeouts(t models.BackupTarget, s models.BackupSettings) models.TimeoutSettings {
+	timeouts := defaultTimeouts.Merge(s.Timeouts)
+	if t.Timeouts != nil {
+		timeouts = timeouts.Merge(*t.Timeouts)
+	}
+	return timeouts
+}
+
+// getOperationTimeout returns the timeout for an operation on the ADC
+func getOperationTimeout(timeouts models.TimeoutSettings, operation Operation) time.Duration {
+	switch operation {
+	case OperationCreate:
+		return timeouts.Create
+	case OperationDownload:
+		return timeouts.Download
+	case OperationDelete:
+		return timeouts.Delete
+	default:
+		return 0
+	}
+}
+
+// withTimeout returns a context which is done after timeout, or a cancellable copy of ctx when timeout is 0
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runWithTimeout runs fn with a context which is done after timeout, and reports when fn failed because the timeout expired
+func runWithTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	operationCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(operationCtx)
+	if err != nil && ctx.Err() == nil && operationCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s: %w", timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// runWithContext runs fn, and returns early with the error of ctx when it is done before fn completes.
+// The NITRO client does not accept a context, so a request which is abandoned completes in the background.
+func runWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
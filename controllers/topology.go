@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"github.com/citrix/adc-nitro-go/service"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"strings"
+	"time"
+)
+
+const (
+	haStatePrimary    = "primary"
+	haStateStandalone = "standalone"
+	haStatusUp        = "up"
+	haSyncSuccess     = "success"
+	haSyncDisabled    = "disabled"
+)
+
+// getHaNodeTopology queries the hanode entries of a node: id 0 is the node itself, the other entry is its peer
+func getHaNodeTopology(ctx context.Context, nitroClient *service.NitroClient, n models.BackupNode) (models.NodeTopology, bool, error) {
+	output := models.NodeTopology{Node: n.Name}
+
+	var entries []map[string]interface{}
+	err := runWithContext(ctx, func() error {
+		var err error
+		entries, err = nitroClient.FindAllResources(service.Hanode.Type())
+		return err
+	})
+	if err != nil {
+		return output, false, err
+	}
+
+	hasPeer := false
+	for _, e := range entries {
+		if fmt.Sprint(e["id"]) == "0" {
+			output.State = getResourceValue(e, "state")
+			output.HaStatus = getResourceValue(e, "hastatus")
+			output.Sync = getResourceValue(e, "hasync")
+			continue
+		}
+		hasPeer = true
+		output.PeerState = getResourceValue(e, "state")
+		output.PeerHaStatus = getResourceValue(e, "hastatus")
+		output.PeerSync = getResourceValue(e, "hasync")
+	}
+	if output.State == "" {
+		return output, hasPeer, fmt.Errorf("node %s did not report its HA state", n.Name)
+	}
+	return output, hasPeer, nil
+}
+
+func getResourceValue(entry map[string]interface{}, key string) string {
+	if v, ok := entry[key]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// getHaTopology queries the HA state of every node of a target, and returns the Primary node with the topology.
+// The topology is invalid unless exactly one node is Primary and all reachable nodes are part of the pair.
+// Unreachable peers, peers which are not UP and failed synchronization make the topology degraded.
+func getHaTopology(ctx context.Context, nitroClients map[string]*service.NitroClient, t models.BackupTarget, timeout time.Duration) (models.BackupNode, *models.TopologyReport, error) {
+	topology := &models.TopologyReport{Status: models.TopologyStatusHealthy}
+
+	var reachable []models.BackupNode
+	var primaries []models.BackupNode
+	var invalid, warnings []string
+	var err error
+	for _, n := range t.Nodes {
+		var node models.NodeTopology
+		var hasPeer bool
+		nodeErr := runWithTimeout(ctx, timeout, func(ctx context.Context) error {
+			var err error
+			node, hasPeer, err = getHaNodeTopology(ctx, nitroClients[n.Name], n)
+			return err
+		})
+		if nodeErr != nil {
+			node.Node = n.Name
+			node.Error = nodeErr.Error()
+			topology.Nodes = append(topology.Nodes, node)
+			warnings = append(warnings, fmt.Sprintf("node %s is unreachable", n.Name))
+			err = newStageError(StagePrimary, n.Name, nodeErr)
+			continue
+		}
+		topology.Nodes = append(topology.Nodes, node)
+		reachable = append(reachable, n)
+
+		// A node which left the pair acts as Primary on its own
+		if !hasPeer || strings.EqualFold(node.State, haStateStandalone) {
+			invalid = append(invalid, fmt.Sprintf("node %s is not part of an HA pair", n.Name))
+			primaries = append(primaries, n)
+			continue
+		}
+		if !strings.EqualFold(node.State, haStatePrimary) {
+			continue
+		}
+		primaries = append(primaries, n)
+
+		if !strings.EqualFold(node.PeerHaStatus, haStatusUp) {
+			warnings = append(warnings, fmt.Sprintf("peer of %s is %s", n.Name, getHaStatusDescription(node.PeerHaStatus)))
+		}
+		if strings.EqualFold(node.Sync, haSyncDisabled) {
+			warnings = append(warnings, fmt.Sprintf("HA synchronization is disabled on %s", n.Name))
+		} else if node.PeerSync != "" && !strings.EqualFold(node.PeerSync, haSyncSuccess) {
+			warnings = append(warnings, fmt.Sprintf("HA synchronization from %s is %s", n.Name, node.PeerSync))
+		}
+	}
+
+	if len(reachable) == 0 {
+		topology.Status = models.TopologyStatusInvalid
+		topology.Problems = warnings
+		printHaTopology(t, topology)
+		return models.BackupNode{}, topology, err
+	}
+
+	switch len(primaries) {
+	case 0:
+		invalid = append(invalid, "no node is Primary")
+	case 1:
+	default:
+		var names []string
+		for _, n := range primaries {
+			names = append(names, n.Name)
+		}
+		invalid = append(invalid, fmt.Sprintf("split-brain, nodes %s are all Primary", strings.Join(names, ", ")))
+	}
+
+	topology.Problems = append(invalid, warnings...)
+	if len(invalid) > 0 {
+		topology.Status = models.TopologyStatusInvalid
+	} else if len(warnings) > 0 {
+		topology.Status = models.TopologyStatusDegraded
+	}
+	printHaTopology(t, topology)
+
+	if len(invalid) == 0 {
+		return primaries[0], topology, nil
+	}
+
+	if strings.EqualFold(t.HaPolicy, models.HaPolicyFirstReachable) {
+		fmt.Println("HA topology of", t.Name, "is invalid, backing up from first reachable node", reachable[0].Name)
+		return reachable[0], topology, nil
+	}
+	return models.BackupNode{}, topology, newStageError(StagePrimary, "", fmt.Errorf("HA topology of %s is invalid: %s", t.Name, strings.Join(invalid, "; ")))
+}
+
+func getHaStatusDescription(status string) string {
+	if status == "" {
+		return "unknown"
+	}
+	return status
+}
+
+func printHaTopology(t models.BackupTarget, topology *models.TopologyReport) {
+	var nodes []string
+	for _, n := range topology.Nodes {
+		if n.Error != "" {
+			nodes = append(nodes, fmt.Sprintf("%s unreachable", n.Node))
+			continue
+		}
+		nodes = append(nodes, fmt.Sprintf("%s %s (%s, sync %s)", n.Node, n.State, n.HaStatus, n.Sync))
+	}
+	fmt.Println("HA topology of", t.Name, "is", topology.Status+":", strings.Join(nodes, ", "))
+	for _, p := range topology.Problems {
+		fmt.Println("HA topology of", t.Name, "-", p)
+	}
+}
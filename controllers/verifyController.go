@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/archive"
+	"github.com/jantytgat/citrixadc-backup/encryption"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// storedArchive is a stored file as it was read by VerifyController.readArchive
+type storedArchive struct {
+	Sha256  string
+	Size    int64
+	Content archive.Archive
+	// FormatErr makes the file an invalid archive, it is only set for archives which are not encrypted
+	FormatErr error
+}
+
+type VerifyController struct{}
+
+type VerifyControllerCaller interface {
+	Run(paths []string) ([]models.VerifyResult, error)
+	Write(results []models.VerifyResult, format string, w io.Writer) error
+
+	listTree(root string) ([]string, []string, error)
+	verifyArchive(filename string) models.VerifyResult
+	readManifest(filename string) (*models.Manifest, error)
+	readArchive(filename string) (storedArchive, error)
+	writeTable(results []models.VerifyResult, w io.Writer) error
+}
+
+// Run checks archives against their manifests. A path is an archive, the manifest of an archive, or a directory which is searched for archives.
+// Manifests in a directory of which the archive is gone are reported as missing.
+func (c *VerifyController) Run(paths []string) ([]models.VerifyResult, error) {
+	var output []models.VerifyResult
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return output, err
+		}
+
+		if !info.IsDir() {
+			filename, _ := isManifestFilename(p)
+			output = append(output, c.verifyArchive(filename))
+			continue
+		}
+
+		archives, manifests, err := c.listTree(p)
+		if err != nil {
+			return output, err
+		}
+		found := make(map[string]bool)
+		for _, filename := range archives {
+			found[filename] = true
+			output = append(output, c.verifyArchive(filename))
+		}
+		for _, filename := range manifests {
+			if a, _ := isManifestFilename(filename); !found[a] {
+				output = append(output, models.VerifyResult{File: a, Status: models.VerifyStatusMissing, Detail: "archive of manifest does not exist"})
+			}
+		}
+	}
+
+	sort.SliceStable(output, func(i, j int) bool {
+		return output[i].File < output[j].File
+	})
+	return output, nil
+}
+
+// listTree returns the archives and manifests in a directory and its subdirectories.
+// Spool files, which start with a dot, and exported configurations are skipped.
+func (c *VerifyController) listTree(root string) ([]string, []string, error) {
+	var archives, manifests []string
+	err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		if _, ok := isManifestFilename(filename); ok {
+			manifests = append(manifests, filename)
+		} else if strings.HasSuffix(encryption.TrimExtension(filename), ".tgz") {
+			archives = append(archives, filename)
+		}
+		return nil
+	})
+	return archives, manifests, err
+}
+
+// verifyArchive checks the size and hash of an archive against its manifest, and whether it is still a valid archive.
+// The content of encrypted archives is not checked, their hash covers the encrypted file.
+func (c *VerifyController) verifyArchive(filename string) models.VerifyResult {
+	output := models.VerifyResult{File: filename}
+
+	manifest, err := c.readManifest(filename + models.ManifestExtension)
+	if err != nil {
+		output.Status = models.VerifyStatusInvalid
+		output.Detail = err.Error()
+		return output
+	}
+
+	stored, err := c.readArchive(filename)
+	if os.IsNotExist(err) {
+		output.Status = models.VerifyStatusMissing
+		output.Detail = "archive does not exist"
+		return output
+	}
+	if err != nil {
+		output.Status = models.VerifyStatusCorrupt
+		output.Detail = fmt.Sprintf("could not read archive: %v", err)
+		return output
+	}
+	encrypted := encryption.IsEncrypted(filename)
+
+	if manifest == nil {
+		output.Status = models.VerifyStatusNoManifest
+		switch {
+		case encrypted:
+			output.Detail = "content of encrypted archive was not checked"
+		case stored.FormatErr != nil:
+			output.Status = models.VerifyStatusCorrupt
+			output.Detail = fmt.Sprintf("invalid archive: %v", stored.FormatErr)
+		case len(stored.Content.MissingMembers()) > 0:
+			output.Status = models.VerifyStatusCorrupt
+			output.Detail = "archive has no " + strings.Join(stored.Content.MissingMembers(), ", ")
+		default:
+			output.Detail = "archive is valid"
+		}
+		return output
+	}
+
+	if manifest.Filename != filepath.Base(filename) {
+		output.Status = models.VerifyStatusInvalid
+		output.Detail = fmt.Sprintf("manifest describes %s", manifest.Filename)
+		return output
+	}
+
+	if stored.Size != manifest.Size || stored.Sha256 != manifest.Sha256 {
+		output.Status = models.VerifyStatusModified
+		output.Detail = fmt.Sprintf("sha256 %s and size %d do not match the manifest", stored.Sha256, stored.Size)
+		if stored.FormatErr != nil {
+			output.Status = models.VerifyStatusCorrupt
+			output.Detail += fmt.Sprintf(", invalid archive: %v", stored.FormatErr)
+		}
+		return output
+	}
+
+	if !encrypted {
+		// The hash matches, so a manifest which does not match the content was written for another archive or was altered
+		if stored.FormatErr != nil {
+			output.Status = models.VerifyStatusCorrupt
+			output.Detail = fmt.Sprintf("invalid archive: %v", stored.FormatErr)
+			return output
+		}
+		for _, m := range manifest.Members {
+			e, ok := stored.Content.Entry(m.Name)
+			if ok != m.Present || (ok && m.Sha256 != "" && e.Sha256 != m.Sha256) {
+				output.Status = models.VerifyStatusInvalid
+				output.Detail = fmt.Sprintf("%s does not match the manifest", m.Name)
+				return output
+			}
+		}
+	}
+
+	output.Status = models.VerifyStatusOk
+	return output
+}
+
+// readManifest reads the manifest of an archive. It returns nil when the archive has no manifest.
+func (c *VerifyController) readManifest(filename string) (*models.Manifest, error) {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := parseManifest(content)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", filepath.Base(filename), err)
+	}
+	return &m, nil
+}
+
+// readArchive returns the sha256 hash and size of a file. Unless the file is encrypted, it is read as an archive as well.
+// Only errors of reading the file are returned, an invalid archive is returned in the FormatErr of the output.
+func (c *VerifyController) readArchive(filename string) (storedArchive, error) {
+	var output storedArchive
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return output, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r := io.TeeReader(f, hash)
+	if !encryption.IsEncrypted(filename) {
+		output.Content, err = archive.Read(r, func(name string) bool {
+			return false
+		})
+		if _, ok := err.(*archive.FormatError); ok {
+			output.FormatErr = err
+			err = nil
+		}
+		if err != nil {
+			return output, err
+		}
+	}
+
+	// Read the rest of the file, which follows the archive or was not read because it is encrypted or invalid
+	_, err = io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return output, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return output, err
+	}
+	output.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	output.Size = info.Size()
+	return output, nil
+}
+
+// Write writes the results of a verification as a table, json or yaml
+func (c *VerifyController) Write(results []models.VerifyResult, format string, w io.Writer) error {
+	switch format {
+	case "table":
+		return c.writeTable(results, w)
+	case "json":
+		if results == nil {
+			results = []models.VerifyResult{}
+		}
+		output, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(output, '\n'))
+		return err
+	case "yaml":
+		output, err := yaml.Marshal(results)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(output)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %s", format)
+	}
+}
+
+func (c *VerifyController) writeTable(results []models.VerifyResult, w io.Writer) error {
+	r := ReportController{}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tFILE\tDETAIL")
+	counts := make(map[string]int)
+	problems := 0
+	for _, result := range results {
+		counts[result.Status]++
+		if result.IsProblem() {
+			problems++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Status, result.File, r.summaryValue(result.Detail))
+	}
+	fmt.Fprintf(tw, "\n%d archives: %d ok, %d without manifest, %d failed verification\n",
+		len(results), counts[models.VerifyStatusOk], counts[models.VerifyStatusNoManifest], problems)
+	return tw.Flush()
+}
@@ -8,3 +8,9 @@ func GetSystemBackupCreateData(name string, level string) system.Systembackup {
 		Level:            level,
 	}
 }
+
+func GetSystemBackupRestoreData(name string) system.Systembackup {
+	return system.Systembackup{
+		Filename: name,
+	}
+}
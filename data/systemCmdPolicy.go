@@ -5,28 +5,49 @@ import (
 	"strings"
 )
 
-var cmdPolicyHaNodeGet = "(^show\\s+ha\\s+node\\s+0)"
+var cmdPolicyHaNodeGet = "(^show\\s+ha\\s+node)"
+var cmdPolicyClusterGet = "(^show\\s+cluster\\s+(instance|node))"
 var cmdPolicySystemBackupGet = "(^show\\s+system\\s+backup\\s+\\d{8}_\\d{6})"
 var cmdPolicySystemBackupCreate = "(^create\\s+system\\s+backup\\s+\\d{8}_\\d{6})"
 var cmdPolicySystemBackupDelete = "(^rm\\s+system\\s+backup\\s+\\d{8}_\\d{6}\\.tgz)"
 var cmdPolicySystemFileDownload = "(^show\\s+system\\s+file\\s+\\d{8}_\\d{6}\\.tgz\\s+-fileLocation\\s+\"/var/ns_sys_backup\")"
+var cmdPolicyRunningConfigGet = "(^show\\s+ns\\s+runningConfig)"
+var cmdPolicySavedConfigGet = "(^show\\s+ns\\s+savedConfig)"
+var cmdPolicyNsConfigGet = "(^show\\s+ns\\s+config)"
+var cmdPolicyNsConfDownload = "(^show\\s+system\\s+file\\s+ns\\.conf\\s+-fileLocation\\s+\"/nsconfig\")"
 
-func getSystemCmdPolicySpecification() string {
+// Only added to the command policy when restore is explicitly allowed
+var cmdPolicySystemFileUpload = "(^add\\s+system\\s+file\\s+\\d{8}_\\d{6}\\.tgz\\s+-fileLocation\\s+\"/var/ns_sys_backup\")"
+var cmdPolicySystemBackupRestore = "(^restore\\s+system\\s+backup\\s+\\d{8}_\\d{6}\\.tgz)"
+
+func getSystemCmdPolicySpecification(allowRestore bool) string {
 	cmdPolicies := []string{
 		cmdPolicyHaNodeGet,
+		cmdPolicyClusterGet,
 		cmdPolicySystemBackupGet,
 		cmdPolicySystemBackupCreate,
 		cmdPolicySystemBackupDelete,
 		cmdPolicySystemFileDownload,
+		cmdPolicyRunningConfigGet,
+		cmdPolicySavedConfigGet,
+		cmdPolicyNsConfDownload,
+		cmdPolicyNsConfigGet,
+	}
+
+	if allowRestore {
+		cmdPolicies = append(cmdPolicies,
+			cmdPolicySystemFileUpload,
+			cmdPolicySystemBackupRestore,
+		)
 	}
 
 	return strings.Join(cmdPolicies, "|")
 }
 
-func GetSystemCmdPolicyCreateData(name string) system.Systemcmdpolicy {
+func GetSystemCmdPolicyCreateData(name string, allowRestore bool) system.Systemcmdpolicy {
 	return system.Systemcmdpolicy{
 		Policyname: name,
 		Action:     "ALLOW",
-		Cmdspec:    getSystemCmdPolicySpecification(),
+		Cmdspec:    getSystemCmdPolicySpecification(allowRestore),
 	}
 }
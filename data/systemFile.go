@@ -0,0 +1,12 @@
+package data
+
+import "github.com/citrix/adc-nitro-go/resource/config/system"
+
+func GetSystemFileCreateData(name string, location string, content string) system.Systemfile {
+	return system.Systemfile{
+		Filename:     name,
+		Filelocation: location,
+		Filecontent:  content,
+		Fileencoding: "BASE64",
+	}
+}
@@ -0,0 +1,213 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The aes format splits the archive in chunks which are sealed separately with AES-256-GCM, so archives are never held in memory as a whole.
+// The header consists of aesMagic and a random nonce prefix. The nonce of each chunk is the prefix, the chunk counter and a flag marking the last chunk,
+// so chunks cannot be reordered, dropped or truncated without failing authentication.
+const (
+	aesMagic           = "CADCBAK1"
+	aesKeySize         = 32
+	aesNoncePrefixSize = 7
+	aesChunkSize       = 64 * 1024
+)
+
+type aesEncrypter struct {
+	aead cipher.AEAD
+}
+
+func newAesEncrypter(keyFile string) (*aesEncrypter, error) {
+	aead, err := readAesKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &aesEncrypter{aead: aead}, nil
+}
+
+func (e *aesEncrypter) Extension() string {
+	return ".enc"
+}
+
+func (e *aesEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	header := make([]byte, len(aesMagic)+aesNoncePrefixSize)
+	copy(header, aesMagic)
+	if _, err := rand.Read(header[len(aesMagic):]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:      w,
+		aead:   e.aead,
+		header: header,
+	}, nil
+}
+
+// readAesKey reads a 256-bit key from keyFile, stored as raw bytes, hex or base64
+func readAesKey(keyFile string) (cipher.AEAD, error) {
+	if keyFile == "" {
+		return nil, errors.New("aes encryption needs a key file")
+	}
+
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := content
+	if len(key) != aesKeySize {
+		trimmed := string(bytes.TrimSpace(content))
+		if decoded, err := hex.DecodeString(trimmed); err == nil {
+			key = decoded
+		} else if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil {
+			key = decoded
+		}
+	}
+	if len(key) != aesKeySize {
+		return nil, fmt.Errorf("key file %s does not contain a 256-bit key", keyFile)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aesNonce(header []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[len(aesMagic):])
+	binary.BigEndian.PutUint32(nonce[aesNoncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type aesWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buffer  []byte
+	counter uint32
+	closed  bool
+}
+
+// Write only seals a chunk when more data follows, so Close always seals the last chunk, which may be empty
+func (a *aesWriter) Write(p []byte) (int, error) {
+	if a.closed {
+		return 0, errors.New("write to closed writer")
+	}
+
+	a.buffer = append(a.buffer, p...)
+	for len(a.buffer) > aesChunkSize {
+		if err := a.seal(a.buffer[:aesChunkSize], false); err != nil {
+			return 0, err
+		}
+		a.buffer = a.buffer[aesChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (a *aesWriter) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.seal(a.buffer, true)
+}
+
+func (a *aesWriter) seal(chunk []byte, last bool) error {
+	if a.counter == ^uint32(0) {
+		return errors.New("archive is too large to encrypt")
+	}
+	_, err := a.w.Write(a.aead.Seal(nil, aesNonce(a.header, a.counter, last), chunk, a.header))
+	a.counter++
+	return err
+}
+
+func decryptAes(r io.Reader, keyFile string) (io.Reader, error) {
+	aead, err := readAesKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(aesMagic)+aesNoncePrefixSize)
+	if _, err = io.ReadFull(r, header); err != nil || string(header[:len(aesMagic)]) != aesMagic {
+		return nil, errors.New("not an aes encrypted archive")
+	}
+
+	return &aesReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		header: header,
+		chunk:  make([]byte, aesChunkSize+aead.Overhead()),
+	}, nil
+}
+
+type aesReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	chunk   []byte
+	buffer  []byte
+	counter uint32
+	done    bool
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	for len(a.buffer) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		if err := a.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, a.buffer)
+	a.buffer = a.buffer[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk. A chunk is the last one when it is short or nothing follows it.
+func (a *aesReader) open() error {
+	n, err := io.ReadFull(a.r, a.chunk)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err = a.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plaintext, err := a.aead.Open(nil, aesNonce(a.header, a.counter, last), a.chunk[:n], a.header)
+	if err != nil {
+		return errors.New("archive is corrupt or was encrypted with another key")
+	}
+	a.counter++
+	a.buffer = plaintext
+	a.done = last
+	return nil
+}
@@ -0,0 +1,70 @@
+package encryption
+
+import (
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"io"
+	"os"
+)
+
+type ageEncrypter struct {
+	recipients []age.Recipient
+}
+
+func newAgeEncrypter(recipients []string, recipientsFile string) (*ageEncrypter, error) {
+	e := &ageEncrypter{}
+
+	for _, r := range recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %s: %v", r, err)
+		}
+		e.recipients = append(e.recipients, recipient)
+	}
+
+	if recipientsFile != "" {
+		f, err := os.Open(recipientsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		fileRecipients, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipients file %s: %v", recipientsFile, err)
+		}
+		e.recipients = append(e.recipients, fileRecipients...)
+	}
+
+	if len(e.recipients) == 0 {
+		return nil, errors.New("age encryption needs at least one recipient")
+	}
+	return e, nil
+}
+
+func (e *ageEncrypter) Extension() string {
+	return ".age"
+}
+
+func (e *ageEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return age.Encrypt(w, e.recipients...)
+}
+
+func decryptAge(r io.Reader, identityFile string) (io.Reader, error) {
+	if identityFile == "" {
+		return nil, errors.New("an age identity file is needed to decrypt")
+	}
+
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity file %s: %v", identityFile, err)
+	}
+	return age.Decrypt(r, identities...)
+}
@@ -0,0 +1,90 @@
+package encryption
+
+import (
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	TypeAge = "age"
+	TypePgp = "pgp"
+	TypeAes = "aes"
+)
+
+// Encrypter encrypts archives before they are stored
+type Encrypter interface {
+	// Extension is appended to the filename of the archive
+	Extension() string
+	// Encrypt returns a writer which encrypts to w. The writer must be closed to flush the encrypted output.
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+}
+
+// DecryptOptions holds the keys used to decrypt an archive, depending on how it was encrypted
+type DecryptOptions struct {
+	IdentityFile  string
+	SecretKeyFile string
+	KeyFile       string
+}
+
+var extensions = map[string]string{
+	".age": TypeAge,
+	".gpg": TypePgp,
+	".enc": TypeAes,
+}
+
+// NewEncrypter returns the Encrypter for the settings, or nil when encryption is not enabled
+func NewEncrypter(s models.EncryptionSettings) (Encrypter, error) {
+	switch s.Type {
+	case "":
+		return nil, nil
+	case TypeAge:
+		return newAgeEncrypter(s.Recipients, s.RecipientsFile)
+	case TypePgp:
+		return newPgpEncrypter(s.PublicKeyFile)
+	case TypeAes:
+		return newAesEncrypter(s.KeyFile)
+	default:
+		return nil, fmt.Errorf("unknown encryption type %s", s.Type)
+	}
+}
+
+// Extensions returns the extensions of encrypted archives
+func Extensions() []string {
+	var output []string
+	for e := range extensions {
+		output = append(output, e)
+	}
+	return output
+}
+
+// IsEncrypted reports whether the extension of filename is one of the encrypted archive extensions
+func IsEncrypted(filename string) bool {
+	_, ok := extensions[filepath.Ext(filename)]
+	return ok
+}
+
+// TrimExtension returns filename without its encrypted archive extension
+func TrimExtension(filename string) string {
+	if IsEncrypted(filename) {
+		return strings.TrimSuffix(filename, filepath.Ext(filename))
+	}
+	return filename
+}
+
+// Decrypt returns a reader with the decrypted content of r, based on the extension of filename.
+// Authentication errors are returned by the reader, so the content must be read completely before it can be trusted.
+func Decrypt(filename string, r io.Reader, o DecryptOptions) (io.Reader, error) {
+	switch extensions[filepath.Ext(filename)] {
+	case TypeAge:
+		return decryptAge(r, o.IdentityFile)
+	case TypePgp:
+		return decryptPgp(r, o.SecretKeyFile)
+	case TypeAes:
+		return decryptAes(r, o.KeyFile)
+	default:
+		return nil, fmt.Errorf("%s is not an encrypted archive", filename)
+	}
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"io"
+	"os"
+)
+
+// PgpPassphraseEnvironmentVariable holds the passphrase of the OpenPGP secret key for unattended decryption
+const PgpPassphraseEnvironmentVariable = "CITRIXADC_BACKUP_PGP_PASSPHRASE"
+
+type pgpEncrypter struct {
+	recipients openpgp.EntityList
+}
+
+func newPgpEncrypter(publicKeyFile string) (*pgpEncrypter, error) {
+	if publicKeyFile == "" {
+		return nil, errors.New("pgp encryption needs a public key file")
+	}
+
+	recipients, err := readKeyRing(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &pgpEncrypter{recipients: recipients}, nil
+}
+
+func (e *pgpEncrypter) Extension() string {
+	return ".gpg"
+}
+
+func (e *pgpEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return openpgp.Encrypt(w, e.recipients, nil, &openpgp.FileHints{IsBinary: true}, nil)
+}
+
+// readKeyRing reads an armored or binary OpenPGP key ring
+func readKeyRing(filename string) (openpgp.EntityList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if block, err := armor.Decode(f); err == nil {
+		r = block.Body
+	} else if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	keyRing, err := openpgp.ReadKeyRing(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP key file %s: %v", filename, err)
+	}
+	return keyRing, nil
+}
+
+func decryptPgp(r io.Reader, secretKeyFile string) (io.Reader, error) {
+	if secretKeyFile == "" {
+		return nil, errors.New("an OpenPGP secret key file is needed to decrypt")
+	}
+
+	keyRing, err := readKeyRing(secretKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted || symmetric {
+			return nil, errors.New("could not decrypt the OpenPGP secret key")
+		}
+		prompted = true
+
+		passphrase, ok := os.LookupEnv(PgpPassphraseEnvironmentVariable)
+		if !ok {
+			passphrase, err = secrets.ReadSecret("OpenPGP key passphrase: ")
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, k := range keys {
+			if k.PrivateKey != nil && k.PrivateKey.Encrypted {
+				if err := k.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(r, keyRing, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return md.UnverifiedBody, nil
+}
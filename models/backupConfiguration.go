@@ -1,6 +1,6 @@
 package models
 
 type BackupConfiguration struct {
-	Targets  []BackupTarget `yaml: targets`
-	Settings BackupSettings `yaml: settings`
+	Targets  []BackupTarget `yaml:"targets"`
+	Settings BackupSettings `yaml:"settings"`
 }
@@ -1,6 +1,6 @@
 package models
 
 type BackupNode struct {
-	Name    string `yaml: name`
-	Address string `yaml: address`
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
 }
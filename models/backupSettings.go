@@ -1,7 +1,24 @@
 package models
 
 type BackupSettings struct {
-	OutputBasePath  string `yaml: outputbasepath`
-	FolderPerTarget bool   `yaml: folderpertarget`
-	Interval        int    `yaml: interval`
+	OutputBasePath       string                  `yaml:"outputbasepath"`
+	FolderPerTarget      bool                    `yaml:"folderpertarget"`
+	Interval             int                     `yaml:"interval"`
+	Schedule             string                  `yaml:"schedule"`
+	Retention            RetentionSettings       `yaml:"retention"`
+	Metrics              MetricsSettings         `yaml:"metrics"`
+	Encryption           EncryptionSettings      `yaml:"encryption"`
+	Destinations         []DestinationSettings   `yaml:"destinations"`
+	MaxConcurrentTargets int                     `yaml:"maxconcurrenttargets"`
+	MaxConcurrentPerNode int                     `yaml:"maxconcurrentpernode"`
+	Sequences            [][]string              `yaml:"sequences"`
+	TempPath             string                  `yaml:"temppath"`
+	KeystorePath         string                  `yaml:"keystorepath"`
+	CatalogPath          string                  `yaml:"catalogpath"`
+	Deduplicate          bool                    `yaml:"deduplicate"`
+	Retry                RetrySettings           `yaml:"retry"`
+	Timeouts             TimeoutSettings         `yaml:"timeouts"`
+	History              HistorySettings         `yaml:"history"`
+	ChangeDetection      ChangeDetectionSettings `yaml:"changedetection"`
+	Notifications        NotificationSettings    `yaml:"notifications"`
 }
@@ -1,12 +1,39 @@
 package models
 
+const (
+	TargetTypeStandalone = "standalone"
+	TargetTypeHaPair     = "hapair"
+	TargetTypeCluster    = "cluster"
+)
+
+const (
+	ConfigRunning = "running"
+	ConfigSaved   = "saved"
+)
+
+const (
+	HaPolicyFail           = "fail"
+	HaPolicyFirstReachable = "first-reachable"
+)
+
 type BackupTarget struct {
-	Name                string       `yaml: name`
-	Type                string       `yaml: type`
-	Level               string       `yaml: level`
-	Nodes               []BackupNode `yaml: nodes`
-	UseSsl              bool         `yaml: usessl`
-	ValidateCertificate bool         `yaml: validatecertificate`
-	Username            string       `yaml: username`
-	Password            string       `yaml: password`
+	Name                string                   `yaml:"name"`
+	Type                string                   `yaml:"type"`
+	Level               string                   `yaml:"level"`
+	Nodes               []BackupNode             `yaml:"nodes"`
+	ClusterAddress      string                   `yaml:"clusteraddress"`
+	UseSsl              bool                     `yaml:"usessl"`
+	ValidateCertificate bool                     `yaml:"validatecertificate"`
+	Username            string                   `yaml:"username"`
+	Password            string                   `yaml:"password"`
+	Retention           *RetentionSettings       `yaml:"retention"`
+	Schedule            string                   `yaml:"schedule"`
+	Destinations        []string                 `yaml:"destinations"`
+	Retry               *RetrySettings           `yaml:"retry"`
+	Timeouts            *TimeoutSettings         `yaml:"timeouts"`
+	HaPolicy            string                   `yaml:"hapolicy"`
+	ExportConfig        []string                 `yaml:"exportconfig"`
+	ConfigOnly          bool                     `yaml:"configonly"`
+	Tags                []string                 `yaml:"tags"`
+	ChangeDetection     *ChangeDetectionSettings `yaml:"changedetection"`
 }
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+const (
+	ChangeDetectionConfigHash = "confighash"
+	ChangeDetectionSavedTime  = "savedtime"
+)
+
+// ChangeDetectionSettings skip the backup of a target when its configuration did not change since its last backup.
+// MaxAge forces a backup when the last backup of a node is older, even when nothing changed.
+type ChangeDetectionSettings struct {
+	Enabled bool          `yaml:"enabled"`
+	Method  string        `yaml:"method"`
+	MaxAge  time.Duration `yaml:"maxage"`
+}
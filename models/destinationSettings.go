@@ -0,0 +1,21 @@
+package models
+
+type DestinationSettings struct {
+	Name                  string `yaml:"name"`
+	Type                  string `yaml:"type"`
+	Path                  string `yaml:"path"`
+	Url                   string `yaml:"url"`
+	Endpoint              string `yaml:"endpoint"`
+	Bucket                string `yaml:"bucket"`
+	Region                string `yaml:"region"`
+	UseSsl                bool   `yaml:"usessl"`
+	AccessKey             string `yaml:"accesskey"`
+	SecretKey             string `yaml:"secretkey"`
+	Address               string `yaml:"address"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	PrivateKeyFile        string `yaml:"privatekeyfile"`
+	KnownHostsFile        string `yaml:"knownhostsfile"`
+	InsecureIgnoreHostKey bool   `yaml:"insecureignorehostkey"`
+	InsecureSkipVerify    bool   `yaml:"insecureskipverify"`
+}
@@ -0,0 +1,9 @@
+package models
+
+type EncryptionSettings struct {
+	Type           string   `yaml:"type"`
+	Recipients     []string `yaml:"recipients"`
+	RecipientsFile string   `yaml:"recipientsfile"`
+	PublicKeyFile  string   `yaml:"publickeyfile"`
+	KeyFile        string   `yaml:"keyfile"`
+}
@@ -0,0 +1,20 @@
+package models
+
+// HistorySettings configure the git repository which keeps the history of the configuration of every node
+type HistorySettings struct {
+	Path                  string `yaml:"path"`
+	Branch                string `yaml:"branch"`
+	Remote                string `yaml:"remote"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	PrivateKeyFile        string `yaml:"privatekeyfile"`
+	KnownHostsFile        string `yaml:"knownhostsfile"`
+	InsecureIgnoreHostKey bool   `yaml:"insecureignorehostkey"`
+	AuthorName            string `yaml:"authorname"`
+	AuthorEmail           string `yaml:"authoremail"`
+}
+
+// IsEnabled reports whether a history repository is configured
+func (h HistorySettings) IsEnabled() bool {
+	return h.Path != ""
+}
@@ -0,0 +1,67 @@
+package models
+
+import "time"
+
+// ManifestExtension is appended to the filename of an archive to get the filename of its manifest
+const ManifestExtension = ".manifest.json"
+
+// ManifestFormat is the version of the layout of a manifest
+const ManifestFormat = 1
+
+const (
+	VerifyStatusOk         = "ok"
+	VerifyStatusModified   = "modified"
+	VerifyStatusCorrupt    = "corrupt"
+	VerifyStatusMissing    = "missing"
+	VerifyStatusNoManifest = "no manifest"
+	VerifyStatusInvalid    = "invalid manifest"
+)
+
+// ToolVersion is the version of citrixadc-backup which is written to manifests.
+// It is set at build time with -ldflags "-X github.com/jantytgat/citrixadc-backup/models.ToolVersion=<version>".
+var ToolVersion = "dev"
+
+// Manifest describes a stored archive, so it can be verified later on.
+// Size and Sha256 are those of the stored file, which is encrypted when Encryption is set.
+type Manifest struct {
+	Format           int              `json:"format"`
+	Filename         string           `json:"filename"`
+	Target           string           `json:"target"`
+	Node             string           `json:"node"`
+	Timestamp        string           `json:"timestamp"`
+	Created          time.Time        `json:"created"`
+	ToolVersion      string           `json:"tool_version"`
+	Size             int64            `json:"size"`
+	Sha256           string           `json:"sha256"`
+	Encryption       string           `json:"encryption,omitempty"`
+	GzipValid        bool             `json:"gzip_valid"`
+	TarValid         bool             `json:"tar_valid"`
+	Members          []ManifestMember `json:"members"`
+	FileCount        int              `json:"file_count"`
+	UncompressedSize int64            `json:"uncompressed_size"`
+	Hostname         string           `json:"hostname,omitempty"`
+	Firmware         string           `json:"firmware,omitempty"`
+	HaState          string           `json:"ha_state,omitempty"`
+	Level            string           `json:"level"`
+	ConfigState      string           `json:"config_state,omitempty"`
+	Cluster          *ClusterReport   `json:"cluster,omitempty"`
+}
+
+// ManifestMember is a file which every archive is expected to hold
+type ManifestMember struct {
+	Name    string `json:"name"`
+	Present bool   `json:"present"`
+	Sha256  string `json:"sha256,omitempty"`
+}
+
+// VerifyResult is the outcome of checking a stored archive against its manifest
+type VerifyResult struct {
+	File   string `json:"file" yaml:"file"`
+	Status string `json:"status" yaml:"status"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
+}
+
+// IsProblem reports whether the archive failed verification. Archives without a manifest are reported, but are not a problem.
+func (r VerifyResult) IsProblem() bool {
+	return r.Status != VerifyStatusOk && r.Status != VerifyStatusNoManifest
+}
@@ -0,0 +1,6 @@
+package models
+
+type MetricsSettings struct {
+	ListenAddress string `yaml:"listenaddress"`
+	TextfilePath  string `yaml:"textfilepath"`
+}
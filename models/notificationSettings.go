@@ -0,0 +1,34 @@
+package models
+
+const (
+	NotifyOnFailure  = "failure"
+	NotifyOnRecovery = "recovery"
+	NotifyOnAlways   = "always"
+)
+
+// NotificationSettings configure the channels which are notified of the outcome of backup runs.
+// StatePath keeps the last status of every target, to detect recoveries.
+type NotificationSettings struct {
+	StatePath string                `yaml:"statepath"`
+	Channels  []NotificationChannel `yaml:"channels"`
+}
+
+// NotificationChannel sends notifications by mail or to a webhook.
+// A channel is notified of the targets which have any of its Tags, or of every target when it has no Tags.
+type NotificationChannel struct {
+	Name               string   `yaml:"name"`
+	Type               string   `yaml:"type"`
+	Events             []string `yaml:"events"`
+	Tags               []string `yaml:"tags"`
+	Subject            string   `yaml:"subject"`
+	Template           string   `yaml:"template"`
+	Address            string   `yaml:"address"`
+	StartTls           bool     `yaml:"starttls"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	From               string   `yaml:"from"`
+	To                 []string `yaml:"to"`
+	Url                string   `yaml:"url"`
+	Secret             string   `yaml:"secret"`
+	InsecureSkipVerify bool     `yaml:"insecureskipverify"`
+}
@@ -0,0 +1,21 @@
+package models
+
+type RetentionSettings struct {
+	KeepLast    int `yaml:"keeplast"`
+	KeepDaily   int `yaml:"keepdaily"`
+	KeepWeekly  int `yaml:"keepweekly"`
+	KeepMonthly int `yaml:"keepmonthly"`
+	KeepYearly  int `yaml:"keepyearly"`
+	MaxAgeDays  int `yaml:"maxagedays"`
+}
+
+// IsEnabled reports whether any retention rule is configured.
+// Without rules, archives are kept forever.
+func (r RetentionSettings) IsEnabled() bool {
+	return r.HasKeepRules() || r.MaxAgeDays > 0
+}
+
+// HasKeepRules reports whether at least one of the keep rules is configured.
+func (r RetentionSettings) HasKeepRules() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 || r.KeepMonthly > 0 || r.KeepYearly > 0
+}
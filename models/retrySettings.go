@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+const (
+	RetryOnNetwork = "network"
+	RetryOnServer  = "server"
+	RetryOnBusy    = "busy"
+)
+
+// RetryPolicy configures how often and how fast a failed operation is attempted again.
+// Fields which are not set are inherited from the less specific policy.
+type RetryPolicy struct {
+	MaxAttempts int           `yaml:"maxattempts"`
+	BaseDelay   time.Duration `yaml:"basedelay"`
+	MaxDelay    time.Duration `yaml:"maxdelay"`
+	Jitter      float64       `yaml:"jitter"`
+	RetryOn     []string      `yaml:"retryon"`
+	ErrorCodes  []int         `yaml:"errorcodes"`
+}
+
+// RetrySettings holds the retry policy for all operations, and the policies which override it for create, download and delete
+type RetrySettings struct {
+	RetryPolicy `yaml:",inline" mapstructure:",squash"`
+	Create      RetryPolicy `yaml:"create"`
+	Download    RetryPolicy `yaml:"download"`
+	Delete      RetryPolicy `yaml:"delete"`
+}
+
+// Merge returns the policy with the fields which are set in override replaced
+func (p RetryPolicy) Merge(override RetryPolicy) RetryPolicy {
+	if override.MaxAttempts > 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	if override.BaseDelay > 0 {
+		p.BaseDelay = override.BaseDelay
+	}
+	if override.MaxDelay > 0 {
+		p.MaxDelay = override.MaxDelay
+	}
+	if override.Jitter > 0 {
+		p.Jitter = override.Jitter
+	}
+	if len(override.RetryOn) > 0 {
+		p.RetryOn = override.RetryOn
+	}
+	if len(override.ErrorCodes) > 0 {
+		p.ErrorCodes = override.ErrorCodes
+	}
+	return p
+}
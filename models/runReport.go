@@ -0,0 +1,138 @@
+package models
+
+import "time"
+
+const (
+	ReportStatusSuccess = "success"
+	ReportStatusPartial = "partial"
+	ReportStatusFailed  = "failed"
+	ReportStatusSkipped = "skipped"
+)
+
+const (
+	TopologyStatusHealthy  = "healthy"
+	TopologyStatusDegraded = "degraded"
+	TopologyStatusInvalid  = "invalid"
+)
+
+type RunReport struct {
+	Start           time.Time      `json:"start" yaml:"start"`
+	End             time.Time      `json:"end" yaml:"end"`
+	DurationSeconds float64        `json:"duration_seconds" yaml:"duration_seconds"`
+	Status          string         `json:"status" yaml:"status"`
+	Targets         []TargetReport `json:"targets" yaml:"targets"`
+}
+
+type TargetReport struct {
+	Target          string          `json:"target" yaml:"target"`
+	Type            string          `json:"type" yaml:"type"`
+	PrimaryNode     string          `json:"primary_node,omitempty" yaml:"primary_node,omitempty"`
+	Topology        *TopologyReport `json:"topology,omitempty" yaml:"topology,omitempty"`
+	Cluster         *ClusterReport  `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	History         *HistoryReport  `json:"history,omitempty" yaml:"history,omitempty"`
+	Status          string          `json:"status" yaml:"status"`
+	DurationSeconds float64         `json:"duration_seconds" yaml:"duration_seconds"`
+	Retries         int             `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Stage           string          `json:"stage,omitempty" yaml:"stage,omitempty"`
+	Error           string          `json:"error,omitempty" yaml:"error,omitempty"`
+	ErrorCode       int             `json:"error_code,omitempty" yaml:"error_code,omitempty"`
+	SkipReason      string          `json:"skip_reason,omitempty" yaml:"skip_reason,omitempty"`
+	Nodes           []NodeReport    `json:"nodes" yaml:"nodes"`
+}
+
+// TopologyReport is the HA state of a target as reported by its nodes.
+// A degraded topology has warnings, an invalid topology has no single Primary node.
+type TopologyReport struct {
+	Status   string         `json:"status" yaml:"status"`
+	Problems []string       `json:"problems,omitempty" yaml:"problems,omitempty"`
+	Nodes    []NodeTopology `json:"nodes" yaml:"nodes"`
+}
+
+type NodeTopology struct {
+	Node         string `json:"node" yaml:"node"`
+	State        string `json:"state,omitempty" yaml:"state,omitempty"`
+	HaStatus     string `json:"ha_status,omitempty" yaml:"ha_status,omitempty"`
+	Sync         string `json:"sync,omitempty" yaml:"sync,omitempty"`
+	PeerState    string `json:"peer_state,omitempty" yaml:"peer_state,omitempty"`
+	PeerHaStatus string `json:"peer_ha_status,omitempty" yaml:"peer_ha_status,omitempty"`
+	PeerSync     string `json:"peer_sync,omitempty" yaml:"peer_sync,omitempty"`
+	Error        string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ClusterReport is the state of a cluster and its members at the time of the backup
+type ClusterReport struct {
+	Status      string          `json:"status" yaml:"status"`
+	Coordinator string          `json:"coordinator" yaml:"coordinator"`
+	Problems    []string        `json:"problems,omitempty" yaml:"problems,omitempty"`
+	Members     []ClusterMember `json:"members" yaml:"members"`
+}
+
+type ClusterMember struct {
+	Node        string `json:"node" yaml:"node"`
+	NodeId      string `json:"node_id" yaml:"node_id"`
+	Address     string `json:"address" yaml:"address"`
+	State       string `json:"state,omitempty" yaml:"state,omitempty"`
+	Health      string `json:"health,omitempty" yaml:"health,omitempty"`
+	MasterState string `json:"master_state,omitempty" yaml:"master_state,omitempty"`
+	Coordinator bool   `json:"coordinator" yaml:"coordinator"`
+}
+
+// HistoryReport is the result of committing the configuration of a target to the history repository
+type HistoryReport struct {
+	Changed bool   `json:"changed" yaml:"changed"`
+	Commit  string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	Pushed  bool   `json:"pushed" yaml:"pushed"`
+	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type NodeReport struct {
+	Node            string         `json:"node" yaml:"node"`
+	Primary         bool           `json:"primary" yaml:"primary"`
+	HaState         string         `json:"ha_state,omitempty" yaml:"ha_state,omitempty"`
+	Hostname        string         `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Firmware        string         `json:"firmware,omitempty" yaml:"firmware,omitempty"`
+	Filename        string         `json:"filename,omitempty" yaml:"filename,omitempty"`
+	Locations       []string       `json:"locations,omitempty" yaml:"locations,omitempty"`
+	Size            int64          `json:"size" yaml:"size"`
+	Sha256          string         `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	Manifest        string         `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+	ConfigState     string         `json:"config_state,omitempty" yaml:"config_state,omitempty"`
+	Configs         []ConfigReport `json:"configs,omitempty" yaml:"configs,omitempty"`
+	DurationSeconds float64        `json:"duration_seconds" yaml:"duration_seconds"`
+	Retries         int            `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Status          string         `json:"status" yaml:"status"`
+	Stage           string         `json:"stage,omitempty" yaml:"stage,omitempty"`
+	Error           string         `json:"error,omitempty" yaml:"error,omitempty"`
+	ErrorCode       int            `json:"error_code,omitempty" yaml:"error_code,omitempty"`
+}
+
+// ConfigReport is a configuration which was exported as text next to the system backup of a node
+type ConfigReport struct {
+	Config    string   `json:"config" yaml:"config"`
+	Filename  string   `json:"filename" yaml:"filename"`
+	Locations []string `json:"locations,omitempty" yaml:"locations,omitempty"`
+	Size      int64    `json:"size" yaml:"size"`
+	Sha256    string   `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+}
+
+// FailedTargets returns the number of targets which did not complete successfully. Skipped targets did not fail.
+func (r RunReport) FailedTargets() int {
+	var output int
+	for _, t := range r.Targets {
+		if t.Status != ReportStatusSuccess && t.Status != ReportStatusSkipped {
+			output++
+		}
+	}
+	return output
+}
+
+// SkippedTargets returns the number of targets which were skipped because their configuration did not change
+func (r RunReport) SkippedTargets() int {
+	var output int
+	for _, t := range r.Targets {
+		if t.Status == ReportStatusSkipped {
+			output++
+		}
+	}
+	return output
+}
@@ -6,4 +6,5 @@ type SetupTarget struct {
 	Password string
 
 	CmdPolicyName string
+	AllowRestore  bool
 }
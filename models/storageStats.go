@@ -0,0 +1,27 @@
+package models
+
+// StorageStats is the space taken by stored archives on a destination.
+// LogicalBytes is the sum of the sizes of the stored files, PhysicalBytes counts files which are links to the same file once.
+// The stats of a destination have no target, and count files which are shared by targets once.
+type StorageStats struct {
+	Target        string `json:"target,omitempty" yaml:"target,omitempty"`
+	Destination   string `json:"destination" yaml:"destination"`
+	Deduplicated  bool   `json:"deduplicated" yaml:"deduplicated"`
+	Archives      int    `json:"archives" yaml:"archives"`
+	Files         int    `json:"files" yaml:"files"`
+	LogicalBytes  int64  `json:"logical_bytes" yaml:"logical_bytes"`
+	PhysicalBytes int64  `json:"physical_bytes" yaml:"physical_bytes"`
+}
+
+// SavedBytes returns the number of bytes saved by deduplication
+func (s StorageStats) SavedBytes() int64 {
+	return s.LogicalBytes - s.PhysicalBytes
+}
+
+// StatsReport is the space taken by the archives of every target, with the totals per destination.
+// Warnings explain why the archives take more space than expected, such as when deduplication has no effect.
+type StatsReport struct {
+	Targets      []StorageStats `json:"targets" yaml:"targets"`
+	Destinations []StorageStats `json:"destinations" yaml:"destinations"`
+	Warnings     []string       `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
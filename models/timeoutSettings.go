@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// TimeoutSettings limits how long operations, targets and runs may take. A timeout of 0 is not set.
+type TimeoutSettings struct {
+	Connect  time.Duration `yaml:"connect"`
+	Create   time.Duration `yaml:"create"`
+	Download time.Duration `yaml:"download"`
+	Delete   time.Duration `yaml:"delete"`
+	Target   time.Duration `yaml:"target"`
+	Run      time.Duration `yaml:"run"`
+}
+
+// Merge returns the timeouts with the ones which are set in override replaced
+func (t TimeoutSettings) Merge(override TimeoutSettings) TimeoutSettings {
+	if override.Connect > 0 {
+		t.Connect = override.Connect
+	}
+	if override.Create > 0 {
+		t.Create = override.Create
+	}
+	if override.Download > 0 {
+		t.Download = override.Download
+	}
+	if override.Delete > 0 {
+		t.Delete = override.Delete
+	}
+	if override.Target > 0 {
+		t.Target = override.Target
+	}
+	if override.Run > 0 {
+		t.Run = override.Run
+	}
+	return t
+}
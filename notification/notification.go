@@ -0,0 +1,248 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	TypeSmtp    = "smtp"
+	TypeWebhook = "webhook"
+	TypeSlack   = "slack"
+	TypeTeams   = "teams"
+)
+
+// Events of a message, from the most to the least important
+const (
+	EventFailure  = "failure"
+	EventRecovery = "recovery"
+	EventSuccess  = "success"
+	EventTest     = "test"
+)
+
+const defaultSubject = `[citrixadc-backup] {{.Event}}: {{.Summary}}`
+
+const defaultTemplate = `{{.Summary}} on {{.Host}}, {{.End.Format "2006-01-02 15:04:05 MST"}}
+{{range .Targets}}
+{{.Target}}: {{.Status}}{{if .Recovered}}, recovered from {{.PreviousStatus}}{{end}}
+{{- if .Error}}
+  {{.Stage}}: {{.Error}}
+{{- end}}
+{{- if .SkipReason}}
+  {{.SkipReason}}
+{{- end}}
+{{- range .Nodes}}
+  {{.Node}}: {{.Status}}{{if .Filename}}, {{.Filename}}{{end}}{{if .Error}}, {{.Error}}{{end}}
+{{- end}}
+{{end}}`
+
+// Target is the outcome of a target in a run, with its previous status
+type Target struct {
+	models.TargetReport
+	Tags           []string `json:"tags,omitempty"`
+	PreviousStatus string   `json:"previous_status,omitempty"`
+	Recovered      bool     `json:"recovered"`
+}
+
+// Message is the outcome of a run for the targets which are routed to a channel.
+// Subject and Text are rendered from the templates of the channel when the message is sent.
+type Message struct {
+	Event   string    `json:"event"`
+	Host    string    `json:"host"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Targets []Target  `json:"targets"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+}
+
+// Count returns the number of targets with a status
+func (m Message) Count(status string) int {
+	var output int
+	for _, t := range m.Targets {
+		if t.Status == status {
+			output++
+		}
+	}
+	return output
+}
+
+// Failed returns the number of targets which did not complete successfully
+func (m Message) Failed() int {
+	var output int
+	for _, t := range m.Targets {
+		if t.Status != models.ReportStatusSuccess && t.Status != models.ReportStatusSkipped {
+			output++
+		}
+	}
+	return output
+}
+
+// Recovered returns the number of targets which completed after they failed in their previous run
+func (m Message) Recovered() int {
+	var output int
+	for _, t := range m.Targets {
+		if t.Recovered {
+			output++
+		}
+	}
+	return output
+}
+
+// Summary describes the outcome of the targets in a single line
+func (m Message) Summary() string {
+	switch {
+	case m.Event == EventTest:
+		return fmt.Sprintf("test notification for %d targets", len(m.Targets))
+	case m.Failed() > 0:
+		return fmt.Sprintf("%d of %d targets failed", m.Failed(), len(m.Targets))
+	case m.Recovered() > 0:
+		return fmt.Sprintf("%d of %d targets recovered", m.Recovered(), len(m.Targets))
+	case m.Count(models.ReportStatusSkipped) > 0:
+		return fmt.Sprintf("%d of %d targets backed up, %d skipped as unchanged", m.Count(models.ReportStatusSuccess), len(m.Targets), m.Count(models.ReportStatusSkipped))
+	default:
+		return fmt.Sprintf("all %d targets backed up", len(m.Targets))
+	}
+}
+
+// SetEvent sets the event of the message from the outcome of its targets
+func (m *Message) SetEvent() {
+	switch {
+	case m.Failed() > 0:
+		m.Event = EventFailure
+	case m.Recovered() > 0:
+		m.Event = EventRecovery
+	default:
+		m.Event = EventSuccess
+	}
+}
+
+// Notifier sends messages to a channel
+type Notifier interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Options apply to every channel
+type Options struct {
+	KeystorePath string
+}
+
+// New returns the Notifier for a channel. Passwords, secrets and urls may refer to secrets.
+func New(c models.NotificationChannel, o Options) (Notifier, error) {
+	_, err := getEvents(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRenderer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(c.Type) {
+	case TypeSmtp:
+		return newSmtp(c, o, r)
+	case TypeWebhook:
+		return newWebhook(c, o, r)
+	case TypeSlack:
+		return newSlack(c, o, r)
+	case TypeTeams:
+		return newTeams(c, o, r)
+	default:
+		return nil, fmt.Errorf("notification channel %s: unknown type %s", c.Name, c.Type)
+	}
+}
+
+// ShouldSend reports whether a channel is notified of a message, by the events of the channel.
+// Channels without events are notified of failures and recoveries.
+func ShouldSend(c models.NotificationChannel, m Message) bool {
+	events, _ := getEvents(c)
+	for _, e := range events {
+		switch {
+		case e == models.NotifyOnAlways, m.Event == EventTest:
+			return true
+		case e == models.NotifyOnFailure && m.Event == EventFailure:
+			return true
+		case e == models.NotifyOnRecovery && m.Recovered() > 0:
+			return true
+		}
+	}
+	return false
+}
+
+func getEvents(c models.NotificationChannel) ([]string, error) {
+	if len(c.Events) == 0 {
+		return []string{models.NotifyOnFailure, models.NotifyOnRecovery}, nil
+	}
+
+	var output []string
+	for _, e := range c.Events {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch e {
+		case models.NotifyOnFailure, models.NotifyOnRecovery, models.NotifyOnAlways:
+			output = append(output, e)
+		default:
+			return nil, fmt.Errorf("notification channel %s: unknown event %s, use %s, %s or %s", c.Name, e, models.NotifyOnFailure, models.NotifyOnRecovery, models.NotifyOnAlways)
+		}
+	}
+	return output, nil
+}
+
+// renderer renders the subject and text of a message with the templates of a channel
+type renderer struct {
+	subject *template.Template
+	text    *template.Template
+}
+
+func newRenderer(c models.NotificationChannel) (*renderer, error) {
+	subject, text := c.Subject, c.Template
+	if subject == "" {
+		subject = defaultSubject
+	}
+	if text == "" {
+		text = defaultTemplate
+	}
+
+	var r renderer
+	var err error
+	r.subject, err = template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("notification channel %s: invalid subject: %v", c.Name, err)
+	}
+	r.text, err = template.New("template").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("notification channel %s: invalid template: %v", c.Name, err)
+	}
+	return &r, nil
+}
+
+// render returns the message with its subject and text
+func (r *renderer) render(m Message) (Message, error) {
+	var subject, text bytes.Buffer
+	err := r.subject.Execute(&subject, m)
+	if err != nil {
+		return m, fmt.Errorf("could not render subject: %v", err)
+	}
+	err = r.text.Execute(&text, m)
+	if err != nil {
+		return m, fmt.Errorf("could not render template: %v", err)
+	}
+
+	// Headers cannot span lines
+	m.Subject = strings.Join(strings.Fields(subject.String()), " ")
+	m.Text = text.String()
+	return m, nil
+}
+
+func resolve(c models.NotificationChannel, field string, reference string, keystorePath string) (string, error) {
+	value, err := secrets.Resolve(reference, keystorePath)
+	if err != nil {
+		return "", fmt.Errorf("notification channel %s: could not resolve %s: %v", c.Name, field, err)
+	}
+	return value, nil
+}
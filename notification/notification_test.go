@@ -0,0 +1,122 @@
+package notification
+
+import (
+	"github.com/jantytgat/citrixadc-backup/models"
+	"testing"
+)
+
+func TestShouldSend(t *testing.T) {
+	failure := newTestMessage()
+
+	success := newTestMessage()
+	success.Targets = success.Targets[1:]
+	success.SetEvent()
+
+	recovery := newTestMessage()
+	recovery.Targets = recovery.Targets[1:]
+	recovery.Targets[0].PreviousStatus = models.ReportStatusFailed
+	recovery.Targets[0].Recovered = true
+	recovery.SetEvent()
+
+	test := success
+	test.Event = EventTest
+
+	tests := []struct {
+		name    string
+		events  []string
+		message Message
+		send    bool
+	}{
+		{"default on failure", nil, failure, true},
+		{"default on recovery", nil, recovery, true},
+		{"default on success", nil, success, false},
+		{"failure on failure", []string{models.NotifyOnFailure}, failure, true},
+		{"failure on recovery", []string{models.NotifyOnFailure}, recovery, false},
+		{"recovery on failure", []string{models.NotifyOnRecovery}, failure, false},
+		{"recovery on recovery", []string{"Recovery"}, recovery, true},
+		{"always on success", []string{models.NotifyOnAlways}, success, true},
+		{"failure on test", []string{models.NotifyOnFailure}, test, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := models.NotificationChannel{Name: "channel", Events: tt.events}
+			if send := ShouldSend(c, tt.message); send != tt.send {
+				t.Errorf("ShouldSend is %v for %s, want %v", send, tt.message.Event, tt.send)
+			}
+		})
+	}
+}
+
+func TestSetEvent(t *testing.T) {
+	m := newTestMessage()
+	if m.Event != EventFailure {
+		t.Errorf("event is %s, want %s", m.Event, EventFailure)
+	}
+
+	// A recovery of one target does not hide the failure of another
+	m.Targets[1].Recovered = true
+	m.SetEvent()
+	if m.Event != EventFailure {
+		t.Errorf("event is %s, want %s", m.Event, EventFailure)
+	}
+
+	m.Targets = m.Targets[1:]
+	m.SetEvent()
+	if m.Event != EventRecovery {
+		t.Errorf("event is %s, want %s", m.Event, EventRecovery)
+	}
+
+	m.Targets[0].Recovered = false
+	m.SetEvent()
+	if m.Event != EventSuccess {
+		t.Errorf("event is %s, want %s", m.Event, EventSuccess)
+	}
+}
+
+func TestNewValidatesChannel(t *testing.T) {
+	tests := []struct {
+		name    string
+		channel models.NotificationChannel
+	}{
+		{"unknown type", models.NotificationChannel{Name: "c", Type: "pager", Url: "http://127.0.0.1"}},
+		{"unknown event", models.NotificationChannel{Name: "c", Type: TypeWebhook, Url: "http://127.0.0.1", Events: []string{"sometimes"}}},
+		{"invalid template", models.NotificationChannel{Name: "c", Type: TypeWebhook, Url: "http://127.0.0.1", Template: "{{.Targets"}},
+		{"webhook without url", models.NotificationChannel{Name: "c", Type: TypeWebhook}},
+		{"smtp without recipients", models.NotificationChannel{Name: "c", Type: TypeSmtp, Address: "127.0.0.1", From: "backup@example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.channel, Options{})
+			if err == nil {
+				t.Error("invalid channel was accepted")
+			}
+		})
+	}
+}
+
+func TestRenderCustomTemplate(t *testing.T) {
+	c := models.NotificationChannel{
+		Name:     "c",
+		Type:     TypeWebhook,
+		Url:      "http://127.0.0.1",
+		Subject:  "{{.Event}}\non {{.Host}}",
+		Template: `{{range .Targets}}{{if eq .Status "failed"}}{{.Target}} at {{.Stage}}{{end}}{{end}}`,
+	}
+	r, err := newRenderer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := r.render(newTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "failure on backup01" {
+		t.Errorf("subject is %q", m.Subject)
+	}
+	if m.Text != "adc1 at create" {
+		t.Errorf("text is %q", m.Text)
+	}
+}
@@ -0,0 +1,151 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Smtp sends messages by mail. Credentials are only sent over TLS, or to a server on localhost.
+type Smtp struct {
+	address            string
+	host               string
+	startTls           bool
+	insecureSkipVerify bool
+	username           string
+	password           string
+	from               string
+	to                 []string
+	renderer           *renderer
+}
+
+func newSmtp(c models.NotificationChannel, o Options, r *renderer) (*Smtp, error) {
+	if c.Address == "" || c.From == "" || len(c.To) == 0 {
+		return nil, fmt.Errorf("notification channel %s: address, from and to are required", c.Name)
+	}
+
+	s := &Smtp{
+		address:            c.Address,
+		startTls:           c.StartTls,
+		insecureSkipVerify: c.InsecureSkipVerify,
+		from:               c.From,
+		to:                 c.To,
+		renderer:           r,
+	}
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		// The address has no port
+		host = c.Address
+		s.address = net.JoinHostPort(c.Address, "25")
+	}
+	s.host = host
+
+	if c.Username != "" {
+		s.username, err = resolve(c, "username", c.Username, o.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+		s.password, err = resolve(c, "password", c.Password, o.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Smtp) Send(ctx context.Context, m Message) error {
+	m, err := s.renderer.render(m)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if hostname, err := os.Hostname(); err == nil {
+		err = client.Hello(hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.startTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", s.address)
+		}
+		err = client.StartTLS(&tls.Config{ServerName: s.host, InsecureSkipVerify: s.insecureSkipVerify})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.username != "" {
+		err = client.Auth(smtp.PlainAuth("", s.username, s.password, s.host))
+		if err != nil {
+			return fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+
+	err = client.Mail(s.from)
+	if err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(s.format(m))
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// format returns the mail of a message, with its text encoded as quoted-printable
+func (s *Smtp) format(m Message) []byte {
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "From: %s\r\n", s.from)
+	fmt.Fprintf(&output, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&output, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&output, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&output, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&output, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&output, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&output)
+	w.Write([]byte(m.Text))
+	w.Close()
+	return output.Bytes()
+}
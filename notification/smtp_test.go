@@ -0,0 +1,271 @@
+package notification
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"math/big"
+	"mime"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is an SMTP server which accepts every mail, and records the session
+type smtpSink struct {
+	listener net.Listener
+	config   *tls.Config
+	startTls bool
+
+	mux      sync.Mutex
+	username string
+	password string
+	authTls  bool
+	from     string
+	to       []string
+	data     string
+	done     chan struct{}
+}
+
+func newSmtpSink(t *testing.T, startTls bool) *smtpSink {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{
+		listener: listener,
+		config:   &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}},
+		startTls: startTls,
+		done:     make(chan struct{}),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.serve(conn)
+	}()
+	return s
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer close(s.done)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	secure := false
+
+	reply("220 sink ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		s.mux.Lock()
+		switch command {
+		case "EHLO":
+			reply("250-sink")
+			if s.startTls && !secure {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, s.config)
+			if tlsConn.Handshake() != nil {
+				s.mux.Unlock()
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			secure = true
+		case "AUTH":
+			fields := strings.Fields(line)
+			credentials, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			parts := strings.Split(string(credentials), "\x00")
+			s.username, s.password, s.authTls = parts[1], parts[2], secure
+			reply("235 authenticated")
+		case "MAIL":
+			s.from = line
+			reply("250 ok")
+		case "RCPT":
+			s.to = append(s.to, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			s.mux.Unlock()
+			return
+		default:
+			reply("250 ok")
+		}
+		s.mux.Unlock()
+	}
+}
+
+func (s *smtpSink) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("smtp session did not complete")
+	}
+}
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSmtpSendsWithStartTlsAndAuth(t *testing.T) {
+	sink := newSmtpSink(t, true)
+	c := models.NotificationChannel{
+		Name:               "mail",
+		Type:               TypeSmtp,
+		Address:            sink.listener.Addr().String(),
+		StartTls:           true,
+		InsecureSkipVerify: true,
+		Username:           "backup",
+		Password:           "s3cret",
+		From:               "backup@example.com",
+		To:                 []string{"ops@example.com", "noc@example.com"},
+	}
+	n, err := New(c, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.Send(context.Background(), newTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.wait(t)
+
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+	if sink.username != "backup" || sink.password != "s3cret" {
+		t.Errorf("authenticated as %q with %q, want backup with s3cret", sink.username, sink.password)
+	}
+	if !sink.authTls {
+		t.Error("credentials were sent before STARTTLS")
+	}
+	if len(sink.to) != 2 {
+		t.Errorf("mail was sent to %d recipients, want 2", len(sink.to))
+	}
+
+	subject := getHeader(sink.data, "Subject")
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != "[citrixadc-backup] failure: 1 of 2 targets failed" {
+		t.Errorf("subject is %q", decoded)
+	}
+	if !strings.Contains(sink.data, "adc1: failed") || !strings.Contains(sink.data, "create: connection refused") {
+		t.Errorf("mail does not hold the outcome of the targets:\n%s", sink.data)
+	}
+}
+
+func TestSmtpRequiresStartTlsWhenConfigured(t *testing.T) {
+	sink := newSmtpSink(t, false)
+	c := models.NotificationChannel{
+		Name:     "mail",
+		Type:     TypeSmtp,
+		Address:  sink.listener.Addr().String(),
+		StartTls: true,
+		From:     "backup@example.com",
+		To:       []string{"ops@example.com"},
+	}
+	n, err := New(c, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.Send(context.Background(), newTestMessage())
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("sent without STARTTLS, error is %v", err)
+	}
+	sink.mux.Lock()
+	defer sink.mux.Unlock()
+	if sink.data != "" {
+		t.Error("mail was sent without STARTTLS")
+	}
+}
+
+func getHeader(data string, name string) string {
+	for _, line := range strings.Split(data, "\r\n") {
+		if strings.HasPrefix(line, name+": ") {
+			return strings.TrimPrefix(line, name+": ")
+		}
+	}
+	return ""
+}
+
+// newTestMessage returns a failure of one of two targets
+func newTestMessage() Message {
+	end := time.Date(2026, 1, 1, 1, 0, 0, 0, time.UTC)
+	m := Message{
+		Host:  "backup01",
+		Start: end.Add(-time.Minute),
+		End:   end,
+		Targets: []Target{
+			{
+				TargetReport: models.TargetReport{Target: "adc1", Status: models.ReportStatusFailed, Stage: "create", Error: "connection refused"},
+				Tags:         []string{"prod"},
+			},
+			{
+				TargetReport: models.TargetReport{
+					Target: "adc2",
+					Status: models.ReportStatusSuccess,
+					Nodes:  []models.NodeReport{{Node: "node2", Status: models.ReportStatusSuccess, Filename: "20260101_010000_adc2_node2.tgz"}},
+				},
+				Tags: []string{"lab"},
+			},
+		},
+	}
+	m.SetEvent()
+	return m
+}
@@ -0,0 +1,219 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SignatureHeader holds the HMAC-SHA256 of the body of a webhook, as sha256=<hex>, when the channel has a secret
+const SignatureHeader = "X-Citrixadc-Backup-Signature"
+
+// EventHeader holds the event of the message sent to a webhook
+const EventHeader = "X-Citrixadc-Backup-Event"
+
+// Webhook posts messages as JSON, signed with the secret of the channel
+type Webhook struct {
+	url      string
+	secret   string
+	client   *http.Client
+	renderer *renderer
+}
+
+// Slack posts messages to a Slack incoming webhook
+type Slack struct {
+	url      string
+	client   *http.Client
+	renderer *renderer
+}
+
+// Teams posts messages to a Microsoft Teams incoming webhook, as a message card
+type Teams struct {
+	url      string
+	client   *http.Client
+	renderer *renderer
+}
+
+// slackPayload is a message with an attachment, colored by the event
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Color    string   `json:"color"`
+	Text     string   `json:"text"`
+	MrkdwnIn []string `json:"mrkdwn_in"`
+}
+
+type teamsPayload struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	Summary    string `json:"summary"`
+	ThemeColor string `json:"themeColor"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+}
+
+func newWebhook(c models.NotificationChannel, o Options, r *renderer) (*Webhook, error) {
+	address, client, err := newWebhookClient(c, o)
+	if err != nil {
+		return nil, err
+	}
+	w := &Webhook{url: address, client: client, renderer: r}
+	if c.Secret != "" {
+		w.secret, err = resolve(c, "secret", c.Secret, o.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func newSlack(c models.NotificationChannel, o Options, r *renderer) (*Slack, error) {
+	address, client, err := newWebhookClient(c, o)
+	if err != nil {
+		return nil, err
+	}
+	return &Slack{url: address, client: client, renderer: r}, nil
+}
+
+func newTeams(c models.NotificationChannel, o Options, r *renderer) (*Teams, error) {
+	address, client, err := newWebhookClient(c, o)
+	if err != nil {
+		return nil, err
+	}
+	return &Teams{url: address, client: client, renderer: r}, nil
+}
+
+// newWebhookClient returns the url of a channel, which often holds a token and may therefore refer to a secret, with an HTTP client for it
+func newWebhookClient(c models.NotificationChannel, o Options) (string, *http.Client, error) {
+	if c.Url == "" {
+		return "", nil, fmt.Errorf("notification channel %s: url is required", c.Name)
+	}
+	address, err := resolve(c, "url", c.Url, o.KeystorePath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify},
+		},
+	}
+	return address, client, nil
+}
+
+func (w *Webhook) Send(ctx context.Context, m Message) error {
+	m, err := w.renderer.render(m)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{EventHeader: m.Event}
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(body)
+		headers[SignatureHeader] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return post(ctx, w.client, w.url, body, headers)
+}
+
+func (s *Slack) Send(ctx context.Context, m Message) error {
+	m, err := s.renderer.render(m)
+	if err != nil {
+		return err
+	}
+
+	color := "good"
+	if m.Event == EventFailure {
+		color = "danger"
+	}
+	body, err := json.Marshal(slackPayload{
+		Text: m.Subject,
+		Attachments: []slackAttachment{
+			{Color: color, Text: "```" + strings.TrimSpace(m.Text) + "```", MrkdwnIn: []string{"text"}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return post(ctx, s.client, s.url, body, nil)
+}
+
+func (t *Teams) Send(ctx context.Context, m Message) error {
+	m, err := t.renderer.render(m)
+	if err != nil {
+		return err
+	}
+
+	color := "2EB67D"
+	if m.Event == EventFailure {
+		color = "E01E5A"
+	}
+	// Teams joins single line breaks, so every line becomes a paragraph
+	var lines []string
+	for _, line := range strings.Split(m.Text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	body, err := json.Marshal(teamsPayload{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		Summary:    m.Subject,
+		ThemeColor: color,
+		Title:      m.Subject,
+		Text:       strings.Join(lines, "\n\n"),
+	})
+	if err != nil {
+		return err
+	}
+	return post(ctx, t.client, t.url, body, nil)
+}
+
+// post sends a JSON body to a webhook, and expects a 2xx response
+func post(ctx context.Context, client *http.Client, address string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(body))
+	if err != nil {
+		// The url may hold a token, so it is not part of the error
+		return fmt.Errorf("invalid webhook url")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "citrixadc-backup")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		// The url may hold a token, so only the cause of the error is returned
+		if e, ok := err.(*url.Error); ok {
+			err = e.Err
+		}
+		return fmt.Errorf("could not post to webhook at %s: %v", request.URL.Host, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		content, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return fmt.Errorf("webhook at %s returned %s %s", request.URL.Host, response.Status, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
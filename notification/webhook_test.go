@@ -0,0 +1,180 @@
+package notification
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// receiver is an httptest server which records the last request
+type receiver struct {
+	*httptest.Server
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	t.Helper()
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		r.headers = request.Header
+		r.body, _ = ioutil.ReadAll(request.Body)
+		w.WriteHeader(r.status)
+		w.Write([]byte("rejected"))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func send(t *testing.T, c models.NotificationChannel, m Message) error {
+	t.Helper()
+	n, err := New(c, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.Send(context.Background(), m)
+}
+
+func TestWebhookSignsBody(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	c := models.NotificationChannel{Name: "hook", Type: TypeWebhook, Url: r.URL + "/hook", Secret: "s3cret"}
+
+	err := send(t, c, newTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(r.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := r.headers.Get(SignatureHeader); !hmac.Equal([]byte(signature), []byte(expected)) {
+		t.Errorf("signature is %q, want %q", signature, expected)
+	}
+	if event := r.headers.Get(EventHeader); event != EventFailure {
+		t.Errorf("event header is %q, want %s", event, EventFailure)
+	}
+	if contentType := r.headers.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("content type is %q", contentType)
+	}
+
+	var m Message
+	err = json.Unmarshal(r.body, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Event != EventFailure || len(m.Targets) != 2 || m.Targets[0].Target != "adc1" || m.Targets[0].Tags[0] != "prod" {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if m.Subject == "" || !strings.Contains(m.Text, "adc1: failed") {
+		t.Errorf("message is not rendered: subject %q, text %q", m.Subject, m.Text)
+	}
+}
+
+func TestWebhookWithoutSecretIsNotSigned(t *testing.T) {
+	r := newReceiver(t, http.StatusNoContent)
+	c := models.NotificationChannel{Name: "hook", Type: TypeWebhook, Url: r.URL}
+
+	err := send(t, c, newTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature := r.headers.Get(SignatureHeader); signature != "" {
+		t.Errorf("unsigned webhook has signature %q", signature)
+	}
+}
+
+func TestWebhookErrorHidesUrl(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError)
+	c := models.NotificationChannel{Name: "hook", Type: TypeWebhook, Url: r.URL + "/services/T0KEN"}
+
+	err := send(t, c, newTestMessage())
+	if err == nil {
+		t.Fatal("webhook which returned 500 succeeded")
+	}
+	if strings.Contains(err.Error(), "T0KEN") {
+		t.Errorf("error holds the url of the webhook: %v", err)
+	}
+	if !strings.Contains(err.Error(), "500") {
+		t.Errorf("error does not hold the status: %v", err)
+	}
+}
+
+func TestSlackPayload(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	c := models.NotificationChannel{Name: "slack", Type: TypeSlack, Url: r.URL}
+
+	err := send(t, c, newTestMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Text        string `json:"text"`
+		Attachments []struct {
+			Color    string   `json:"color"`
+			Text     string   `json:"text"`
+			MrkdwnIn []string `json:"mrkdwn_in"`
+		} `json:"attachments"`
+	}
+	err = json.Unmarshal(r.body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Text != "[citrixadc-backup] failure: 1 of 2 targets failed" {
+		t.Errorf("text is %q", payload.Text)
+	}
+	if len(payload.Attachments) != 1 {
+		t.Fatalf("payload has %d attachments, want 1", len(payload.Attachments))
+	}
+	a := payload.Attachments[0]
+	if a.Color != "danger" {
+		t.Errorf("color is %q, want danger", a.Color)
+	}
+	if !strings.HasPrefix(a.Text, "```") || !strings.HasSuffix(a.Text, "```") || !strings.Contains(a.Text, "adc1: failed") {
+		t.Errorf("attachment text is %q", a.Text)
+	}
+	if len(a.MrkdwnIn) != 1 || a.MrkdwnIn[0] != "text" {
+		t.Errorf("mrkdwn_in is %v", a.MrkdwnIn)
+	}
+}
+
+func TestTeamsPayload(t *testing.T) {
+	r := newReceiver(t, http.StatusOK)
+	c := models.NotificationChannel{Name: "teams", Type: TypeTeams, Url: r.URL}
+
+	m := newTestMessage()
+	m.Targets = m.Targets[1:]
+	m.SetEvent()
+	err := send(t, c, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload map[string]string
+	err = json.Unmarshal(r.body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload["@type"] != "MessageCard" || payload["@context"] != "https://schema.org/extensions" {
+		t.Errorf("payload is not a message card: %v", payload)
+	}
+	if payload["themeColor"] != "2EB67D" {
+		t.Errorf("theme color is %q, want 2EB67D", payload["themeColor"])
+	}
+	if payload["title"] != "[citrixadc-backup] success: all 1 targets backed up" || payload["summary"] != payload["title"] {
+		t.Errorf("title is %q, summary is %q", payload["title"], payload["summary"])
+	}
+	// Every line is a paragraph, without empty paragraphs in between
+	if !strings.Contains(payload["text"], "adc2: success\n\n  node2: success") || strings.Contains(payload["text"], "\n\n\n") {
+		t.Errorf("text is %q", payload["text"])
+	}
+}
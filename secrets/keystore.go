@@ -0,0 +1,232 @@
+package secrets
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PassphraseEnvironmentVariable holds the keystore passphrase for unattended runs
+const PassphraseEnvironmentVariable = "CITRIXADC_BACKUP_KEYSTORE_PASSPHRASE"
+
+const keystoreVersion = 1
+
+// scrypt parameters recommended for interactive logins
+const (
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// Keystore is a local file holding named secrets, encrypted with AES-256-GCM using a key derived from a passphrase
+type Keystore struct {
+	path       string
+	passphrase string
+	secrets    map[string]string
+}
+
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	Kdf        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// OpenKeystore decrypts the keystore at path. A keystore which does not exist yet is returned empty.
+func OpenKeystore(path string, passphrase string) (*Keystore, error) {
+	k := &Keystore{
+		path:       path,
+		passphrase: passphrase,
+		secrets:    make(map[string]string),
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return k, nil
+		}
+		return nil, err
+	}
+
+	var f keystoreFile
+	err = json.Unmarshal(content, &f)
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s is invalid: %v", path, err)
+	}
+	if f.Version != keystoreVersion || f.Kdf != "scrypt" {
+		return nil, fmt.Errorf("keystore %s has an unsupported format", path)
+	}
+
+	gcm, err := newKeystoreCipher(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt keystore %s, wrong passphrase or corrupt file", path)
+	}
+
+	err = json.Unmarshal(plaintext, &k.secrets)
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s is invalid: %v", path, err)
+	}
+	return k, nil
+}
+
+func (k *Keystore) Get(name string) (string, bool) {
+	value, ok := k.secrets[name]
+	return value, ok
+}
+
+func (k *Keystore) Set(name string, value string) {
+	k.secrets[name] = value
+}
+
+// Delete removes a secret, and reports whether it existed
+func (k *Keystore) Delete(name string) bool {
+	_, ok := k.secrets[name]
+	delete(k.secrets, name)
+	return ok
+}
+
+// Names returns the sorted names of the secrets in the keystore
+func (k *Keystore) Names() []string {
+	var output []string
+	for name := range k.secrets {
+		output = append(output, name)
+	}
+	sort.Strings(output)
+	return output
+}
+
+// Save encrypts the keystore with a new salt and nonce, and atomically replaces the file
+func (k *Keystore) Save() error {
+	plaintext, err := json.Marshal(k.secrets)
+	if err != nil {
+		return err
+	}
+
+	f := keystoreFile{
+		Version: keystoreVersion,
+		Kdf:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, 16),
+	}
+	_, err = rand.Read(f.Salt)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newKeystoreCipher(k.passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, gcm.NonceSize())
+	_, err = rand.Read(f.Nonce)
+	if err != nil {
+		return err
+	}
+	f.Ciphertext = gcm.Seal(nil, f.Nonce, plaintext, nil)
+
+	content, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(k.path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(k.path), filepath.Base(k.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+func newKeystoreCipher(passphrase string, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GetPassphrase returns the keystore passphrase from the environment, or asks for it on the terminal.
+// With confirm set, the passphrase has to be entered twice.
+func GetPassphrase(confirm bool) (string, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnvironmentVariable); ok {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("keystore passphrase not available, set %s", PassphraseEnvironmentVariable)
+	}
+
+	passphrase, err := ReadSecret("Keystore passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if confirm {
+		again, err := ReadSecret("Confirm keystore passphrase: ")
+		if err != nil {
+			return "", err
+		}
+		if again != passphrase {
+			return "", errors.New("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// ReadSecret reads a secret without echo from the terminal, or a single line from stdin when it is not a terminal
+func ReadSecret(prompt string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		reader := bufio.NewReader(os.Stdin)
+		value, err := reader.ReadString('\n')
+		if err != nil && value == "" {
+			return "", err
+		}
+		return strings.TrimRight(value, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	value, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
@@ -0,0 +1,110 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Prefixes of secret references. Values without a known prefix are used as-is.
+const (
+	PrefixEnv      = "env:"
+	PrefixFile     = "file:"
+	PrefixExec     = "exec:"
+	PrefixKeystore = "keystore:"
+	PrefixPlain    = "plain:"
+)
+
+var keystoreMux sync.Mutex
+var keystores = make(map[string]*Keystore)
+
+// Resolve returns the secret a reference points to.
+// Errors describe the reference, but never contain the secret itself.
+func Resolve(reference string, keystorePath string) (string, error) {
+	switch {
+	case strings.HasPrefix(reference, PrefixEnv):
+		name := strings.TrimPrefix(reference, PrefixEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+
+	case strings.HasPrefix(reference, PrefixFile):
+		filename := strings.TrimPrefix(reference, PrefixFile)
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("could not read secret file: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+
+	case strings.HasPrefix(reference, PrefixExec):
+		return resolveExec(strings.TrimPrefix(reference, PrefixExec))
+
+	case strings.HasPrefix(reference, PrefixKeystore):
+		return resolveKeystore(strings.TrimPrefix(reference, PrefixKeystore), keystorePath)
+
+	case strings.HasPrefix(reference, PrefixPlain):
+		return strings.TrimPrefix(reference, PrefixPlain), nil
+
+	default:
+		return reference, nil
+	}
+}
+
+// resolveExec runs a command without a shell and returns the first line of its output
+func resolveExec(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("no command specified")
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("command %s failed: %v", args[0], err)
+	}
+
+	output := strings.SplitN(stdout.String(), "\n", 2)[0]
+	return strings.TrimRight(output, "\r"), nil
+}
+
+// ClearKeystores forgets the keystores which were opened to resolve secrets, so they are opened again the next time a secret is resolved
+func ClearKeystores() {
+	keystoreMux.Lock()
+	defer keystoreMux.Unlock()
+
+	keystores = make(map[string]*Keystore)
+}
+
+func resolveKeystore(name string, keystorePath string) (string, error) {
+	keystoreMux.Lock()
+	defer keystoreMux.Unlock()
+
+	k, ok := keystores[keystorePath]
+	if !ok {
+		passphrase, err := GetPassphrase(false)
+		if err != nil {
+			return "", err
+		}
+		k, err = OpenKeystore(keystorePath, passphrase)
+		if err != nil {
+			return "", err
+		}
+		keystores[keystorePath] = k
+	}
+
+	value, ok := k.Get(name)
+	if !ok {
+		return "", fmt.Errorf("secret %s not found in keystore %s", name, keystorePath)
+	}
+	return value, nil
+}
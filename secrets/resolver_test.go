@@ -0,0 +1,47 @@
+package secrets
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestClearKeystoresReadsChangedSecrets(t *testing.T) {
+	t.Setenv(PassphraseEnvironmentVariable, "passphrase")
+	path := filepath.Join(t.TempDir(), "citrixadc-backup.keystore")
+	t.Cleanup(ClearKeystores)
+
+	setSecret := func(value string) {
+		t.Helper()
+		k, err := OpenKeystore(path, "passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.Set("adc", value)
+		if err = k.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve := func() string {
+		t.Helper()
+		value, err := Resolve(PrefixKeystore+"adc", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	setSecret("first")
+	if got := resolve(); got != "first" {
+		t.Fatalf("resolved %q, want first", got)
+	}
+
+	// The opened keystore is used until it is cleared
+	setSecret("second")
+	if got := resolve(); got != "first" {
+		t.Fatalf("resolved %q before the keystores were cleared, want first", got)
+	}
+	ClearKeystores()
+	if got := resolve(); got != "second" {
+		t.Fatalf("resolved %q after the keystores were cleared, want second", got)
+	}
+}
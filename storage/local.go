@@ -0,0 +1,369 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoreDirectory holds the content-addressed store of a local destination, where a file is stored as sha256/<first two characters of its hash>/<hash>
+const StoreDirectory = ".store"
+
+// StoreLockFilename is the file in StoreDirectory which is locked while the store is changed
+const StoreLockFilename = "lock"
+
+// storeMutex serializes the changes to the stores within the process, the lock file in the store serializes them with other processes.
+// Together they make sure Collect never deletes a copy which is being linked, such as by a prune from cron while the daemon runs a backup.
+var storeMutex sync.Mutex
+
+// Local stores files in a directory on the local filesystem
+type Local struct {
+	path string
+	mode os.FileMode
+}
+
+// NewLocal returns a Storage for the directory at path
+func NewLocal(path string, o Options) *Local {
+	l := &Local{path: path, mode: 0644}
+	if o.Private {
+		l.mode = 0600
+	}
+	return l
+}
+
+// localReadCloser stops reading a file once the context it was opened with is done
+type localReadCloser struct {
+	contextReader
+	file *os.File
+}
+
+func (r *localReadCloser) Close() error {
+	return r.file.Close()
+}
+
+func newLocal(d models.DestinationSettings, o Options) (*Local, error) {
+	if d.Path == "" {
+		return nil, fmt.Errorf("destination %s: path is required", d.Name)
+	}
+	return NewLocal(d.Path, o), nil
+}
+
+// Put writes to a temporary file in the same directory, which is renamed once it is complete
+func (l *Local) Put(ctx context.Context, name string, r io.Reader) error {
+	filename := l.filename(name)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, &contextReader{ctx: ctx, r: r})
+	if err == nil {
+		err = tmp.Chmod(l.mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// PutFile links filename into place, which avoids a copy when both are on the same filesystem, and copies it otherwise
+func (l *Local) PutFile(ctx context.Context, name string, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	target := l.filename(name)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Chmod(filename, l.mode); err == nil {
+		if err = os.Link(filename, target); err == nil {
+			return nil
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return l.Put(ctx, name, f)
+}
+
+func (l *Local) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(l.filename(name))
+	if err != nil {
+		return nil, err
+	}
+	return &localReadCloser{contextReader: contextReader{ctx: ctx, r: f}, file: f}, nil
+}
+
+func (l *Local) List(ctx context.Context, directory string) ([]Object, error) {
+	var output []Object
+
+	if err := ctx.Err(); err != nil {
+		return output, err
+	}
+
+	files, err := ioutil.ReadDir(l.filename(directory))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return output, nil
+		}
+		return output, err
+	}
+
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			output = append(output, Object{Name: f.Name(), Size: f.Size(), ModTime: f.ModTime()})
+		}
+	}
+	return output, nil
+}
+
+func (l *Local) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Remove(l.filename(name))
+}
+
+func (l *Local) Location(name string) string {
+	return l.filename(name)
+}
+
+func (l *Local) filename(name string) string {
+	return filepath.Join(l.path, filepath.FromSlash(name))
+}
+
+// PutDeduplicated stores filename as name first, so name holds the file even when it cannot be linked to the store.
+// When the store has a copy with the same hash, name is replaced with a link to it, otherwise name is added to the store.
+// The copy in the store is checked before it is linked, so a damaged copy is replaced instead of linked to new names.
+// Errors which leave name stored without a link to the store are returned as a DeduplicationError.
+func (l *Local) PutDeduplicated(ctx context.Context, name string, filename string, hash string) error {
+	err := l.PutFile(ctx, name, filename)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := l.lockStore()
+	if err != nil {
+		return &DeduplicationError{Name: name, Err: err}
+	}
+	defer unlock()
+
+	err = l.link(l.filename(name), l.objectFilename(hash), hash)
+	if err != nil {
+		return &DeduplicationError{Name: name, Err: err}
+	}
+	return nil
+}
+
+// link replaces target with a link to the copy in the store at object, or adds target to the store when there is no valid copy
+func (l *Local) link(target string, object string, hash string) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	objectInfo, err := os.Stat(object)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(filepath.Dir(object), 0755)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, object)
+	}
+	if err != nil {
+		return err
+	}
+	if os.SameFile(info, objectInfo) {
+		return nil
+	}
+
+	if objectInfo.Size() != info.Size() || !hasHash(object, hash) {
+		return replaceWithLink(target, object)
+	}
+	return replaceWithLink(object, target)
+}
+
+// Collect walks the destination for the names which link to the copies in the store, and deletes the copies which have none
+func (l *Local) Collect(ctx context.Context) (int, int64, error) {
+	var count int
+	var size int64
+
+	store := filepath.Join(l.path, StoreDirectory)
+	if _, err := os.Stat(store); errors.Is(err, os.ErrNotExist) {
+		return count, size, nil
+	}
+
+	unlock, err := l.lockStore()
+	if err != nil {
+		return count, size, err
+	}
+	defer unlock()
+	lockFilename := filepath.Join(store, StoreLockFilename)
+
+	// Only files of the same size can be links to the same copy
+	names := make(map[int64][]os.FileInfo)
+	var objects []string
+	err = filepath.Walk(l.path, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || filename == lockFilename {
+			return nil
+		}
+		if strings.HasPrefix(filename, store+string(filepath.Separator)) {
+			objects = append(objects, filename)
+		} else {
+			names[info.Size()] = append(names[info.Size()], info)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, size, err
+	}
+
+	for _, object := range objects {
+		if err = ctx.Err(); err != nil {
+			return count, size, err
+		}
+		info, err := os.Stat(object)
+		if err != nil {
+			return count, size, err
+		}
+		if findSameFile(names[info.Size()], info) {
+			continue
+		}
+		err = os.Remove(object)
+		if err != nil {
+			return count, size, err
+		}
+		// The directory of the copy is removed when it is empty
+		os.Remove(filepath.Dir(object))
+		count++
+		size += info.Size()
+	}
+	return count, size, nil
+}
+
+// Usage counts names which link to the same file once
+func (l *Local) Usage(ctx context.Context, names []string) (int64, error) {
+	var output int64
+
+	files := make(map[int64][]os.FileInfo)
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return output, err
+		}
+		info, err := os.Stat(l.filename(name))
+		if err != nil {
+			return output, err
+		}
+		if findSameFile(files[info.Size()], info) {
+			continue
+		}
+		files[info.Size()] = append(files[info.Size()], info)
+		output += info.Size()
+	}
+	return output, nil
+}
+
+// lockStore locks the store of the destination for the process and for other processes, and returns the function which unlocks it
+func (l *Local) lockStore() (func(), error) {
+	store := filepath.Join(l.path, StoreDirectory)
+	err := os.MkdirAll(store, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	storeMutex.Lock()
+	f, err := os.OpenFile(filepath.Join(store, StoreLockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err == nil {
+		err = lockFile(f)
+		if err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		storeMutex.Unlock()
+		return nil, fmt.Errorf("could not lock the store: %v", err)
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+		storeMutex.Unlock()
+	}, nil
+}
+
+func (l *Local) objectFilename(hash string) string {
+	return filepath.Join(l.path, StoreDirectory, "sha256", hash[:2], hash)
+}
+
+// replaceWithLink atomically replaces target with a link to source
+func replaceWithLink(source string, target string) error {
+	tmp := filepath.Join(filepath.Dir(target), fmt.Sprintf(".%s.%d", filepath.Base(target), time.Now().UnixNano()))
+	err := os.Link(source, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, target)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// hasHash reports whether the sha256 hash of the content of filename is hash
+func hasHash(filename string, hash string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == hash
+}
+
+func findSameFile(files []os.FileInfo, info os.FileInfo) bool {
+	for _, f := range files {
+		if os.SameFile(f, info) {
+			return true
+		}
+	}
+	return false
+}
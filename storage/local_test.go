@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalStopsCancelledUpload(t *testing.T) {
+	testCancelledPut(t, NewLocal(t.TempDir(), Options{}))
+}
+
+func TestLocalCollectKeepsLockFile(t *testing.T) {
+	directory := t.TempDir()
+	l := NewLocal(directory, Options{})
+
+	spool := filepath.Join(t.TempDir(), "spool")
+	content := []byte("archive")
+	if err := ioutil.WriteFile(spool, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	if err := l.PutDeduplicated(context.Background(), "prod/20260101_010000_prod_node1.tgz", spool, hash); err != nil {
+		t.Fatal(err)
+	}
+	lockFilename := filepath.Join(directory, StoreDirectory, StoreLockFilename)
+	if _, err := os.Stat(lockFilename); err != nil {
+		t.Fatalf("store has no lock file: %v", err)
+	}
+
+	count, _, err := l.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("collected %d linked files", count)
+	}
+
+	if err = l.Delete(context.Background(), "prod/20260101_010000_prod_node1.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	count, size, err := l.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || size != int64(len(content)) {
+		t.Errorf("collected %d files of %d bytes, want 1 of %d", count, size, len(content))
+	}
+	if _, err = os.Stat(lockFilename); err != nil {
+		t.Errorf("collect deleted the lock file: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLockStoreExcludesOtherProcesses(t *testing.T) {
+	directory := t.TempDir()
+	l := NewLocal(directory, Options{})
+
+	unlock, err := l.lockStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock on a file opened separately conflicts as the lock of another process would
+	f, err := os.Open(filepath.Join(directory, StoreDirectory, StoreLockFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Fatalf("lock of a locked store returned %v, want %v", err, syscall.EWOULDBLOCK)
+	}
+
+	unlock()
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("lock of an unlocked store failed: %v", err)
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockFile blocks until it holds an exclusive lock on f, which is shared with other processes
+func lockFile(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"strings"
+)
+
+// s3PartSize limits the memory used to upload archives of unknown size
+const s3PartSize = 16 * 1024 * 1024
+
+// S3 stores files as objects in a bucket of an S3-compatible object store, such as MinIO
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3(d models.DestinationSettings, o Options) (*S3, error) {
+	if d.Endpoint == "" || d.Bucket == "" {
+		return nil, fmt.Errorf("destination %s: endpoint and bucket are required", d.Name)
+	}
+
+	accessKey, err := resolve(d, "access key", d.AccessKey, o.KeystorePath)
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := resolve(d, "secret key", d.SecretKey, o.KeystorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := minio.DefaultTransport(d.UseSsl)
+	if err != nil {
+		return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+	}
+	if d.InsecureSkipVerify {
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+
+	client, err := minio.New(d.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure:    d.UseSsl,
+		Region:    d.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+	}
+
+	return &S3{
+		client: client,
+		bucket: d.Bucket,
+		prefix: strings.Trim(d.Path, "/"),
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, name string, r io.Reader) error {
+	// Archives of unknown size are uploaded in parts, which are buffered in memory
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(name), r, size(r), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3PartSize,
+	})
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject does not send a request until the object is read, so missing objects are detected here
+	if _, err = object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+func (s *S3) List(ctx context.Context, directory string) ([]Object, error) {
+	var output []Object
+
+	prefix := s.key(directory)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if info.Err != nil {
+			return output, info.Err
+		}
+		if strings.HasSuffix(info.Key, "/") {
+			continue
+		}
+		output = append(output, Object{
+			Name:    strings.TrimPrefix(info.Key, prefix),
+			Size:    info.Size,
+			ModTime: info.LastModified,
+		})
+	}
+	return output, nil
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Location(name string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(name))
+}
+
+func (s *S3) key(name string) string {
+	return Join(s.prefix, name)
+}
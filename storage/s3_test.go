@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Server is an S3 endpoint with path-style requests, which stores the objects of a single bucket in memory
+type s3Server struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	aborted int
+}
+
+type s3ListResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []s3ListObject
+	CommonPrefixes []s3ListPrefix
+}
+
+type s3ListObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3ListPrefix struct {
+	Prefix string
+}
+
+func newS3Server(bucket string) *s3Server {
+	return &s3Server{bucket: bucket, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+}
+
+func (s *s3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=backup/") {
+		s.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	elements := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if elements[0] != s.bucket {
+		s.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := ""
+	if len(elements) == 2 {
+		key = elements[1]
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		s.list(w, query.Get("prefix"), query.Get("delimiter"))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(s.uploads) + s.aborted + 1)
+		s.uploads[id] = make(map[int][]byte)
+		s.writeXml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: s.bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, found := s.uploads[query.Get("uploadId")]
+		if !found {
+			s.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		content, err := s.readBody(r)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = content
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, number))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, found := s.uploads[query.Get("uploadId")]
+		if !found {
+			s.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		io.Copy(ioutil.Discard, r.Body)
+		var numbers []int
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var content []byte
+		for _, n := range numbers {
+			content = append(content, parts[n]...)
+		}
+		s.objects[key] = content
+		delete(s.uploads, query.Get("uploadId"))
+		s.writeXml(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: s.bucket, Key: key, ETag: `"complete"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		s.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		content, err := s.readBody(r)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = content
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		content, found := s.objects[key]
+		if !found {
+			s.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *s3Server) list(w http.ResponseWriter, prefix string, delimiter string) {
+	result := s3ListResult{Name: s.bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: 1000}
+
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	prefixes := make(map[string]bool)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			p := k[:len(prefix)+i+len(delimiter)]
+			if !prefixes[p] {
+				prefixes[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, s3ListPrefix{Prefix: p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, s3ListObject{
+			Key:          k,
+			LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"object"`,
+			Size:         int64(len(s.objects[k])),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	s.writeXml(w, result)
+}
+
+// readBody returns the content of an upload, which minio-go signs in aws-chunked encoding over plain HTTP
+func (s *s3Server) readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	var output []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(header), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			io.Copy(ioutil.Discard, reader)
+			return output, nil
+		}
+		chunk := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		output = append(output, chunk[:length]...)
+	}
+}
+
+func (s *s3Server) writeXml(w http.ResponseWriter, v interface{}) {
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	xml.NewEncoder(&buffer).Encode(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buffer.Bytes())
+}
+
+func (s *s3Server) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+func TestS3(t *testing.T) {
+	server := newS3Server("backups")
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	u, err := url.Parse(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := New(models.DestinationSettings{
+		Name:      "s3",
+		Type:      TypeS3,
+		Endpoint:  u.Host,
+		Bucket:    "backups",
+		Region:    "us-east-1",
+		Path:      "adc",
+		AccessKey: "backup",
+		SecretKey: "s3cret",
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, st, func() io.Reader {
+		return unknownSize{&failingReader{data: []byte("partial")}}
+	})
+
+	server.Lock()
+	if len(server.uploads) != 0 {
+		t.Errorf("%d multipart uploads are left after a failed upload", len(server.uploads))
+	}
+	if server.aborted != 1 {
+		t.Errorf("aborted %d multipart uploads, want 1", server.aborted)
+	}
+	if _, found := server.objects["adc/prod/20260102_010000_prod_node1.tgz"]; !found {
+		t.Error("objects are not stored below the path of the destination")
+	}
+	server.Unlock()
+
+	testCancelledPut(t, st)
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Sftp stores files in a directory on an SFTP server.
+// A connection is opened for every operation, as operations are few and far between.
+type Sftp struct {
+	address string
+	path    string
+	config  *ssh.ClientConfig
+	private bool
+}
+
+// sftpTimeout limits the time to connect to the server
+const sftpTimeout = 30 * time.Second
+
+// sftpReadCloser closes the connection once the file has been read
+type sftpReadCloser struct {
+	*sftp.File
+	client *sftp.Client
+	conn   *ssh.Client
+	stop   func()
+}
+
+func (r *sftpReadCloser) Close() error {
+	err := r.File.Close()
+	r.client.Close()
+	r.conn.Close()
+	r.stop()
+	return err
+}
+
+func newSftp(d models.DestinationSettings, o Options) (*Sftp, error) {
+	if d.Address == "" || d.Username == "" {
+		return nil, fmt.Errorf("destination %s: address and username are required", d.Name)
+	}
+
+	address := d.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	username, err := resolve(d, "username", d.Username, o.KeystorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if d.PrivateKeyFile != "" {
+		key, err := ioutil.ReadFile(d.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: invalid private key %s: %v", d.Name, d.PrivateKeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if d.Password != "" {
+		password, err := resolve(d, "password", d.Password, o.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("destination %s: a password or private key file is required", d.Name)
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !d.InsecureIgnoreHostKey {
+		knownHostsFile := d.KnownHostsFile
+		if knownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+			}
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: could not read known hosts: %v", d.Name, err)
+		}
+	}
+
+	return &Sftp{
+		address: address,
+		path:    d.Path,
+		private: o.Private,
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sftpTimeout,
+		},
+	}, nil
+}
+
+// connect opens a connection which is closed when ctx is done, so a running operation fails instead of waiting for the server.
+// The returned function stops watching ctx, and must be called once the connection is closed.
+func (s *Sftp) connect(ctx context.Context) (*sftp.Client, *ssh.Client, func(), error) {
+	dialer := net.Dialer{Timeout: sftpTimeout}
+	tcp, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			tcp.Close()
+		case <-stop:
+		}
+	}()
+	stopWatching := func() { close(stop) }
+
+	c, channels, requests, err := ssh.NewClientConn(tcp, s.address, s.config)
+	if err != nil {
+		stopWatching()
+		tcp.Close()
+		return nil, nil, nil, s.contextError(ctx, err)
+	}
+	conn := ssh.NewClient(c, channels, requests)
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		stopWatching()
+		conn.Close()
+		return nil, nil, nil, s.contextError(ctx, err)
+	}
+	return client, conn, stopWatching, nil
+}
+
+// contextError returns the error of ctx when it is done, as the errors of a connection which was closed because of it do not tell why
+func (s *Sftp) contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Put writes to a temporary file in the same directory, which is renamed once it is complete
+func (s *Sftp) Put(ctx context.Context, name string, r io.Reader) error {
+	client, conn, stop, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	defer conn.Close()
+	defer client.Close()
+
+	filename := s.filename(name)
+	err = client.MkdirAll(path.Dir(filename))
+	if err != nil {
+		return s.contextError(ctx, err)
+	}
+
+	tmp := path.Join(path.Dir(filename), "."+path.Base(filename)+".part")
+	f, err := client.Create(tmp)
+	if err != nil {
+		return s.contextError(ctx, err)
+	}
+
+	_, err = f.ReadFrom(r)
+	if err == nil && s.private {
+		err = f.Chmod(0600)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(tmp)
+		return s.contextError(ctx, err)
+	}
+
+	// Plain SFTP renames fail when the target exists, the posix-rename extension replaces it
+	err = client.PosixRename(tmp, filename)
+	if err != nil {
+		err = client.Rename(tmp, filename)
+	}
+	if err != nil {
+		client.Remove(tmp)
+	}
+	return s.contextError(ctx, err)
+}
+
+func (s *Sftp) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	client, conn, stop, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := client.Open(s.filename(name))
+	if err != nil {
+		client.Close()
+		conn.Close()
+		stop()
+		return nil, s.contextError(ctx, err)
+	}
+	return &sftpReadCloser{File: f, client: client, conn: conn, stop: stop}, nil
+}
+
+func (s *Sftp) List(ctx context.Context, directory string) ([]Object, error) {
+	var output []Object
+
+	client, conn, stop, err := s.connect(ctx)
+	if err != nil {
+		return output, err
+	}
+	defer stop()
+	defer conn.Close()
+	defer client.Close()
+
+	files, err := client.ReadDir(s.filename(directory))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return output, nil
+		}
+		return output, s.contextError(ctx, err)
+	}
+
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			output = append(output, Object{Name: f.Name(), Size: f.Size(), ModTime: f.ModTime()})
+		}
+	}
+	return output, nil
+}
+
+func (s *Sftp) Delete(ctx context.Context, name string) error {
+	client, conn, stop, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	defer conn.Close()
+	defer client.Close()
+
+	return s.contextError(ctx, client.Remove(s.filename(name)))
+}
+
+func (s *Sftp) Location(name string) string {
+	return fmt.Sprintf("sftp://%s%s", s.address, path.Join("/", s.filename(name)))
+}
+
+func (s *Sftp) filename(name string) string {
+	if s.path == "" {
+		return path.Join(".", name)
+	}
+	return path.Join(s.path, name)
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startSftpServer serves the sftp subsystem on the local file system to a user with a password, until the test ends
+func startSftpServer(t *testing.T, username string, password string) string {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if c.User() == username && string(p) == password {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSftp(conn, config)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveSftp(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for c := range channels {
+		if c.ChannelType() != "session" {
+			c.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := c.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for r := range requests {
+				ok := r.Type == "subsystem" && string(r.Payload[4:]) == "sftp"
+				r.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					server.Serve()
+					server.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestSftp(t *testing.T) {
+	address := startSftpServer(t, "backup", "s3cret")
+	directory := t.TempDir()
+
+	st, err := New(models.DestinationSettings{
+		Name:                  "sftp",
+		Type:                  TypeSftp,
+		Address:               address,
+		Path:                  filepath.ToSlash(directory),
+		Username:              "backup",
+		Password:              "s3cret",
+		InsecureIgnoreHostKey: true,
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStorage(t, st, func() io.Reader {
+		return unknownSize{&failingReader{data: []byte("partial")}}
+	})
+
+	// The failed upload must not leave its temporary file behind
+	files, err := ioutil.ReadDir(filepath.Join(directory, "prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".part") || strings.HasPrefix(f.Name(), "20260103") {
+			t.Errorf("failed upload left %s", f.Name())
+		}
+	}
+
+	testCancelledPut(t, st)
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"github.com/jantytgat/citrixadc-backup/secrets"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	TypeLocal  = "local"
+	TypeS3     = "s3"
+	TypeSftp   = "sftp"
+	TypeWebdav = "webdav"
+)
+
+// Object is a stored file. Name is relative to the directory it was listed in.
+type Object struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage stores archives on a destination.
+// Names are slash-separated and relative to the root of the destination.
+// Operations stop when ctx is done, a reader returned by Get stops when the ctx it was opened with is done.
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the files directly in directory, or nothing when directory does not exist
+	List(ctx context.Context, directory string) ([]Object, error)
+	Delete(ctx context.Context, name string) error
+	// Location describes where name is stored, for logging and reporting
+	Location(name string) string
+}
+
+// FilePutter is implemented by storages which can store a local file more efficiently than by reading it
+type FilePutter interface {
+	PutFile(ctx context.Context, name string, filename string) error
+}
+
+// Deduplicator is implemented by storages which keep a single copy of identical files in a content-addressed store,
+// where every name of a file is a link to its copy in the store
+type Deduplicator interface {
+	// PutDeduplicated stores filename as name, and links name to the copy in the store of the file with the same sha256 hash
+	PutDeduplicated(ctx context.Context, name string, filename string, hash string) error
+	// Collect deletes the copies in the store which no name links to anymore, and returns their number and size
+	Collect(ctx context.Context) (int, int64, error)
+	// Usage returns the number of bytes the names take on the destination, where names which link to the same file are counted once
+	Usage(ctx context.Context, names []string) (int64, error)
+}
+
+// DeduplicationError is returned when a file was stored, but could not be linked to the store
+type DeduplicationError struct {
+	Name string
+	Err  error
+}
+
+func (e *DeduplicationError) Error() string {
+	return fmt.Sprintf("could not deduplicate %s: %v", e.Name, e.Err)
+}
+
+func (e *DeduplicationError) Unwrap() error {
+	return e.Err
+}
+
+// Options apply to every destination
+type Options struct {
+	KeystorePath string
+	// Private restricts access to the stored files to their owner, where the destination supports it
+	Private bool
+}
+
+// New returns the Storage for a destination. Credentials may refer to secrets.
+func New(d models.DestinationSettings, o Options) (Storage, error) {
+	switch d.Type {
+	case TypeLocal:
+		return newLocal(d, o)
+	case TypeS3:
+		return newS3(d, o)
+	case TypeSftp:
+		return newSftp(d, o)
+	case TypeWebdav:
+		return newWebdav(d, o)
+	default:
+		return nil, fmt.Errorf("destination %s: unknown type %s", d.Name, d.Type)
+	}
+}
+
+// Join joins the elements of a name, ignoring empty elements
+func Join(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+// contextReader stops reading from r once ctx is done, for copies which do not take a context themselves
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// size returns the number of bytes which can be read from r, or -1 when it is unknown
+func size(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := v.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+func resolve(d models.DestinationSettings, field string, reference string, keystorePath string) (string, error) {
+	value, err := secrets.Resolve(reference, keystorePath)
+	if err != nil {
+		return "", fmt.Errorf("destination %s: could not resolve %s: %v", d.Name, field, err)
+	}
+	return value, nil
+}
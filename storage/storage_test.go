@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errUploadFailed = errors.New("upload failed")
+
+// failingReader returns data, and fails once it is read again after wait returns
+type failingReader struct {
+	data []byte
+	wait func()
+	read bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		return copy(p, r.data), nil
+	}
+	if r.wait != nil {
+		r.wait()
+	}
+	return 0, errUploadFailed
+}
+
+// endlessReader returns data until the test ends, and signals once it was read
+type endlessReader struct {
+	once sync.Once
+	read chan struct{}
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { close(r.read) })
+	for i := range p {
+		p[i] = 'e'
+	}
+	return len(p), nil
+}
+
+// unknownSize hides the size of a reader, as the size of a stream is unknown
+type unknownSize struct {
+	io.Reader
+}
+
+// testCancelledPut cancels an upload which never ends, which must stop with the error of its context
+func testCancelledPut(t *testing.T, st Storage) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &endlessReader{read: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- st.Put(ctx, "prod/20260104_010000_prod_node1.tgz", unknownSize{r})
+	}()
+
+	<-r.read
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled upload returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload did not stop when its context was cancelled")
+	}
+}
+
+// testStorage stores, lists, reads and deletes the archives of a target on st, as a backup and its retention do
+func testStorage(t *testing.T, st Storage, partial func() io.Reader) {
+	t.Helper()
+
+	objects, err := st.List(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("list of missing directory failed: %v", err)
+	}
+	if len(objects) != 0 {
+		t.Fatalf("missing directory lists %d objects", len(objects))
+	}
+
+	archives := map[string][]byte{
+		"20260101_010000_prod_node1.tgz":               bytes.Repeat([]byte("a"), 1000),
+		"20260101_010000_prod_node1.tgz.manifest.json": []byte(`{"target":"prod"}`),
+		"20260102_010000_prod_node1.tgz":               bytes.Repeat([]byte("b"), 2000),
+	}
+	for name, content := range archives {
+		// Archives are streamed with an unknown size, manifests are stored from memory
+		var r io.Reader = bytes.NewReader(content)
+		if strings.HasSuffix(name, ".tgz") {
+			r = unknownSize{r}
+		}
+		if err = st.Put(context.Background(), Join("prod", name), r); err != nil {
+			t.Fatalf("put %s failed: %v", name, err)
+		}
+	}
+	// Files in other directories are not listed
+	if err = st.Put(context.Background(), "prod/other/20260101_010000_prod_node2.tgz", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err = st.Put(context.Background(), "20260101_010000_prod_node3.tgz", strings.NewReader("root")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Put(context.Background(), "prod/20260103_010000_prod_node1.tgz", partial()); err == nil {
+		t.Fatal("put of a failing reader succeeded")
+	}
+
+	objects, err = st.List(context.Background(), "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range objects {
+		names = append(names, o.Name)
+		if content, found := archives[o.Name]; found && o.Size != int64(len(content)) {
+			t.Errorf("%s has size %d, want %d", o.Name, o.Size, len(content))
+		}
+	}
+	sort.Strings(names)
+	want := []string{"20260101_010000_prod_node1.tgz", "20260101_010000_prod_node1.tgz.manifest.json", "20260102_010000_prod_node1.tgz"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("listed %v, want %v without partial uploads", names, want)
+	}
+
+	r, err := st.Get(context.Background(), "prod/20260102_010000_prod_node1.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, archives["20260102_010000_prod_node1.tgz"]) {
+		t.Errorf("read %d bytes which differ from the stored archive", len(content))
+	}
+
+	if err = st.Delete(context.Background(), "prod/20260101_010000_prod_node1.tgz"); err != nil {
+		t.Fatal(err)
+	}
+	objects, err = st.List(context.Background(), "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("listed %d objects after delete, want 2", len(objects))
+	}
+
+	if _, err = st.Get(context.Background(), "prod/20260101_010000_prod_node1.tgz"); err == nil {
+		t.Error("deleted archive can still be read")
+	}
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Webdav stores files on a WebDAV server.
+// Servers which only accept HTTP PUT can be used to store archives, but not for retention or restore, which need PROPFIND and GET.
+type Webdav struct {
+	url      *url.URL
+	prefix   string
+	username string
+	password string
+	client   *http.Client
+}
+
+// webdavMultistatus is the response to a PROPFIND request
+type webdavMultistatus struct {
+	Responses []struct {
+		Href         string    `xml:"href"`
+		Collection   *struct{} `xml:"propstat>prop>resourcetype>collection"`
+		Length       int64     `xml:"propstat>prop>getcontentlength"`
+		LastModified string    `xml:"propstat>prop>getlastmodified"`
+	} `xml:"response"`
+}
+
+// webdavDeleteAttempts limits the attempts to delete what is left of a failed upload.
+// The server may still hold the lock of the upload, or still be writing it, when the upload fails on the client.
+const webdavDeleteAttempts = 6
+
+// webdavDeleteDelay is the delay before the second attempt to delete a failed upload, which doubles with each attempt
+const webdavDeleteDelay = 100 * time.Millisecond
+
+// webdavConnectTimeout limits the time to connect to the server and to wait for the response to a request.
+// The transfer of a file itself is only limited by the context of the operation, as archives can be large.
+const webdavConnectTimeout = 30 * time.Second
+
+// webdavCleanupTimeout limits the time to delete a failed upload, which is also deleted when the upload was cancelled
+const webdavCleanupTimeout = time.Minute
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+func newWebdav(d models.DestinationSettings, o Options) (*Webdav, error) {
+	if d.Url == "" {
+		return nil, fmt.Errorf("destination %s: url is required", d.Name)
+	}
+
+	u, err := url.Parse(d.Url)
+	if err != nil {
+		return nil, fmt.Errorf("destination %s: %v", d.Name, err)
+	}
+	w := &Webdav{
+		url:    u,
+		prefix: strings.Trim(d.Path, "/"),
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: webdavConnectTimeout}).DialContext,
+				TLSClientConfig:       &tls.Config{InsecureSkipVerify: d.InsecureSkipVerify},
+				TLSHandshakeTimeout:   webdavConnectTimeout,
+				ResponseHeaderTimeout: webdavConnectTimeout,
+			},
+		},
+	}
+
+	if d.Username != "" {
+		w.username, err = resolve(d, "username", d.Username, o.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+		w.password, err = resolve(d, "password", d.Password, o.KeystorePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *Webdav) Put(ctx context.Context, name string, r io.Reader) error {
+	// Collections are created one level at a time below the url, existing collections are answered with 405 Method Not Allowed
+	name = Join(w.prefix, name)
+	elements := strings.Split(path.Dir(name), "/")
+	for i := range elements {
+		if elements[i] == "." {
+			break
+		}
+		response, err := w.do(ctx, "MKCOL", strings.Join(elements[:i+1], "/")+"/", nil, nil)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("could not create collection %s: %s", strings.Join(elements[:i+1], "/"), response.Status)
+		}
+	}
+
+	// A server may keep the part of the file it received before an upload failed, so the file is deleted when the upload fails
+	response, err := w.do(ctx, http.MethodPut, name, r, nil)
+	if err != nil {
+		w.deletePartial(name)
+		return err
+	}
+	defer response.Body.Close()
+	err = w.checkStatus(response, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		w.deletePartial(name)
+	}
+	return err
+}
+
+// deletePartial deletes what is left of a failed upload, name must include the Path of the destination.
+// It is retried until the server confirms the file is gone, as a server which is still busy with the upload answers with an error such as 423 Locked.
+// It does not use the context of the upload, so the file is also deleted when the upload was cancelled.
+func (w *Webdav) deletePartial(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), webdavCleanupTimeout)
+	defer cancel()
+
+	delay := webdavDeleteDelay
+	for attempt := 1; attempt <= webdavDeleteAttempts; attempt++ {
+		response, err := w.do(ctx, http.MethodDelete, name, nil, nil)
+		if err == nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+			if response.StatusCode < 300 || response.StatusCode == http.StatusNotFound {
+				return
+			}
+		}
+		if attempt < webdavDeleteAttempts {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+}
+
+func (w *Webdav) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	name = Join(w.prefix, name)
+	response, err := w.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = w.checkStatus(response, http.StatusOK); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (w *Webdav) List(ctx context.Context, directory string) ([]Object, error) {
+	var output []Object
+
+	directory = Join(w.prefix, directory)
+	if directory != "" {
+		directory += "/"
+	}
+
+	response, err := w.do(ctx, "PROPFIND", directory, strings.NewReader(webdavPropfind), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		return output, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return output, nil
+	}
+	if err = w.checkStatus(response, http.StatusMultiStatus); err != nil {
+		return output, err
+	}
+
+	var multistatus webdavMultistatus
+	err = xml.NewDecoder(response.Body).Decode(&multistatus)
+	if err != nil {
+		return output, err
+	}
+
+	for _, r := range multistatus.Responses {
+		if r.Collection != nil {
+			continue
+		}
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return output, err
+		}
+		o := Object{Name: path.Base(href.Path), Size: r.Length}
+		if t, err := http.ParseTime(r.LastModified); err == nil {
+			o.ModTime = t
+		}
+		output = append(output, o)
+	}
+	return output, nil
+}
+
+func (w *Webdav) Delete(ctx context.Context, name string) error {
+	name = Join(w.prefix, name)
+	response, err := w.do(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return w.checkStatus(response, http.StatusOK, http.StatusNoContent)
+}
+
+func (w *Webdav) Location(name string) string {
+	return w.resolveUrl(Join(w.prefix, name))
+}
+
+// resolveUrl returns the url of name relative to Url, so name must include the Path of the destination
+func (w *Webdav) resolveUrl(name string) string {
+	u := *w.url
+	u.Path = path.Join(u.Path, name)
+	if strings.HasSuffix(name, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (w *Webdav) do(ctx context.Context, method string, name string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, w.resolveUrl(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if w.username != "" {
+		request.SetBasicAuth(w.username, w.password)
+	}
+	// Not every server accepts chunked uploads, so the length is sent when it is known
+	if body != nil && request.ContentLength == 0 {
+		if l := size(body); l > 0 {
+			request.ContentLength = l
+		}
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	return w.client.Do(request)
+}
+
+func (w *Webdav) checkStatus(response *http.Response, expected ...int) error {
+	for _, e := range expected {
+		if response.StatusCode == e {
+			return nil
+		}
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	return fmt.Errorf("%s %s: %s", response.Request.Method, response.Request.URL.Redacted(), response.Status)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"github.com/jantytgat/citrixadc-backup/models"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// signalingBody signals once the server has received a part of an upload
+type signalingBody struct {
+	io.ReadCloser
+	once     *sync.Once
+	received chan struct{}
+}
+
+func (b signalingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.once.Do(func() { close(b.received) })
+	}
+	return n, err
+}
+
+func TestWebdav(t *testing.T) {
+	var once sync.Once
+	received := make(chan struct{})
+	handler := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "backup" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// Only the failing upload signals, so it fails while the server holds the lock of its file
+		if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/20260103_010000_prod_node1.tgz") {
+			r.Body = signalingBody{ReadCloser: r.Body, once: &once, received: received}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	st, err := New(models.DestinationSettings{
+		Name:     "webdav",
+		Type:     TypeWebdav,
+		Url:      server.URL + "/",
+		Path:     "backups",
+		Username: "backup",
+		Password: "s3cret",
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The upload only fails once the server stored a part of it, so its file is locked when it is deleted
+	testStorage(t, st, func() io.Reader {
+		return &failingReader{data: []byte("partial"), wait: func() { <-received }}
+	})
+
+	testCancelledPut(t, st)
+}
+
+func TestWebdavRetriesDeleteOfFailedUpload(t *testing.T) {
+	var deletes int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case http.MethodPut:
+			io.Copy(ioutil.Discard, r.Body)
+			w.WriteHeader(http.StatusInsufficientStorage)
+		case http.MethodDelete:
+			// The server still holds the lock of the upload for the first attempts
+			deletes++
+			if deletes < 3 {
+				w.WriteHeader(http.StatusLocked)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	st, err := New(models.DestinationSettings{Name: "webdav", Type: TypeWebdav, Url: server.URL}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = st.Put(context.Background(), "prod/20260101_010000_prod_node1.tgz", strings.NewReader("archive")); err == nil {
+		t.Fatal("put succeeded while the server is out of space")
+	}
+	if deletes != 3 {
+		t.Errorf("deleted the failed upload %d times, want 3", deletes)
+	}
+}